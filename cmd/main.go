@@ -20,7 +20,7 @@ import (
 
 	_ "github.com/egfanboy/mediapire-media-host/internal/health"
 	_ "github.com/egfanboy/mediapire-media-host/internal/settings"
-	_ "github.com/egfanboy/mediapire-media-host/internal/transfers"
+	"github.com/egfanboy/mediapire-media-host/internal/transfers"
 
 	// APIs - end
 
@@ -29,6 +29,9 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+// how long routes that are not streamed have to write their response
+const apiWriteTimeout = time.Second * 15
+
 func main() {
 	initiliazeApp()
 }
@@ -88,18 +91,32 @@ func initiliazeApp() {
 
 	log.Debug().Msgf("Finished scanning media in %s", time.Since(t))
 
+	// index changes are saved in batches, the last ones are written before exiting
+	addCleanupFunc(media.SaveMediaIndex)
+
 	log.Debug().Msg("Starting webserver")
 	mainRouter := mux.NewRouter()
 
+	// streams and archives write for as long as the client reads them so they have no write deadline
+	media.BuildRawRoutes(mainRouter)
+	transfers.BuildRawRoutes(mainRouter)
+
+	// every other route answers within the deadline, matched after the raw routes
+	apiRouter := mainRouter.NewRoute().Subrouter()
+	apiRouter.Use(func(next http.Handler) http.Handler {
+		return http.TimeoutHandler(next, apiWriteTimeout, "request timed out")
+	})
+
 	for _, c := range app.GetApp().ControllerRegistry.GetControllers() {
 		for _, b := range c.GetApis() {
-			b.Build(mainRouter)
+			b.Build(apiRouter)
 		}
 	}
 
 	srv := &http.Server{
-		Addr:         fmt.Sprintf("0.0.0.0:%d", mediaHost.Port),
-		WriteTimeout: time.Second * 15,
+		Addr: fmt.Sprintf("0.0.0.0:%d", mediaHost.Port),
+		// deadlines are per route, see apiWriteTimeout
+		WriteTimeout: 0,
 		ReadTimeout:  time.Second * 15,
 		IdleTimeout:  time.Second * 60,
 		Handler:      mainRouter,
@@ -34,6 +34,13 @@ var a *App
 
 var o = sync.Once{}
 
+// Controllers register themselves when their package is initialised, before the config is read
+var controllerRegistry = router.NewControllerRegistry()
+
+func RegisterController(c router.Controller) {
+	controllerRegistry.Register(c)
+}
+
 func initApp() {
 	if a == nil {
 		config, err := readConfig()
@@ -43,7 +50,7 @@ func initApp() {
 			os.Exit(1)
 			return
 		}
-		a = &App{ControllerRegistry: router.NewControllerRegistry(), config: config}
+		a = &App{ControllerRegistry: controllerRegistry, config: config}
 	}
 
 	// Create the download path from the config in case it does not exist
@@ -70,7 +77,3 @@ func GetApp() *App {
 
 	return a
 }
-
-func init() {
-	initApp()
-}
@@ -48,6 +48,26 @@ type consulCfg struct {
 	Port    int    `yaml:"port"`
 }
 
+type artCfg struct {
+	// Maximum amount of resized art kept on disk
+	ThumbnailCacheLimit int `yaml:"thumbnailCacheLimit"`
+}
+
+type scanCfg struct {
+	// Decode every frame of mp3 files instead of reading their duration from the Xing/VBRI header or estimating it
+	ExactMp3Duration bool `yaml:"exactMp3Duration"`
+}
+
+type organiseCfg struct {
+	// Path of organised items relative to their directory, see the organise api for the fields
+	Template string `yaml:"template"`
+}
+
+const (
+	defaultThumbnailCacheLimit = 1000
+	defaultOrganiseTemplate    = "{albumartist}/{year} - {album}/{disc}-{track:02} {title}.{ext}"
+)
+
 type config struct {
 	Name        string    `yaml:"name"`
 	Directories []string  `yaml:"directories"`
@@ -59,6 +79,9 @@ type config struct {
 		Port     int    `yaml:"port"`
 		Address  string `yaml:"address"`
 	} `yaml:"rabbit"`
+	Art          artCfg      `yaml:"art"`
+	Scan         scanCfg     `yaml:"scan"`
+	Organise     organiseCfg `yaml:"organise"`
 	SelfCfg      `yaml:"mediaHost"`
 	DownloadPath string `yaml:"-"`
 	ArtPath      string `yaml:"-"`
@@ -109,5 +132,13 @@ func readConfig() (s config, err error) {
 
 	s.ArtPath = artPath
 
+	if s.Art.ThumbnailCacheLimit <= 0 {
+		s.Art.ThumbnailCacheLimit = defaultThumbnailCacheLimit
+	}
+
+	if s.Organise.Template == "" {
+		s.Organise.Template = defaultOrganiseTemplate
+	}
+
 	return
 }
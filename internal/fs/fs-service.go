@@ -28,6 +28,8 @@ const (
 	eventProcessingInterval = time.Second * 10
 	// Maximum amount of events
 	eventBuffer = 100
+	// A rename is reported as a rename of the old path immediately followed by a create of the new one
+	renamePairingWindow = time.Second
 )
 
 var (
@@ -39,6 +41,9 @@ type fsWatcher struct {
 	deleteBatchProcessor         utils.AsyncBatchProcessor[fsnotify.Event]
 	nonDestructiveBatchProcessor utils.AsyncBatchProcessor[fsnotify.Event]
 	directory                    string
+	// last path renamed to a path that is not known yet, only used by the goroutine reading the events
+	lastRename   string
+	lastRenameAt time.Time
 }
 
 func (w *fsWatcher) ProcessEvents(events []fsnotify.Event) {
@@ -255,6 +260,9 @@ func (s *fsService) handleWatcherEvent(event fsnotify.Event, watcher *fsWatcher)
 			_, err := os.Stat(event.Name)
 			if err != nil {
 				if os.IsNotExist(err) {
+					watcher.lastRename = event.Name
+					watcher.lastRenameAt = time.Now()
+
 					watcher.deleteBatchProcessor.Add(event)
 					return nil
 				}
@@ -268,6 +276,14 @@ func (s *fsService) handleWatcherEvent(event fsnotify.Event, watcher *fsWatcher)
 		return nil
 
 	default:
+		if event.Op == fsnotify.Create && watcher.lastRename != "" {
+			if time.Since(watcher.lastRenameAt) < renamePairingWindow {
+				s.mediaService.RegisterMove(watcher.lastRename, event.Name)
+			}
+
+			watcher.lastRename = ""
+		}
+
 		watcher.nonDestructiveBatchProcessor.Add(event)
 
 	}
@@ -44,5 +44,5 @@ func initController() healthController {
 }
 
 func init() {
-	app.GetApp().ControllerRegistry.Register(initController())
+	app.RegisterController(initController())
 }
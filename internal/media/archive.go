@@ -0,0 +1,118 @@
+package media
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
+
+	"github.com/rs/zerolog/log"
+)
+
+// A file on disk and the path it will have within an archive
+type archiveEntry struct {
+	id         string
+	sourcePath string
+	targetPath string
+}
+
+/*
+** Writes the entries to w as a zip archive. Files are copied one at a time straight into
+** the writer so memory stays bounded regardless of the size of the archive.
+ */
+func writeArchive(w io.Writer, entries []archiveEntry) error {
+	zipWriter := zip.NewWriter(w)
+
+	for _, entry := range entries {
+		log.Debug().Msgf("adding item with id %q to archive", entry.id)
+
+		err := addFileToArchive(zipWriter, entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return zipWriter.Close()
+}
+
+// Folder of the item in a download, items without an album are at the root of the archive
+func getArchiveAlbumFolder(item types.MediaItem) string {
+	info, ok := getTrackInfo(item)
+	if !ok {
+		return ""
+	}
+
+	// the album is a single folder, separators and dot folders would nest or escape it
+	return strings.TrimRight(strings.TrimSpace(unsafePathCharacters.ReplaceAllString(info.Album, "_")), ". ")
+}
+
+/*
+** Path of the entry made unique among the paths already in the archive, ie Song (2).mp3. Extractors ignore case
+** on some platforms so paths that only differ by case also collide.
+ */
+func uniqueArchivePath(used map[string]bool, targetPath string) string {
+	ext := path.Ext(targetPath)
+	base := strings.TrimSuffix(targetPath, ext)
+
+	unique := targetPath
+	for i := 2; used[strings.ToLower(unique)]; i++ {
+		unique = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+
+	used[strings.ToLower(unique)] = true
+
+	return unique
+}
+
+func addFileToArchive(zipWriter *zip.Writer, entry archiveEntry) error {
+	file, err := os.Open(entry.sourcePath)
+	if err != nil {
+		log.Err(err).Msgf("Failed to open item with id %q", entry.id)
+		return err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+
+	header.Name = entry.targetPath
+	header.Method = zip.Deflate
+
+	writer, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		log.Err(err).Msgf("Failed to create archive entry for item with id %q", entry.id)
+		return err
+	}
+
+	if _, err := io.Copy(writer, file); err != nil {
+		log.Err(err).Msgf("Failed to copy file to archive for item with id %q", entry.id)
+		return err
+	}
+
+	return nil
+}
+
+// Keeps track of whether anything was written, once a response started its status can no longer change
+type countingWriter struct {
+	w       io.Writer
+	written int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.written += int64(n)
+
+	return n, err
+}
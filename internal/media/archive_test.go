@@ -0,0 +1,47 @@
+package media
+
+import (
+	"testing"
+
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
+)
+
+func TestGetArchiveAlbumFolder(t *testing.T) {
+	cases := map[string]struct {
+		item     types.MediaItem
+		expected string
+	}{
+		"album":          {item: types.MediaItem{Metadata: Mp3Metadata{Album: "Album"}}, expected: "Album"},
+		"untagged":       {item: types.MediaItem{Metadata: Mp3Metadata{}}, expected: ""},
+		"video":          {item: types.MediaItem{Metadata: MatroskaMetadata{Title: "Movie"}}, expected: ""},
+		"no metadata":    {item: types.MediaItem{}, expected: ""},
+		"separators":     {item: types.MediaItem{Metadata: Mp3Metadata{Album: "AC/DC\\Live"}}, expected: "AC_DC_Live"},
+		"parent folder":  {item: types.MediaItem{Metadata: Mp3Metadata{Album: ".."}}, expected: ""},
+		"trailing dots":  {item: types.MediaItem{Metadata: Mp3Metadata{Album: " Vol. 1... "}}, expected: "Vol. 1"},
+		"absolute album": {item: types.MediaItem{Metadata: Mp3Metadata{Album: "/etc"}}, expected: "_etc"},
+	}
+
+	for name, c := range cases {
+		if folder := getArchiveAlbumFolder(c.item); folder != c.expected {
+			t.Errorf("%s: expected %q, got %q", name, c.expected, folder)
+		}
+	}
+}
+
+func TestUniqueArchivePath(t *testing.T) {
+	used := make(map[string]bool)
+
+	for _, expected := range []string{"Song.mp3", "Song (2).mp3", "Song (3).mp3"} {
+		if unique := uniqueArchivePath(used, "Song.mp3"); unique != expected {
+			t.Fatalf("expected %q, got %q", expected, unique)
+		}
+	}
+
+	if unique := uniqueArchivePath(used, "SONG.mp3"); unique != "SONG (4).mp3" {
+		t.Fatalf("paths differing only by case should collide, got %q", unique)
+	}
+
+	if unique := uniqueArchivePath(used, "Album/Song.mp3"); unique != "Album/Song.mp3" {
+		t.Fatalf("same name in another folder should be kept, got %q", unique)
+	}
+}
@@ -0,0 +1,329 @@
+package media
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/egfanboy/mediapire-common/exceptions"
+	"github.com/egfanboy/mediapire-media-host/internal/app"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// marks resized art in the art directory so it can be told apart from the originals
+	thumbnailMarker = ".thumb-"
+	maxArtDimension = 2048
+	jpegQuality     = 85
+	// art is embedded in files we do not control, larger images are not decoded
+	maxArtPixels = 25_000_000
+)
+
+// Requested dimensions of art, the zero value returns the original image
+type ArtOptions struct {
+	// maximum width and height, the aspect ratio is kept
+	Size int
+	// exact width, the height follows the aspect ratio. Takes precedence over Size
+	Width int
+}
+
+func (o ArtOptions) isResized() bool {
+	return o.Size > 0 || o.Width > 0
+}
+
+func (o ArtOptions) validate() error {
+	if o.Size < 0 || o.Width < 0 || o.Size > maxArtDimension || o.Width > maxArtDimension {
+		return &exceptions.ApiException{
+			StatusCode: http.StatusBadRequest,
+			Err:        fmt.Errorf("art size and width must be between 0 and %d, 0 keeps the original size", maxArtDimension),
+		}
+	}
+
+	return nil
+}
+
+// Suffix of the cached file for these options, ie .thumb-w120
+func (o ArtOptions) cacheSuffix() string {
+	if o.Width > 0 {
+		return fmt.Sprintf("%sw%d", thumbnailMarker, o.Width)
+	}
+
+	return fmt.Sprintf("%ss%d", thumbnailMarker, o.Size)
+}
+
+// Dimensions of the resized image, images are never scaled up
+func (o ArtOptions) targetSize(width, height int) (int, int) {
+	scale := 1.0
+
+	if o.Width > 0 {
+		scale = float64(o.Width) / float64(width)
+	} else if width >= height {
+		scale = float64(o.Size) / float64(width)
+	} else {
+		scale = float64(o.Size) / float64(height)
+	}
+
+	if scale >= 1 {
+		return width, height
+	}
+
+	targetWidth := int(float64(width)*scale + 0.5)
+	targetHeight := int(float64(height)*scale + 0.5)
+
+	if targetWidth < 1 {
+		targetWidth = 1
+	}
+
+	if targetHeight < 1 {
+		targetHeight = 1
+	}
+
+	return targetWidth, targetHeight
+}
+
+func getThumbnailPath(cacheKey string, options ArtOptions, format string) string {
+	return path.Join(app.GetApp().ArtPath, fmt.Sprintf("%s%s.%s", cacheKey, options.cacheSuffix(), format))
+}
+
+// Returns the cached resized art, png is only used for sources that can have transparency
+func readCachedThumbnail(cacheKey string, options ArtOptions) ([]byte, bool) {
+	for _, format := range []string{"jpg", "png"} {
+		thumbnailPath := getThumbnailPath(cacheKey, options, format)
+
+		data, err := os.ReadFile(thumbnailPath)
+		if err != nil {
+			continue
+		}
+
+		// keep track of usage so eviction removes the least recently used thumbnails, on disk for the next start
+		now := time.Now()
+		os.Chtimes(thumbnailPath, now, now)
+		resizedArt.Touch(path.Base(thumbnailPath), now)
+
+		return data, true
+	}
+
+	return nil, false
+}
+
+/*
+** Scales the art down to the requested size. Png art is kept as png to preserve transparency,
+** everything else is encoded as jpeg. Formats the standard library cannot decode are returned as is.
+ */
+func resizeArt(art *mediaArt, options ArtOptions) (*mediaArt, error) {
+	// the header is enough to know how much memory decoding takes
+	config, _, err := image.DecodeConfig(bytes.NewReader(art.Data))
+	if err != nil {
+		log.Debug().Err(err).Msgf("cannot decode art of format %s, returning it as is", art.Format)
+		return art, nil
+	}
+
+	if int64(config.Width)*int64(config.Height) > maxArtPixels {
+		return nil, &exceptions.ApiException{
+			StatusCode: http.StatusUnprocessableEntity,
+			Err:        fmt.Errorf("art of %dx%d is too large to resize", config.Width, config.Height),
+		}
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(art.Data))
+	if err != nil {
+		log.Debug().Err(err).Msgf("cannot decode art of format %s, returning it as is", art.Format)
+		return art, nil
+	}
+
+	bounds := src.Bounds()
+	width, height := options.targetSize(bounds.Dx(), bounds.Dy())
+
+	resized := src
+	if width != bounds.Dx() || height != bounds.Dy() {
+		resized = scaleDown(src, width, height)
+	}
+
+	buf := new(bytes.Buffer)
+	result := &mediaArt{Format: "jpg"}
+
+	if art.Format == "png" {
+		result.Format = "png"
+		err = png.Encode(buf, resized)
+	} else {
+		err = jpeg.Encode(buf, resized, &jpeg.Options{Quality: jpegQuality})
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	result.Data = buf.Bytes()
+
+	return result, nil
+}
+
+// Box filter: every target pixel is the average of the source pixels it covers
+func scaleDown(src image.Image, width, height int) image.Image {
+	bounds := src.Bounds()
+
+	source := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(source, source.Bounds(), src, bounds.Min, draw.Src)
+
+	target := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	xRatio := float64(bounds.Dx()) / float64(width)
+	yRatio := float64(bounds.Dy()) / float64(height)
+
+	for y := 0; y < height; y++ {
+		startY := int(float64(y) * yRatio)
+		endY := int(float64(y+1) * yRatio)
+		if endY <= startY {
+			endY = startY + 1
+		}
+
+		for x := 0; x < width; x++ {
+			startX := int(float64(x) * xRatio)
+			endX := int(float64(x+1) * xRatio)
+			if endX <= startX {
+				endX = startX + 1
+			}
+
+			var r, g, b, a, count uint64
+
+			for sy := startY; sy < endY; sy++ {
+				offset := source.PixOffset(startX, sy)
+
+				for sx := startX; sx < endX; sx++ {
+					pixel := source.Pix[offset : offset+4]
+					r += uint64(pixel[0])
+					g += uint64(pixel[1])
+					b += uint64(pixel[2])
+					a += uint64(pixel[3])
+					count++
+					offset += 4
+				}
+			}
+
+			targetOffset := target.PixOffset(x, y)
+			target.Pix[targetOffset] = uint8(r / count)
+			target.Pix[targetOffset+1] = uint8(g / count)
+			target.Pix[targetOffset+2] = uint8(b / count)
+			target.Pix[targetOffset+3] = uint8(a / count)
+		}
+	}
+
+	return target
+}
+
+/*
+** Last use of the thumbnails in the art directory. The directory is listed once, afterwards thumbnails are
+** tracked as they are written and read so caching one does not go through the whole directory.
+ */
+type thumbnailTracker struct {
+	mu     sync.Mutex
+	loaded bool
+	// file name -> last use
+	usedAt map[string]time.Time
+}
+
+var resizedArt = &thumbnailTracker{usedAt: make(map[string]time.Time)}
+
+// Reads the thumbnails already on disk, the caller holds the lock
+func (t *thumbnailTracker) load() {
+	if t.loaded {
+		return
+	}
+
+	entries, err := os.ReadDir(app.GetApp().ArtPath)
+	if err != nil {
+		log.Err(err).Msg("Failed to list cached art")
+		return
+	}
+
+	t.loaded = true
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.Contains(entry.Name(), thumbnailMarker) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		// thumbnails used since the start are already tracked
+		if _, ok := t.usedAt[entry.Name()]; !ok {
+			t.usedAt[entry.Name()] = info.ModTime()
+		}
+	}
+}
+
+func (t *thumbnailTracker) Touch(name string, usedAt time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.load()
+	t.usedAt[name] = usedAt
+}
+
+/*
+** Removes the least recently used thumbnails once there are more than limit of them. A tenth of the limit is
+** freed at once so the thumbnails are not sorted again on every write once the cache is full.
+ */
+func (t *thumbnailTracker) Evict(limit int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.load()
+
+	if len(t.usedAt) <= limit {
+		return
+	}
+
+	names := make([]string, 0, len(t.usedAt))
+	for name := range t.usedAt {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		return t.usedAt[names[i]].Before(t.usedAt[names[j]])
+	})
+
+	artPath := app.GetApp().ArtPath
+
+	for _, name := range names[:len(names)-(limit-limit/10)] {
+		err := os.Remove(path.Join(artPath, name))
+		if err != nil && !os.IsNotExist(err) {
+			log.Err(err).Msgf("Failed to evict resized art %s", name)
+			continue
+		}
+
+		delete(t.usedAt, name)
+	}
+}
+
+func cacheThumbnail(cacheKey string, options ArtOptions, art *mediaArt) {
+	thumbnailPath := getThumbnailPath(cacheKey, options, art.Format)
+
+	// garbage collection cannot remove the temporary file while it is written
+	store := getArtStore()
+	store.files.RLock()
+	err := writeArtFile(thumbnailPath, art.Data)
+	store.files.RUnlock()
+
+	if err != nil {
+		log.Err(err).Msg("Failed to cache resized art")
+		return
+	}
+
+	resizedArt.Touch(path.Base(thumbnailPath), time.Now())
+	resizedArt.Evict(app.GetApp().Art.ThumbnailCacheLimit)
+}
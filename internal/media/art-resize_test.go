@@ -0,0 +1,44 @@
+package media
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestArtOptionsValidate(t *testing.T) {
+	valid := []ArtOptions{{}, {Size: 1}, {Width: maxArtDimension}, {Size: 0, Width: 120}}
+	invalid := []ArtOptions{{Size: -1}, {Width: -1}, {Size: maxArtDimension + 1}, {Width: maxArtDimension + 1}}
+
+	for _, options := range valid {
+		if err := options.validate(); err != nil {
+			t.Errorf("%+v should be valid: %v", options, err)
+		}
+	}
+
+	for _, options := range invalid {
+		if err := options.validate(); err == nil {
+			t.Errorf("%+v should be invalid", options)
+		}
+	}
+}
+
+func TestWriteArtFileLeavesNoTemporaryFile(t *testing.T) {
+	dir := t.TempDir()
+	artPath := filepath.Join(dir, "hash.thumb-s120.jpg")
+
+	err := writeArtFile(artPath, []byte("image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != "hash.thumb-s120.jpg" {
+		t.Fatalf("expected only the art in the folder, got %v", entries)
+	}
+
+	if content, _ := os.ReadFile(artPath); !bytes.Equal(content, []byte("image")) {
+		t.Fatalf("got content %q", content)
+	}
+}
@@ -0,0 +1,275 @@
+package media
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/egfanboy/mediapire-media-host/internal/app"
+	"github.com/rs/zerolog/log"
+)
+
+const artIndexFileName = "art.json"
+
+// Art of a media item, the file in the art directory is named <Hash>.<Format>
+type artRef struct {
+	Hash   string `json:"hash"`
+	Format string `json:"format"`
+}
+
+func (r artRef) fileName() string {
+	return fmt.Sprintf("%s.%s", r.Hash, r.Format)
+}
+
+/*
+** Content addressed store for art. Images are saved once per distinct content no matter how many
+** items share them, and the index keeps track of which image belongs to which media item.
+ */
+type artStore struct {
+	mu    sync.Mutex
+	refs  map[string]artRef
+	dirty bool
+	// held for reading while art is written and referenced, for writing while unreferenced art is deleted
+	files sync.RWMutex
+}
+
+var (
+	mediaArtStore *artStore
+	artStoreOnce  sync.Once
+)
+
+func getArtStore() *artStore {
+	artStoreOnce.Do(func() {
+		mediaArtStore = &artStore{refs: make(map[string]artRef)}
+
+		err := mediaArtStore.load()
+		if err != nil {
+			log.Err(err).Msg("Failed to load the art index, art will be extracted again")
+		}
+	})
+
+	return mediaArtStore
+}
+
+func hashArt(data []byte) string {
+	hash := sha256.Sum256(data)
+
+	return hex.EncodeToString(hash[:])
+}
+
+func getArtIndexPath() (string, error) {
+	basePath, err := app.GetBasePath()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(basePath, artIndexFileName), nil
+}
+
+func (s *artStore) load() error {
+	indexPath, err := getArtIndexPath()
+	if err != nil {
+		return err
+	}
+
+	content, err := os.ReadFile(indexPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	return json.Unmarshal(content, &s.refs)
+}
+
+// Returns the path of the art of a media item, os.ErrNotExist if it is not stored
+func (s *artStore) Path(mediaId string) (string, artRef, error) {
+	s.mu.Lock()
+	ref, ok := s.refs[mediaId]
+	s.mu.Unlock()
+
+	if !ok {
+		return "", artRef{}, os.ErrNotExist
+	}
+
+	artPath := path.Join(app.GetApp().ArtPath, ref.fileName())
+
+	if _, err := os.Stat(artPath); err != nil {
+		return "", artRef{}, err
+	}
+
+	return artPath, ref, nil
+}
+
+/*
+** Writes next to the final file and renames it so readers never see a partial image, items sharing art can write it
+** at the same time. The temporary file starts with the hash so garbage collection knows what it belongs to.
+ */
+func writeArtFile(artPath string, data []byte) error {
+	tmp, err := os.CreateTemp(path.Dir(artPath), path.Base(artPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), artPath)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+// Saves the art and associates it to the media item, content already on disk is not written again
+func (s *artStore) Put(mediaId string, art *mediaArt) (artRef, error) {
+	ref := artRef{Hash: hashArt(art.Data), Format: art.Format}
+
+	artPath := path.Join(app.GetApp().ArtPath, ref.fileName())
+
+	// garbage collection cannot delete the file before it is referenced
+	s.files.RLock()
+	defer s.files.RUnlock()
+
+	if _, err := os.Stat(artPath); os.IsNotExist(err) {
+		err = writeArtFile(artPath, art.Data)
+		if err != nil {
+			return ref, err
+		}
+	}
+
+	s.mu.Lock()
+	s.refs[mediaId] = ref
+	s.dirty = true
+	s.mu.Unlock()
+
+	return ref, nil
+}
+
+func (s *artStore) Remove(mediaId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.refs[mediaId]; ok {
+		delete(s.refs, mediaId)
+		s.dirty = true
+	}
+}
+
+// Writes the index to disk if it changed since the last save
+func (s *artStore) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.dirty {
+		return nil
+	}
+
+	content, err := json.Marshal(s.refs)
+	if err != nil {
+		return err
+	}
+
+	indexPath, err := getArtIndexPath()
+	if err != nil {
+		return err
+	}
+
+	// write next to the index and rename so a crash never leaves a partially written index
+	tmpPath := indexPath + ".tmp"
+
+	err = os.WriteFile(tmpPath, content, os.ModePerm)
+	if err != nil {
+		log.Err(err).Msg("Failed to save the art index")
+		return err
+	}
+
+	err = os.Rename(tmpPath, indexPath)
+	if err != nil {
+		log.Err(err).Msg("Failed to replace the art index on disk")
+		return err
+	}
+
+	s.dirty = false
+
+	return nil
+}
+
+/*
+** Drops the references of media that no longer exists and deletes the art, and its resized variants,
+** that is not referenced by any media. Anything in the art directory that is not a referenced hash,
+** such as art cached before the store was content addressed, is removed.
+ */
+func (s *artStore) CollectGarbage(existingIds map[string]bool) {
+	// art being written is referenced before the lock is released, temporary files left behind are safe to delete
+	s.files.Lock()
+	defer s.files.Unlock()
+
+	s.mu.Lock()
+
+	referenced := make(map[string]bool)
+
+	for mediaId, ref := range s.refs {
+		if !existingIds[mediaId] {
+			delete(s.refs, mediaId)
+			s.dirty = true
+			continue
+		}
+
+		referenced[ref.Hash] = true
+	}
+
+	s.mu.Unlock()
+
+	// thumbnails are evicted at the same time to not race with the removal of their original
+	resizedArt.mu.Lock()
+	defer resizedArt.mu.Unlock()
+
+	artPath := app.GetApp().ArtPath
+
+	entries, err := os.ReadDir(artPath)
+	if err != nil {
+		log.Err(err).Msg("Failed to list art for garbage collection")
+		return
+	}
+
+	removed := 0
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		// file names start with the hash, followed by either the format or a thumbnail marker
+		hash, _, _ := strings.Cut(entry.Name(), ".")
+		if referenced[hash] && !strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+
+		err := os.Remove(path.Join(artPath, entry.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			log.Err(err).Msgf("Failed to remove unused art %s", entry.Name())
+			continue
+		}
+
+		delete(resizedArt.usedAt, entry.Name())
+		removed++
+	}
+
+	log.Debug().Msgf("Removed %d unused art files", removed)
+
+	s.Save()
+}
@@ -0,0 +1,286 @@
+package media
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/dhowden/tag"
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
+	"github.com/rs/zerolog/log"
+)
+
+var artItemChan = make(chan types.MediaItem, 10)
+
+// Image file names, without extension, commonly used to store the art of an album next to its tracks
+var sidecarArtNames = []string{"cover", "folder", "front", "album", "albumart", "poster"}
+
+// Image formats supported for sidecar art and their mime types
+var artFormats = map[string]string{
+	"jpg":  "image/jpeg",
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+	"bmp":  "image/bmp",
+}
+
+type mediaArt struct {
+	Data []byte
+	// file extension of the image format, ie jpg or png
+	Format string
+}
+
+// Extracts the art embedded in a media file, returns nil if the file has none
+type artExtractor func(item types.MediaItem) (*mediaArt, error)
+
+var artExtractors = map[string]artExtractor{
+	"mp3":  embeddedTagArtExtractor,
+	"flac": embeddedTagArtExtractor,
+	"m4a":  mp4ArtExtractor,
+	"m4b":  mp4ArtExtractor,
+	"mp4":  mp4ArtExtractor,
+	"m4v":  mp4ArtExtractor,
+	"mkv":  matroskaArtExtractor,
+	"mka":  matroskaArtExtractor,
+	"webm": matroskaArtExtractor,
+	"wav":  pcmArtExtractor,
+	"aiff": pcmArtExtractor,
+	"aif":  pcmArtExtractor,
+	"ogg":  oggArtExtractor,
+	"opus": oggArtExtractor,
+}
+
+// Whether items of this type can have art, either embedded or in a sidecar file
+func isArtSupported(ext string) bool {
+	_, ok := artExtractors[ext]
+
+	return ok
+}
+
+// Reads the picture from the tags of formats supported by the tag library (ID3 and Vorbis comments)
+func embeddedTagArtExtractor(item types.MediaItem) (*mediaArt, error) {
+	file, err := os.OpenFile(item.Path, 0, fs.FileMode(os.O_RDONLY))
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	m, err := tag.ReadFrom(file)
+	if err != nil {
+		return nil, err
+	}
+
+	picture := m.Picture()
+	if picture == nil || len(picture.Data) == 0 {
+		return nil, nil
+	}
+
+	return &mediaArt{Data: picture.Data, Format: detectImageFormat(picture.Data)}, nil
+}
+
+// Reads the picture of the id3 chunk
+func pcmArtExtractor(item types.MediaItem) (*mediaArt, error) {
+	file, err := os.OpenFile(item.Path, 0, fs.FileMode(os.O_RDONLY))
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	info, err := readPcmInfo(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Id3 == nil {
+		return nil, nil
+	}
+
+	picture := info.Id3.Picture()
+	if picture == nil || len(picture.Data) == 0 {
+		return nil, nil
+	}
+
+	return &mediaArt{Data: picture.Data, Format: detectImageFormat(picture.Data)}, nil
+}
+
+// Reads the METADATA_BLOCK_PICTURE comment, the tag library does not handle it and does not read opus comments
+func oggArtExtractor(item types.MediaItem) (*mediaArt, error) {
+	file, err := os.OpenFile(item.Path, 0, fs.FileMode(os.O_RDONLY))
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	streamInfo, err := readOggStreamInfo(file)
+	if err != nil {
+		return nil, err
+	}
+
+	picture := streamInfo.Comments.picture()
+	if len(picture) == 0 {
+		return nil, nil
+	}
+
+	return &mediaArt{Data: picture, Format: detectImageFormat(picture)}, nil
+}
+
+// Reads the covr atom of the file
+func mp4ArtExtractor(item types.MediaItem) (*mediaArt, error) {
+	file, err := os.OpenFile(item.Path, 0, fs.FileMode(os.O_RDONLY))
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	info, err := readMp4Info(file)
+	if err != nil {
+		return nil, err
+	}
+
+	cover := info.cover()
+	if len(cover) == 0 {
+		return nil, nil
+	}
+
+	return &mediaArt{Data: cover, Format: detectImageFormat(cover)}, nil
+}
+
+// Uses the image attachments of the file, cover.jpg or cover.png are preferred
+func matroskaArtExtractor(item types.MediaItem) (*mediaArt, error) {
+	file, err := os.OpenFile(item.Path, 0, fs.FileMode(os.O_RDONLY))
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	attachments, err := readMatroskaAttachments(file)
+	if err != nil {
+		return nil, err
+	}
+
+	cover := matroskaCover(attachments)
+	if len(cover) == 0 {
+		return nil, nil
+	}
+
+	return &mediaArt{Data: cover, Format: detectImageFormat(cover)}, nil
+}
+
+// Looks for an image such as cover.jpg or folder.png in the directory of the item
+func sidecarArt(item types.MediaItem) (*mediaArt, error) {
+	entries, err := os.ReadDir(item.ParentDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range sidecarArtNames {
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+
+			ext := strings.TrimPrefix(filepath.Ext(entry.Name()), ".")
+			baseName := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+
+			if _, ok := artFormats[strings.ToLower(ext)]; !ok || !strings.EqualFold(baseName, name) {
+				continue
+			}
+
+			data, err := os.ReadFile(path.Join(item.ParentDir, entry.Name()))
+			if err != nil {
+				return nil, err
+			}
+
+			return &mediaArt{Data: data, Format: detectImageFormat(data)}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Returns the embedded art of an item, falling back to sidecar images in its directory
+func getArtForItem(item types.MediaItem) (*mediaArt, error) {
+	if extractor, ok := artExtractors[item.Extension]; ok {
+		art, err := extractor(item)
+		if err != nil {
+			log.Debug().Err(err).Msgf("could not read embedded art for item %q", item.Id)
+		}
+
+		if art != nil {
+			return art, nil
+		}
+	}
+
+	return sidecarArt(item)
+}
+
+// Uses the content of the image to determine its format instead of trusting the file or tag
+func detectImageFormat(data []byte) string {
+	switch http.DetectContentType(data) {
+	case "image/png":
+		return "png"
+	case "image/gif":
+		return "gif"
+	case "image/webp":
+		return "webp"
+	case "image/bmp":
+		return "bmp"
+	default:
+		return "jpg"
+	}
+}
+
+func processArtItem() {
+	store := getArtStore()
+
+	for value := range artItemChan {
+		log.Debug().Msgf("handling art for file: %s", value.Path)
+
+		_, _, err := store.Path(value.Id)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Err(err).Msgf("could not read cached art for %s", value.Name)
+		}
+
+		if err != nil {
+			cacheArtForItem(store, value)
+		}
+
+		// save the index once there is nothing left to process instead of after every item
+		if len(artItemChan) == 0 {
+			store.Save()
+		}
+	}
+}
+
+func cacheArtForItem(store *artStore, item types.MediaItem) {
+	art, err := getArtForItem(item)
+	if err != nil {
+		log.Err(err).Msgf("could not get art for item %s", item.Name)
+		return
+	}
+
+	if art == nil {
+		return
+	}
+
+	log.Debug().Msgf("writing art to disk for file: %s", item.Path)
+
+	_, err = store.Put(item.Id, art)
+	if err != nil {
+		log.Err(err).Msgf("could not cache art for item %s", item.Name)
+	}
+}
+
+func init() {
+	go processArtItem()
+}
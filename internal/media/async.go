@@ -6,11 +6,13 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/egfanboy/mediapire-common/messaging"
 	"github.com/egfanboy/mediapire-media-host/internal/app"
 	"github.com/egfanboy/mediapire-media-host/internal/rabbitmq"
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
 	"github.com/rabbitmq/amqp091-go"
 	"github.com/rs/zerolog/log"
 )
@@ -57,14 +59,9 @@ func handleTransferMessage(ctx context.Context, msg amqp091.Delivery) error {
 
 	mediaService := NewMediaService()
 
-	content, err := mediaService.DownloadMedia(ctx, input)
-	if err != nil {
-		msg := err.Error()
-		sendTransferUpdateMessage(ctx, tMsg.Id, &msg)
-		return err
-	}
+	transferPath := path.Join(appInstance.DownloadPath, tMsg.Id+".zip")
 
-	file, err := os.Create(path.Join(appInstance.DownloadPath, tMsg.Id+".zip"))
+	file, err := os.Create(transferPath)
 	if err != nil {
 		msg := err.Error()
 		sendTransferUpdateMessage(ctx, tMsg.Id, &msg)
@@ -73,10 +70,14 @@ func handleTransferMessage(ctx context.Context, msg amqp091.Delivery) error {
 
 	defer file.Close()
 
-	_, err = file.Write(content)
+	// archive is written to disk as it is created instead of being built in memory first
+	err = mediaService.DownloadMedia(ctx, input, file)
 	if err != nil {
-		msg := "Failed to write content to file"
-		log.Err(err).Msg(msg)
+		msg := err.Error()
+		log.Err(err).Msg("Failed to write transfer content to file")
+
+		file.Close()
+		os.Remove(transferPath)
 
 		sendTransferUpdateMessage(ctx, tMsg.Id, &msg)
 		return err
@@ -147,19 +148,35 @@ func handleUpdateMedia(ctx context.Context, msg amqp091.Delivery) error {
 
 		return nil
 	} else {
-		for _, item := range items {
-			mediaService := NewMediaService()
+		mediaService := NewMediaService()
+		// items already changed by this changeset, restored if a later item fails
+		updated := make([]string, 0, len(items))
 
+		for _, item := range items {
 			_, err := mediaService.UpdateItem(ctx, item.MediaId, item.Content)
 			if err != nil {
 				msg := fmt.Sprintf("failed to update item %s", item.MediaId)
 				log.Err(err).Msg(msg)
 
+				if failed := rollbackUpdatedItems(ctx, mediaService, updated); len(failed) > 0 {
+					msg = fmt.Sprintf("%s, could not roll back items %s", msg, strings.Join(failed, ", "))
+				} else if len(updated) > 0 {
+					msg = fmt.Sprintf("%s, the rest of the changeset was rolled back", msg)
+				}
+
 				sendMediaUpdateMessage(ctx, message.ChangesetId, &msg)
 
 				return err
 			}
 
+			updated = append(updated, item.MediaId)
+		}
+
+		for _, mediaId := range updated {
+			err := mediaService.DiscardItemBackup(ctx, mediaId)
+			if err != nil {
+				log.Err(err).Msgf("Failed to remove previous content of item %s", mediaId)
+			}
 		}
 
 		sendMediaUpdateMessage(ctx, message.ChangesetId, nil)
@@ -169,6 +186,75 @@ func handleUpdateMedia(ctx context.Context, msg amqp091.Delivery) error {
 	return nil
 }
 
+// Restores the items to their content before the changeset, latest update first. Returns the items that could not be restored
+func rollbackUpdatedItems(ctx context.Context, mediaService MediaApi, updated []string) (failed []string) {
+	for i := len(updated) - 1; i >= 0; i-- {
+		_, err := mediaService.RestoreItem(ctx, updated[i])
+		if err != nil {
+			log.Err(err).Msgf("Failed to roll back item %s", updated[i])
+
+			failed = append(failed, updated[i])
+		}
+	}
+
+	return
+}
+
+func handlePatchMediaMetadata(ctx context.Context, msg amqp091.Delivery) error {
+	log.Info().Msgf("Handling message for %s", types.TopicPatchMediaMetadata)
+
+	var message types.PatchMediaMetadataMessage
+	err := json.Unmarshal(msg.Body, &message)
+	if err != nil {
+		log.Err(err).Msg("failed to unmarshal message")
+
+		return err
+	}
+
+	items, ok := message.Items[app.GetApp().NodeId]
+	if !ok {
+		log.Info().Msgf("Ignoring message for %s since no patches are for this node.", types.TopicPatchMediaMetadata)
+
+		return nil
+	}
+
+	mediaService := NewMediaService()
+	// items already patched by this changeset, restored if a later item fails
+	patched := make([]string, 0, len(items))
+
+	for _, item := range items {
+		_, err := mediaService.PatchItemMetadata(ctx, item.MediaId, item.Patch)
+		if err != nil {
+			msg := fmt.Sprintf("failed to patch metadata of item %s", item.MediaId)
+			log.Err(err).Msg(msg)
+
+			if failed := rollbackUpdatedItems(ctx, mediaService, patched); len(failed) > 0 {
+				msg = fmt.Sprintf("%s, could not roll back items %s", msg, strings.Join(failed, ", "))
+			} else if len(patched) > 0 {
+				msg = fmt.Sprintf("%s, the rest of the changeset was rolled back", msg)
+			}
+
+			sendMediaUpdateMessage(ctx, message.ChangesetId, &msg)
+
+			return err
+		}
+
+		patched = append(patched, item.MediaId)
+	}
+
+	for _, mediaId := range patched {
+		err := mediaService.DiscardItemBackup(ctx, mediaId)
+		if err != nil {
+			log.Err(err).Msgf("Failed to remove previous content of item %s", mediaId)
+		}
+	}
+
+	sendMediaUpdateMessage(ctx, message.ChangesetId, nil)
+
+	log.Info().Msgf("Finished handling message for topic %s", types.TopicPatchMediaMetadata)
+	return nil
+}
+
 func sendMediaUpdateMessage(ctx context.Context, changesetId string, failureReason *string) {
 	msg := messaging.MediaUpdatedMessage{
 		ChangesetId: changesetId,
@@ -188,8 +274,21 @@ func sendMediaUpdateMessage(ctx context.Context, changesetId string, failureReas
 	}
 }
 
+func sendMediaMovedMessage(ctx context.Context, items []types.MovedMediaItem) {
+	msg := types.MediaMovedMessage{
+		NodeId: app.GetApp().NodeId,
+		Items:  items,
+	}
+
+	err := rabbitmq.PublishMessage(ctx, types.TopicMediaMoved, msg)
+	if err != nil {
+		log.Err(err).Msg("Failed to send media moved message")
+	}
+}
+
 func init() {
 	rabbitmq.RegisterConsumer(handleTransferMessage, messaging.TopicTransfer)
 	rabbitmq.RegisterConsumer(handleDeleteMessage, messaging.TopicDeleteMedia)
 	rabbitmq.RegisterConsumer(handleUpdateMedia, messaging.TopicUpdateMedia)
+	rabbitmq.RegisterConsumer(handlePatchMediaMetadata, types.TopicPatchMediaMetadata)
 }
@@ -0,0 +1,393 @@
+package media
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
+)
+
+// Item of the browse index with the groups it belongs to, ids are empty when the tag is missing
+type browseTrack struct {
+	item     types.MediaItem
+	info     trackInfo
+	artistId string
+	albumId  string
+	genreId  string
+}
+
+type browseGroup struct {
+	id string
+	// display values taken from the first item added to the group
+	name   string
+	artist string
+	year   int
+	// ids of the items in the group
+	items map[string]bool
+	// total length of the items, updated as they are added and removed
+	length float64
+	// album id -> items of the group in that album, only used for artists
+	albums map[string]int
+	// first item in order that can have art, looked up again when listing after the members changed
+	artId    string
+	artStale bool
+}
+
+/*
+** Artists, albums and genres of the items with tags. Membership, counts and lengths are updated as items are added
+** and removed, the sorted lists are built when listing and kept until the next change.
+ */
+type browseIndex struct {
+	mu      sync.Mutex
+	tracks  map[string]browseTrack
+	artists map[string]*browseGroup
+	albums  map[string]*browseGroup
+	genres  map[string]*browseGroup
+	// sorted lists, nil until listed after a change
+	artistList []types.Artist
+	albumList  []types.Album
+	genreList  []types.Genre
+}
+
+var mediaBrowseIndex = &browseIndex{
+	tracks:  make(map[string]browseTrack),
+	artists: make(map[string]*browseGroup),
+	albums:  make(map[string]*browseGroup),
+	genres:  make(map[string]*browseGroup),
+}
+
+// Opaque id of a group derived from its identity, it stays the same across restarts and rescans
+func getBrowseGroupId(kind string, parts ...string) string {
+	hash := sha256.Sum256([]byte(kind + "\x00" + strings.Join(parts, "\x00")))
+
+	return hex.EncodeToString(hash[:12])
+}
+
+// Adds or replaces an item in the index, items without tags are not part of any group
+func (b *browseIndex) Add(item types.MediaItem) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.remove(item.Id)
+
+	info, ok := getTrackInfo(item)
+	if !ok {
+		return
+	}
+
+	track := browseTrack{item: item, info: info}
+	key := getAlbumKey(info)
+
+	artist := strings.TrimSpace(info.AlbumArtist)
+	if artist == "" {
+		artist = strings.TrimSpace(info.Artist)
+	}
+
+	if key.album != "" {
+		track.albumId = getBrowseGroupId("album", key.artist, key.album, strconv.Itoa(key.year))
+	}
+
+	if genre := strings.TrimSpace(info.Genre); genre != "" {
+		track.genreId = getBrowseGroupId("genre", strings.ToLower(genre))
+	}
+
+	if key.artist != "" {
+		track.artistId = getBrowseGroupId("artist", key.artist)
+
+		if group := addToBrowseGroup(b.artists, track.artistId, track); group.name == "" {
+			group.name = artist
+		}
+	}
+
+	if track.albumId != "" {
+		if group := addToBrowseGroup(b.albums, track.albumId, track); group.name == "" {
+			group.name = strings.TrimSpace(info.Album)
+			group.artist = artist
+			group.year = info.Year
+		}
+	}
+
+	if track.genreId != "" {
+		if group := addToBrowseGroup(b.genres, track.genreId, track); group.name == "" {
+			group.name = strings.TrimSpace(info.Genre)
+		}
+	}
+
+	b.tracks[item.Id] = track
+	b.invalidateLists()
+}
+
+func (b *browseIndex) Remove(id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.remove(id)
+}
+
+func (b *browseIndex) remove(id string) {
+	track, ok := b.tracks[id]
+	if !ok {
+		return
+	}
+
+	removeFromBrowseGroup(b.artists, track.artistId, track)
+	removeFromBrowseGroup(b.albums, track.albumId, track)
+	removeFromBrowseGroup(b.genres, track.genreId, track)
+
+	delete(b.tracks, id)
+	b.invalidateLists()
+}
+
+func (b *browseIndex) invalidateLists() {
+	b.artistList = nil
+	b.albumList = nil
+	b.genreList = nil
+}
+
+func addToBrowseGroup(groups map[string]*browseGroup, groupId string, track browseTrack) *browseGroup {
+	group, ok := groups[groupId]
+	if !ok {
+		group = &browseGroup{id: groupId, items: make(map[string]bool), albums: make(map[string]int)}
+		groups[groupId] = group
+	}
+
+	group.items[track.item.Id] = true
+	group.length += track.info.Length
+	group.artStale = true
+
+	if track.albumId != "" {
+		group.albums[track.albumId]++
+	}
+
+	return group
+}
+
+// Removes the item from the group and drops the group once it is empty
+func removeFromBrowseGroup(groups map[string]*browseGroup, groupId string, track browseTrack) {
+	group, ok := groups[groupId]
+	if !ok {
+		return
+	}
+
+	delete(group.items, track.item.Id)
+
+	if len(group.items) == 0 {
+		delete(groups, groupId)
+		return
+	}
+
+	group.length -= track.info.Length
+	group.artStale = true
+
+	if track.albumId != "" {
+		group.albums[track.albumId]--
+
+		if group.albums[track.albumId] == 0 {
+			delete(group.albums, track.albumId)
+		}
+	}
+}
+
+// Orders tracks by album then by their position in it, the name keeps the order stable
+func browseTrackLess(a browseTrack, b browseTrack) bool {
+	albumA, albumB := strings.ToLower(a.info.Album), strings.ToLower(b.info.Album)
+	if albumA != albumB {
+		return albumA < albumB
+	}
+
+	if trackLess(a.info, b.info) {
+		return true
+	}
+
+	if trackLess(b.info, a.info) {
+		return false
+	}
+
+	if a.item.Name != b.item.Name {
+		return a.item.Name < b.item.Name
+	}
+
+	return a.item.Id < b.item.Id
+}
+
+// Tracks of the group in order
+func (b *browseIndex) groupTracks(group *browseGroup) []browseTrack {
+	tracks := make([]browseTrack, 0, len(group.items))
+
+	for id := range group.items {
+		tracks = append(tracks, b.tracks[id])
+	}
+
+	sort.Slice(tracks, func(i, j int) bool {
+		return browseTrackLess(tracks[i], tracks[j])
+	})
+
+	return tracks
+}
+
+// Id of the first track of the group that can have art, only the groups that changed since the last listing are looked at
+func (b *browseIndex) groupArtId(group *browseGroup) string {
+	if !group.artStale {
+		return group.artId
+	}
+
+	var first *browseTrack
+
+	for id := range group.items {
+		track := b.tracks[id]
+
+		if isArtSupported(track.item.Extension) && (first == nil || browseTrackLess(track, *first)) {
+			first = &track
+		}
+	}
+
+	group.artId = ""
+	if first != nil {
+		group.artId = first.item.Id
+	}
+
+	group.artStale = false
+
+	return group.artId
+}
+
+// Artists in alphabetical order
+func (b *browseIndex) Artists() []types.Artist {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.artistList != nil {
+		return b.artistList
+	}
+
+	artists := make([]types.Artist, 0, len(b.artists))
+
+	for _, group := range b.artists {
+		artists = append(artists, types.Artist{
+			Id:         group.id,
+			Name:       group.name,
+			AlbumCount: len(group.albums),
+			TrackCount: len(group.items),
+			Length:     group.length,
+			ArtId:      b.groupArtId(group),
+		})
+	}
+
+	sort.Slice(artists, func(i, j int) bool {
+		nameI, nameJ := strings.ToLower(artists[i].Name), strings.ToLower(artists[j].Name)
+		if nameI != nameJ {
+			return nameI < nameJ
+		}
+
+		return artists[i].Id < artists[j].Id
+	})
+
+	b.artistList = artists
+
+	return artists
+}
+
+// Albums in alphabetical order, albums with the same title are ordered by artist then year
+func (b *browseIndex) Albums() []types.Album {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.albumList != nil {
+		return b.albumList
+	}
+
+	albums := make([]types.Album, 0, len(b.albums))
+
+	for _, group := range b.albums {
+		albums = append(albums, types.Album{
+			Id:         group.id,
+			Title:      group.name,
+			Artist:     group.artist,
+			Year:       group.year,
+			TrackCount: len(group.items),
+			Length:     group.length,
+			ArtId:      b.groupArtId(group),
+		})
+	}
+
+	sort.Slice(albums, func(i, j int) bool {
+		titleI, titleJ := strings.ToLower(albums[i].Title), strings.ToLower(albums[j].Title)
+		if titleI != titleJ {
+			return titleI < titleJ
+		}
+
+		artistI, artistJ := strings.ToLower(albums[i].Artist), strings.ToLower(albums[j].Artist)
+		if artistI != artistJ {
+			return artistI < artistJ
+		}
+
+		if albums[i].Year != albums[j].Year {
+			return albums[i].Year < albums[j].Year
+		}
+
+		return albums[i].Id < albums[j].Id
+	})
+
+	b.albumList = albums
+
+	return albums
+}
+
+// Genres in alphabetical order
+func (b *browseIndex) Genres() []types.Genre {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.genreList != nil {
+		return b.genreList
+	}
+
+	genres := make([]types.Genre, 0, len(b.genres))
+
+	for _, group := range b.genres {
+		genres = append(genres, types.Genre{
+			Id:         group.id,
+			Name:       group.name,
+			TrackCount: len(group.items),
+			Length:     group.length,
+			ArtId:      b.groupArtId(group),
+		})
+	}
+
+	sort.Slice(genres, func(i, j int) bool {
+		nameI, nameJ := strings.ToLower(genres[i].Name), strings.ToLower(genres[j].Name)
+		if nameI != nameJ {
+			return nameI < nameJ
+		}
+
+		return genres[i].Id < genres[j].Id
+	})
+
+	b.genreList = genres
+
+	return genres
+}
+
+// Tracks of the album ordered by disc then track, false when there is no such album
+func (b *browseIndex) AlbumTracks(albumId string) ([]types.MediaItem, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	group, ok := b.albums[albumId]
+	if !ok {
+		return nil, false
+	}
+
+	tracks := b.groupTracks(group)
+
+	items := make([]types.MediaItem, len(tracks))
+	for i, track := range tracks {
+		items[i] = track.item
+	}
+
+	return items, true
+}
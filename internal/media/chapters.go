@@ -0,0 +1,195 @@
+package media
+
+import (
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
+)
+
+const (
+	// CTOC flag of the table of contents that is not a child of another one
+	id3CtocTopLevel = 0x02
+)
+
+// Genres of items that are grouped as audiobooks even without a series
+var audiobookGenres = map[string]bool{
+	"audiobook":  true,
+	"audiobooks": true,
+	"audio book": true,
+}
+
+// Metadata of media types that can have chapters
+type chapteredMetadata interface {
+	chapters() []types.Chapter
+}
+
+func (m Mp3Metadata) chapters() []types.Chapter {
+	return m.Chapters
+}
+
+func (m Mp4Metadata) chapters() []types.Chapter {
+	return m.Chapters
+}
+
+// m4b files are always audiobooks, other items are when they belong to a series or have an audiobook genre
+func isAudiobook(item types.MediaItem) bool {
+	if item.Extension == "m4b" {
+		return true
+	}
+
+	info, ok := getTrackInfo(item)
+	if !ok {
+		return false
+	}
+
+	return info.Series != "" || audiobookGenres[strings.ToLower(strings.TrimSpace(info.Genre))]
+}
+
+// Volume of a series such as "2", "2.5" or "2/7", 0 when it is not a number
+func parseVolume(value string) float64 {
+	value, _, _ = strings.Cut(value, "/")
+
+	volume, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return 0
+	}
+
+	return volume
+}
+
+// Chapters that only have a start end where the next one starts, the last one at the end of the item
+func completeChapterEnds(chapters []types.Chapter, length float64) []types.Chapter {
+	for i := range chapters {
+		if chapters[i].End > chapters[i].Start {
+			continue
+		}
+
+		if i+1 < len(chapters) {
+			chapters[i].End = chapters[i+1].Start
+		} else if length > chapters[i].Start {
+			chapters[i].End = length
+		}
+	}
+
+	return chapters
+}
+
+/*
+** Reads the CHAP frames of the tag, each has an element id, its start and end in milliseconds and sub-frames
+** holding its title. Chapters are in the order of the top level CTOC frame when there is one, by start otherwise.
+ */
+func id3Chapters(tag *id3Tag) []types.Chapter {
+	type id3Chapter struct {
+		id      string
+		chapter types.Chapter
+	}
+
+	chapters := make([]id3Chapter, 0)
+	order := make(map[string]int)
+
+	for _, frame := range tag.frames {
+		switch frame.id {
+		case "CHAP":
+			id, rest := splitId3String(id3EncodingLatin1, frame.data)
+			if len(rest) < 16 {
+				continue
+			}
+
+			chapter := types.Chapter{
+				Start: float64(binary.BigEndian.Uint32(rest[0:4])) / 1000,
+				End:   float64(binary.BigEndian.Uint32(rest[4:8])) / 1000,
+			}
+
+			subFrames, err := parseId3Frames(tag.version, rest[16:])
+			if err == nil {
+				for _, subFrame := range subFrames {
+					if subFrame.id == "TIT2" && len(subFrame.data) > 0 {
+						chapter.Title = decodeId3Text(subFrame.data[0], subFrame.data[1:])
+					}
+				}
+			}
+
+			chapters = append(chapters, id3Chapter{id: id, chapter: chapter})
+		case "CTOC":
+			_, rest := splitId3String(id3EncodingLatin1, frame.data)
+			if len(rest) < 2 || rest[0]&id3CtocTopLevel == 0 || len(order) > 0 {
+				continue
+			}
+
+			count := int(rest[1])
+			rest = rest[2:]
+
+			for i := 0; i < count && len(rest) > 0; i++ {
+				var child string
+				child, rest = splitId3String(id3EncodingLatin1, rest)
+				order[child] = i
+			}
+		}
+	}
+
+	sort.SliceStable(chapters, func(i, j int) bool {
+		iPosition, iListed := order[chapters[i].id]
+		jPosition, jListed := order[chapters[j].id]
+
+		if iListed && jListed {
+			return iPosition < jPosition
+		}
+
+		if iListed != jListed {
+			return iListed
+		}
+
+		return chapters[i].chapter.Start < chapters[j].chapter.Start
+	})
+
+	result := make([]types.Chapter, len(chapters))
+	for i, c := range chapters {
+		result[i] = c.chapter
+	}
+
+	return result
+}
+
+// Value of the TXXX frame with this description, descriptions are case insensitive
+func id3UserText(tag *id3Tag, description string) string {
+	for _, frame := range tag.frames {
+		if frame.id != "TXXX" || len(frame.data) < 1 {
+			continue
+		}
+
+		name, value := splitId3String(frame.data[0], frame.data[1:])
+		if strings.EqualFold(name, description) {
+			return decodeId3Text(frame.data[0], value)
+		}
+	}
+
+	return ""
+}
+
+func id3Text(tag *id3Tag, id string) string {
+	for _, frame := range tag.frames {
+		if frame.id == id && len(frame.data) > 0 {
+			return decodeId3Text(frame.data[0], frame.data[1:])
+		}
+	}
+
+	return ""
+}
+
+// Audiobook tools write the series in TXXX frames, iTunes in the movement frames
+func id3Series(tag *id3Tag) (string, float64) {
+	series := id3UserText(tag, "SERIES")
+	if series == "" {
+		series = id3Text(tag, "MVNM")
+	}
+
+	part := id3UserText(tag, "SERIES-PART")
+	if part == "" {
+		part = id3Text(tag, "MVIN")
+	}
+
+	return series, parseVolume(part)
+}
@@ -7,18 +7,31 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/egfanboy/mediapire-media-host/internal/app"
 	"github.com/egfanboy/mediapire-media-host/internal/utils"
 	"github.com/egfanboy/mediapire-media-host/pkg/types"
 	"github.com/google/uuid"
 
 	"github.com/dhowden/tag"
-	"github.com/tcolgate/mp3"
 )
 
 type mediaFactory func(path string, ext string, cache *utils.ConcurrentMap[string, string]) (item types.MediaItem, err error)
 
 var mediaTypeFactory = map[string]mediaFactory{
-	"mp3": mp3Factory,
+	"mp3":  mp3Factory,
+	"flac": flacFactory,
+	"wav":  pcmFactory,
+	"aiff": pcmFactory,
+	"aif":  pcmFactory,
+	"ogg":  oggFactory,
+	"opus": oggFactory,
+	"mp4":  mp4Factory,
+	"m4a":  mp4Factory,
+	"m4b":  mp4Factory,
+	"m4v":  mp4Factory,
+	"mkv":  matroskaFactory,
+	"mka":  matroskaFactory,
+	"webm": matroskaFactory,
 }
 
 func getFactory(ext string) mediaFactory {
@@ -66,26 +79,49 @@ func mp3Factory(path string, ext string, cache *utils.ConcurrentMap[string, stri
 
 	metadata := mp3MetadataFromTag(m)
 
-	d := mp3.NewDecoder(f)
-	songTime := 0.0
-	var frame mp3.Frame
-	skipped := 0
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
 
-	for {
-		errD := d.Decode(&frame, &skipped)
-		if errD != nil {
-			if errD == io.EOF {
-				break
-			}
+	metadata.FileSize = info.Size()
+	metadata.ModTime = info.ModTime()
+
+	// chapters and series are in frames the tag library does not expose, they are optional so a tag it cannot read is ignored
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return
+	}
 
-			err = errD
-			return
-		}
+	var chapters []types.Chapter
 
-		songTime = songTime + frame.Duration().Seconds()
+	if id3, errId3 := readId3Tag(f); errId3 == nil {
+		metadata.Series, metadata.Volume = id3Series(id3)
+		chapters = id3Chapters(id3)
+	}
+
+	err = skipId3v2Tag(f)
+	if err != nil {
+		return
+	}
+
+	streamInfo, err := readMp3StreamInfo(f, info.Size(), app.GetApp().Scan.ExactMp3Duration)
+	if err != nil {
+		return
+	}
+
+	metadata.Length = streamInfo.Length
+	metadata.BitrateAvg = streamInfo.BitrateAvg
+	metadata.BitratePeak = streamInfo.BitratePeak
+	metadata.SampleRate = streamInfo.SampleRate
+	metadata.ChannelMode = streamInfo.ChannelMode
+	metadata.Vbr = streamInfo.Vbr
+	metadata.Encoder = streamInfo.Encoder
+
+	if len(chapters) > 0 {
+		metadata.Chapters = completeChapterEnds(chapters, metadata.Length)
 	}
 
-	metadata.Length = songTime
 	item.Metadata = metadata
 	/* Use the song title as the name of the item as opposed to the file name.
 	** This is in case the name of the song was changed through metadata but the file name
@@ -95,3 +131,177 @@ func mp3Factory(path string, ext string, cache *utils.ConcurrentMap[string, stri
 
 	return
 }
+
+func flacFactory(path string, ext string, cache *utils.ConcurrentMap[string, string]) (item types.MediaItem, err error) {
+	item, err = baseFactory(path, ext, cache)
+	if err != nil {
+		return
+	}
+
+	f, err := os.OpenFile(path, 0, fs.FileMode(os.O_RDONLY))
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	m, err := tag.ReadFrom(f)
+	if err != nil {
+		return
+	}
+
+	metadata := flacMetadataFromTag(m)
+
+	// Tags were read from the same handle, go back to the start to read the STREAMINFO block
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return
+	}
+
+	streamInfo, err := readFlacStreamInfo(f)
+	if err != nil {
+		return
+	}
+
+	metadata.Length = streamInfo.Length()
+	metadata.SampleRate = streamInfo.SampleRate
+	metadata.BitDepth = streamInfo.BitDepth
+	metadata.Channels = streamInfo.Channels
+
+	item.Metadata = metadata
+
+	// Same as mp3, prefer the title from the tags but keep the file name if there is none
+	if metadata.Title != "" {
+		item.Name = metadata.Title
+	}
+
+	return
+}
+
+// Vorbis and Opus streams share the ogg container and the comment format, the codec is detected from the stream
+func oggFactory(path string, ext string, cache *utils.ConcurrentMap[string, string]) (item types.MediaItem, err error) {
+	item, err = baseFactory(path, ext, cache)
+	if err != nil {
+		return
+	}
+
+	f, err := os.OpenFile(path, 0, fs.FileMode(os.O_RDONLY))
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	streamInfo, err := readOggStreamInfo(f)
+	if err != nil {
+		return
+	}
+
+	metadata := oggMetadataFromComments(streamInfo.Comments)
+
+	lastGranule, err := readOggLastGranule(f, streamInfo.serial)
+	if err != nil {
+		return
+	}
+
+	metadata.Length = streamInfo.length(lastGranule)
+	metadata.SampleRate = streamInfo.SampleRate
+	metadata.Channels = streamInfo.Channels
+	metadata.Codec = streamInfo.Codec
+
+	item.Metadata = metadata
+
+	if metadata.Title != "" {
+		item.Name = metadata.Title
+	}
+
+	return
+}
+
+// Audio and video files of the mp4 family share the same atom structure
+func mp4Factory(path string, ext string, cache *utils.ConcurrentMap[string, string]) (item types.MediaItem, err error) {
+	item, err = baseFactory(path, ext, cache)
+	if err != nil {
+		return
+	}
+
+	f, err := os.OpenFile(path, 0, fs.FileMode(os.O_RDONLY))
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	info, err := readMp4Info(f)
+	if err != nil {
+		return
+	}
+
+	metadata := mp4MetadataFromInfo(info)
+
+	item.Metadata = metadata
+
+	if metadata.Title != "" {
+		item.Name = metadata.Title
+	}
+
+	return
+}
+
+func matroskaFactory(path string, ext string, cache *utils.ConcurrentMap[string, string]) (item types.MediaItem, err error) {
+	item, err = baseFactory(path, ext, cache)
+	if err != nil {
+		return
+	}
+
+	f, err := os.OpenFile(path, 0, fs.FileMode(os.O_RDONLY))
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	info, err := readMatroskaInfo(f)
+	if err != nil {
+		return
+	}
+
+	metadata := matroskaMetadataFromInfo(info)
+
+	item.Metadata = metadata
+
+	if metadata.Title != "" {
+		item.Name = metadata.Title
+	}
+
+	return
+}
+
+func pcmFactory(path string, ext string, cache *utils.ConcurrentMap[string, string]) (item types.MediaItem, err error) {
+	item, err = baseFactory(path, ext, cache)
+	if err != nil {
+		return
+	}
+
+	f, err := os.OpenFile(path, 0, fs.FileMode(os.O_RDONLY))
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	info, err := readPcmInfo(f)
+	if err != nil {
+		return
+	}
+
+	metadata := pcmMetadataFromInfo(info)
+
+	item.Metadata = metadata
+
+	if metadata.Title != "" {
+		item.Name = metadata.Title
+	}
+
+	return
+}
@@ -0,0 +1,193 @@
+package media
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/egfanboy/mediapire-media-host/internal/utils"
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
+)
+
+// New content of an item before it is validated and renamed over the original
+func getUpdatePath(path string) string {
+	return filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.mediapire-update", filepath.Base(path)))
+}
+
+// Previous content of an updated item, kept until its changeset is either done or rolled back
+func getBackupPath(path string) string {
+	return filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.mediapire-backup", filepath.Base(path)))
+}
+
+// Writes the content to path and flushes it to disk before returning
+func writeFileSynced(path string, content []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(content)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// Flushes a rename in the directory to disk, not every platform can sync directories so failures are ignored
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+
+	d.Sync()
+	d.Close()
+}
+
+// Makes sure the content is still a valid media file of the type of the item by parsing it with its factory
+func validateContent(item types.MediaItem, path string) error {
+	factory := getFactory(item.Extension)
+
+	_, err := factory(path, item.Extension, utils.NewConcurrentMapFromData(map[string]string{path: item.Id}))
+	if err != nil {
+		return fmt.Errorf("new content is not a valid %s file: %w", item.Extension, err)
+	}
+
+	return nil
+}
+
+// Keeps the current content of the file as its backup, a hard link is used when possible to avoid copying it
+func backupFile(path string) error {
+	backupPath := getBackupPath(path)
+
+	err := os.Remove(backupPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if os.Link(path, backupPath) == nil {
+		return nil
+	}
+
+	return copyFile(path, backupPath)
+}
+
+func copyFile(src string, dst string) error {
+	source, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer source.Close()
+
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+
+	target, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(target, source)
+	if err == nil {
+		err = target.Sync()
+	}
+
+	if err != nil {
+		target.Close()
+		os.Remove(dst)
+		return err
+	}
+
+	return target.Close()
+}
+
+/*
+** Replaces the content of the file without ever leaving it partially written. The content is written
+** to a file next to it, validated and then renamed over the original, whose content is kept as a backup.
+ */
+func replaceFileContent(item types.MediaItem, content []byte) error {
+	info, err := os.Stat(item.Path)
+	if err != nil {
+		return err
+	}
+
+	updatePath := getUpdatePath(item.Path)
+
+	err = writeFileSynced(updatePath, content, info.Mode().Perm())
+	if err != nil {
+		os.Remove(updatePath)
+		return err
+	}
+
+	return commitFileUpdate(item, updatePath)
+}
+
+// Validates the content written at the update path of the item and renames it over the file, keeping its content as a backup
+func commitFileUpdate(item types.MediaItem, updatePath string) error {
+	err := validateContent(item, updatePath)
+	if err != nil {
+		os.Remove(updatePath)
+		return err
+	}
+
+	err = backupFile(item.Path)
+	if err != nil {
+		os.Remove(updatePath)
+		return err
+	}
+
+	err = os.Rename(updatePath, item.Path)
+	if err != nil {
+		os.Remove(updatePath)
+		return err
+	}
+
+	syncDir(filepath.Dir(item.Path))
+
+	return nil
+}
+
+// Puts the backup of the file back in place
+func restoreFileBackup(path string) error {
+	err := os.Rename(getBackupPath(path), path)
+	if err != nil {
+		return err
+	}
+
+	syncDir(filepath.Dir(path))
+
+	return nil
+}
+
+// Replaces a sidecar of an item, ie its lyrics, in a single rename. Sidecars are small and get no backup
+func replaceSidecarContent(path string, content []byte) error {
+	updatePath := getUpdatePath(path)
+
+	err := writeFileSynced(updatePath, content, 0644)
+	if err != nil {
+		os.Remove(updatePath)
+		return err
+	}
+
+	err = os.Rename(updatePath, path)
+	if err != nil {
+		os.Remove(updatePath)
+		return err
+	}
+
+	syncDir(filepath.Dir(path))
+
+	return nil
+}
@@ -0,0 +1,372 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
+)
+
+const (
+	flacPaddingBlock       = 1
+	flacVorbisCommentBlock = 4
+	flacPictureBlock       = 6
+
+	flacBlockHeaderSize = 4
+	flacMaxBlockSize    = 1<<24 - 1
+	flacLastBlockFlag   = 0x80
+
+	vorbisVendor = "mediapire"
+)
+
+type flacBlock struct {
+	blockType byte
+	data      []byte
+}
+
+type flacMetadata struct {
+	blocks []flacBlock
+	// bytes before the audio frames, marker and padding included
+	size int64
+}
+
+func readFlacMetadata(r io.Reader) (*flacMetadata, error) {
+	marker := make([]byte, len(flacMarker))
+
+	_, err := io.ReadFull(r, marker)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(marker) != flacMarker {
+		return nil, errors.New("file is not a flac stream")
+	}
+
+	metadata := &flacMetadata{size: int64(len(flacMarker))}
+	header := make([]byte, flacBlockHeaderSize)
+
+	for {
+		_, err = io.ReadFull(r, header)
+		if err != nil {
+			return nil, err
+		}
+
+		block := flacBlock{blockType: header[0] &^ flacLastBlockFlag}
+		blockLength := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+
+		block.data = make([]byte, blockLength)
+
+		_, err = io.ReadFull(r, block.data)
+		if err != nil {
+			return nil, err
+		}
+
+		metadata.size += int64(flacBlockHeaderSize + blockLength)
+
+		// padding is recomputed when the blocks are written
+		if block.blockType != flacPaddingBlock {
+			metadata.blocks = append(metadata.blocks, block)
+		}
+
+		if header[0]&flacLastBlockFlag != 0 {
+			break
+		}
+	}
+
+	if len(metadata.blocks) == 0 || metadata.blocks[0].blockType != flacStreamInfoBlock {
+		return nil, errors.New("first flac metadata block is not STREAMINFO")
+	}
+
+	return metadata, nil
+}
+
+type vorbisComments struct {
+	vendor   string
+	comments []string
+}
+
+func parseVorbisComments(data []byte) (*vorbisComments, error) {
+	r := bytes.NewReader(data)
+
+	readString := func() (string, error) {
+		var length uint32
+
+		err := binary.Read(r, binary.LittleEndian, &length)
+		if err != nil {
+			return "", err
+		}
+
+		if int64(length) > int64(r.Len()) {
+			return "", errors.New("vorbis comment is larger than its block")
+		}
+
+		value := make([]byte, length)
+		_, err = io.ReadFull(r, value)
+
+		return string(value), err
+	}
+
+	vendor, err := readString()
+	if err != nil {
+		return nil, err
+	}
+
+	var count uint32
+
+	err = binary.Read(r, binary.LittleEndian, &count)
+	if err != nil {
+		return nil, err
+	}
+
+	comments := &vorbisComments{vendor: vendor}
+
+	for i := uint32(0); i < count; i++ {
+		comment, err := readString()
+		if err != nil {
+			return nil, err
+		}
+
+		comments.comments = append(comments.comments, comment)
+	}
+
+	return comments, nil
+}
+
+// Replaces every comment with this key, keys are case insensitive. An empty value only removes them
+func (c *vorbisComments) set(key string, value string) {
+	comments := make([]string, 0, len(c.comments))
+
+	for _, comment := range c.comments {
+		name, _, _ := strings.Cut(comment, "=")
+		if strings.EqualFold(name, key) {
+			continue
+		}
+
+		comments = append(comments, comment)
+	}
+
+	if value != "" {
+		comments = append(comments, fmt.Sprintf("%s=%s", key, value))
+	}
+
+	c.comments = comments
+}
+
+func (c *vorbisComments) encode() []byte {
+	buf := new(bytes.Buffer)
+
+	binary.Write(buf, binary.LittleEndian, uint32(len(c.vendor)))
+	buf.WriteString(c.vendor)
+	binary.Write(buf, binary.LittleEndian, uint32(len(c.comments)))
+
+	for _, comment := range c.comments {
+		binary.Write(buf, binary.LittleEndian, uint32(len(comment)))
+		buf.WriteString(comment)
+	}
+
+	return buf.Bytes()
+}
+
+func flacPictureType(block flacBlock) int {
+	if len(block.data) < 4 {
+		return -1
+	}
+
+	return int(binary.BigEndian.Uint32(block.data[:4]))
+}
+
+func encodeFlacPicture(art []byte) []byte {
+	mime := artFormats[detectImageFormat(art)]
+
+	// dimensions are informative, formats the standard library cannot decode leave them unset
+	var width, height, depth uint32
+	if config, _, err := image.DecodeConfig(bytes.NewReader(art)); err == nil {
+		width, height, depth = uint32(config.Width), uint32(config.Height), 24
+	}
+
+	buf := new(bytes.Buffer)
+
+	binary.Write(buf, binary.BigEndian, uint32(id3FrontCover))
+	binary.Write(buf, binary.BigEndian, uint32(len(mime)))
+	buf.WriteString(mime)
+	// empty description
+	binary.Write(buf, binary.BigEndian, uint32(0))
+	binary.Write(buf, binary.BigEndian, width)
+	binary.Write(buf, binary.BigEndian, height)
+	binary.Write(buf, binary.BigEndian, depth)
+	// amount of colors, only used by indexed images
+	binary.Write(buf, binary.BigEndian, uint32(0))
+	binary.Write(buf, binary.BigEndian, uint32(len(art)))
+	buf.Write(art)
+
+	return buf.Bytes()
+}
+
+func (m *flacMetadata) setVorbisComments(patch types.MediaMetadataPatch, current trackInfo) error {
+	index := -1
+
+	for i, block := range m.blocks {
+		if block.blockType == flacVorbisCommentBlock {
+			index = i
+			break
+		}
+	}
+
+	comments := &vorbisComments{vendor: vorbisVendor}
+
+	if index >= 0 {
+		parsed, err := parseVorbisComments(m.blocks[index].data)
+		if err != nil {
+			return err
+		}
+
+		comments = parsed
+	}
+
+	if patch.Title != nil {
+		comments.set("TITLE", *patch.Title)
+	}
+
+	if patch.Artist != nil {
+		comments.set("ARTIST", *patch.Artist)
+	}
+
+	if patch.Album != nil {
+		comments.set("ALBUM", *patch.Album)
+	}
+
+	if patch.Genre != nil {
+		comments.set("GENRE", *patch.Genre)
+	}
+
+	if trackIndex, trackOf, ok := patchedTrack(patch, current); ok {
+		comments.set("TRACKNUMBER", "")
+		comments.set("TRACKTOTAL", "")
+		comments.set("TOTALTRACKS", "")
+
+		if trackIndex > 0 {
+			comments.set("TRACKNUMBER", strconv.Itoa(trackIndex))
+
+			if trackOf > 0 {
+				comments.set("TRACKTOTAL", strconv.Itoa(trackOf))
+			}
+		}
+	}
+
+	block := flacBlock{blockType: flacVorbisCommentBlock, data: comments.encode()}
+
+	if index >= 0 {
+		m.blocks[index] = block
+	} else {
+		m.blocks = append(m.blocks, block)
+	}
+
+	return nil
+}
+
+func (m *flacMetadata) setFrontCover(art []byte) {
+	blocks := make([]flacBlock, 0, len(m.blocks)+1)
+
+	for _, block := range m.blocks {
+		if block.blockType == flacPictureBlock && flacPictureType(block) == id3FrontCover {
+			continue
+		}
+
+		blocks = append(blocks, block)
+	}
+
+	m.blocks = append(blocks, flacBlock{blockType: flacPictureBlock, data: encodeFlacPicture(art)})
+}
+
+// Marker and blocks followed by a padding block of paddingSize bytes, no padding block is written for -1
+func (m *flacMetadata) encode(paddingSize int) ([]byte, error) {
+	blocks := m.blocks
+	if paddingSize >= 0 {
+		blocks = append(blocks, flacBlock{blockType: flacPaddingBlock, data: make([]byte, paddingSize)})
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(flacMarker)
+
+	for i, block := range blocks {
+		if len(block.data) > flacMaxBlockSize {
+			return nil, fmt.Errorf("flac metadata block of type %d is too large", block.blockType)
+		}
+
+		blockType := block.blockType
+		if i == len(blocks)-1 {
+			blockType |= flacLastBlockFlag
+		}
+
+		length := len(block.data)
+		buf.Write([]byte{blockType, byte(length >> 16), byte(length >> 8), byte(length)})
+		buf.Write(block.data)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (m *flacMetadata) blocksSize() int64 {
+	size := int64(len(flacMarker))
+
+	for _, block := range m.blocks {
+		size += int64(flacBlockHeaderSize + len(block.data))
+	}
+
+	return size
+}
+
+/*
+** Applies the patch to the Vorbis comments and pictures of the flac file. The metadata keeps the size of the
+** previous blocks and padding when it fits in them so the audio does not move, otherwise it gets new padding.
+ */
+func writeFlacTags(item types.MediaItem, patch types.MediaMetadataPatch) ([]byte, int64, error) {
+	file, err := os.Open(item.Path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	metadata, err := readFlacMetadata(file)
+	file.Close()
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	current, _ := getTrackInfo(item)
+
+	err = metadata.setVorbisComments(patch, current)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(patch.Art) > 0 {
+		metadata.setFrontCover(patch.Art)
+	}
+
+	available := metadata.size - metadata.blocksSize()
+
+	var encoded []byte
+
+	switch {
+	case available == 0:
+		encoded, err = metadata.encode(-1)
+	case available >= flacBlockHeaderSize:
+		encoded, err = metadata.encode(int(available - flacBlockHeaderSize))
+	default:
+		encoded, err = metadata.encode(tagPadding)
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return encoded, metadata.size, nil
+}
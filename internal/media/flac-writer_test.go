@@ -0,0 +1,147 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
+)
+
+// 44.1kHz stereo 16 bit stream of 10 seconds
+func buildFlacStreamInfo() []byte {
+	block := make([]byte, flacStreamInfoSize)
+	packed := uint64(44100)<<44 | uint64(2-1)<<41 | uint64(16-1)<<36 | uint64(441000)
+
+	binary.BigEndian.PutUint64(block[10:18], packed)
+
+	return block
+}
+
+func buildVorbisComments(comments ...string) []byte {
+	buf := new(bytes.Buffer)
+
+	writeString := func(value string) {
+		binary.Write(buf, binary.LittleEndian, uint32(len(value)))
+		buf.WriteString(value)
+	}
+
+	writeString("test")
+	binary.Write(buf, binary.LittleEndian, uint32(len(comments)))
+
+	for _, comment := range comments {
+		writeString(comment)
+	}
+
+	return buf.Bytes()
+}
+
+func writeTestFlac(t *testing.T, padding int) types.MediaItem {
+	t.Helper()
+
+	metadata := &flacMetadata{blocks: []flacBlock{
+		{blockType: flacStreamInfoBlock, data: buildFlacStreamInfo()},
+		{blockType: flacVorbisCommentBlock, data: buildVorbisComments("TITLE=Old title", "ARTIST=Artist")},
+	}}
+
+	encoded, err := metadata.encode(padding)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return types.MediaItem{Id: "id", Extension: "flac", Path: writeTestFile(t, "track.flac", append(encoded, fakeAudio...))}
+}
+
+func assertStreamInfoKept(t *testing.T, content []byte) {
+	t.Helper()
+
+	info, err := readFlacStreamInfo(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.SampleRate != 44100 || info.Channels != 2 || info.BitDepth != 16 || info.Length() != 10 {
+		t.Fatalf("STREAMINFO was not kept, got %+v", info)
+	}
+}
+
+func TestFlacWriterFitsInPadding(t *testing.T) {
+	item := writeTestFlac(t, 1024)
+	original := len(readTestFile(t, item.Path))
+
+	content, fits := applyTagWriter(t, writeFlacTags, item, types.MediaMetadataPatch{Title: stringPtr("New title ✓")})
+
+	if !fits || len(content) != original {
+		t.Fatalf("metadata should keep its size, file went from %d to %d bytes", original, len(content))
+	}
+
+	assertAudioKept(t, content)
+	assertStreamInfoKept(t, content)
+
+	m := readTestTags(t, content)
+	if m.Title() != "New title ✓" || m.Artist() != "Artist" {
+		t.Fatalf("got title %q and artist %q", m.Title(), m.Artist())
+	}
+}
+
+func TestFlacWriterGrowsMetadataWithPadding(t *testing.T) {
+	item := writeTestFlac(t, -1)
+	title := strings.Repeat("long title ", 200)
+
+	content, fits := applyTagWriter(t, writeFlacTags, item, types.MediaMetadataPatch{Title: &title})
+	if fits {
+		t.Fatal("metadata should have grown")
+	}
+
+	assertAudioKept(t, content)
+	assertStreamInfoKept(t, content)
+
+	if m := readTestTags(t, content); m.Title() != title {
+		t.Fatalf("got title %q", m.Title())
+	}
+
+	metadata, err := readFlacMetadata(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if padding := metadata.size - metadata.blocksSize() - flacBlockHeaderSize; padding != tagPadding {
+		t.Fatalf("expected %d bytes of padding, got %d", tagPadding, padding)
+	}
+
+	// the next edit fits in the padding
+	item.Path = writeTestFile(t, "grown.flac", content)
+
+	_, fits = applyTagWriter(t, writeFlacTags, item, types.MediaMetadataPatch{Artist: stringPtr("Other artist")})
+	if !fits {
+		t.Fatal("edit after growing the metadata should fit in its padding")
+	}
+}
+
+func TestFlacWriterSetsFrontCover(t *testing.T) {
+	item := writeTestFlac(t, 0)
+
+	art := new(bytes.Buffer)
+
+	err := png.Encode(art, image.NewNRGBA(image.Rect(0, 0, 4, 4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := applyTagWriter(t, writeFlacTags, item, types.MediaMetadataPatch{Art: art.Bytes()})
+
+	assertAudioKept(t, content)
+	assertStreamInfoKept(t, content)
+
+	m := readTestTags(t, content)
+	if m.Picture() == nil || !bytes.Equal(m.Picture().Data, art.Bytes()) {
+		t.Fatal("front cover was not written")
+	}
+
+	if m.Title() != "Old title" {
+		t.Fatalf("title should have been kept, got %q", m.Title())
+	}
+}
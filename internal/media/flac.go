@@ -0,0 +1,127 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	flacMarker          = "fLaC"
+	flacStreamInfoBlock = 0
+	flacStreamInfoSize  = 34
+)
+
+type flacStreamInfo struct {
+	SampleRate   int
+	Channels     int
+	BitDepth     int
+	TotalSamples uint64
+}
+
+// Duration of the stream in seconds, 0 if the encoder did not record the total amount of samples
+func (i flacStreamInfo) Length() float64 {
+	if i.SampleRate == 0 {
+		return 0
+	}
+
+	return float64(i.TotalSamples) / float64(i.SampleRate)
+}
+
+// Reads the STREAMINFO metadata block which must be the first block after the fLaC marker
+func readFlacStreamInfo(r io.Reader) (info flacStreamInfo, err error) {
+	header := make([]byte, 8)
+
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return
+	}
+
+	if string(header[0:4]) != flacMarker {
+		err = errors.New("file is not a flac stream")
+		return
+	}
+
+	// lower 7 bits of the first byte of the block header are the block type
+	if header[4]&0x7f != flacStreamInfoBlock {
+		err = errors.New("first flac metadata block is not STREAMINFO")
+		return
+	}
+
+	blockLength := int(header[5])<<16 | int(header[6])<<8 | int(header[7])
+	if blockLength < flacStreamInfoSize {
+		err = errors.New("flac STREAMINFO block is too small")
+		return
+	}
+
+	block := make([]byte, flacStreamInfoSize)
+
+	_, err = io.ReadFull(r, block)
+	if err != nil {
+		return
+	}
+
+	/*
+	** Bytes 10 to 17 are packed as:
+	** sample rate (20 bits) | channels - 1 (3 bits) | bits per sample - 1 (5 bits) | total samples (36 bits)
+	 */
+	packed := binary.BigEndian.Uint64(block[10:18])
+
+	info.SampleRate = int(packed >> 44)
+	info.Channels = int((packed>>41)&0x7) + 1
+	info.BitDepth = int((packed>>36)&0x1f) + 1
+	info.TotalSamples = packed & 0xfffffffff
+
+	return
+}
+
+// Reads the picture type and image data of a PICTURE metadata block
+func parseFlacPicture(block []byte) (pictureType int, data []byte, err error) {
+	r := bytes.NewReader(block)
+
+	readField := func() ([]byte, error) {
+		var length uint32
+
+		err := binary.Read(r, binary.BigEndian, &length)
+		if err != nil {
+			return nil, err
+		}
+
+		if int64(length) > int64(r.Len()) {
+			return nil, errors.New("flac picture field is larger than its block")
+		}
+
+		field := make([]byte, length)
+		_, err = io.ReadFull(r, field)
+
+		return field, err
+	}
+
+	var header uint32
+
+	err = binary.Read(r, binary.BigEndian, &header)
+	if err != nil {
+		return
+	}
+
+	pictureType = int(header)
+
+	// mime type and description
+	for i := 0; i < 2; i++ {
+		_, err = readField()
+		if err != nil {
+			return
+		}
+	}
+
+	// width, height, color depth and amount of colors
+	_, err = r.Seek(16, io.SeekCurrent)
+	if err != nil {
+		return
+	}
+
+	data, err = readField()
+
+	return
+}
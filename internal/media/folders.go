@@ -0,0 +1,165 @@
+package media
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
+)
+
+// Directory holding media, or directories that do, within one of the configured directories
+type folderNode struct {
+	path string
+	// path from the configured directory, empty for the directory itself
+	relPath  string
+	items    []types.MediaItem
+	children map[string]*folderNode
+}
+
+// Opaque id of a folder, the absolute path it is derived from is never returned to clients
+func getFolderId(path string) string {
+	return getBrowseGroupId("folder", filepath.Clean(path))
+}
+
+/*
+** Builds the tree of each configured directory from the media cache, which is keyed by the directory of the items.
+** Directories without media are only part of the tree when one of their subdirectories has media.
+ */
+func buildFolderTrees(directories []string, cache map[string][]types.MediaItem) []*folderNode {
+	roots := make([]*folderNode, 0, len(directories))
+	rootsByPath := make(map[string]*folderNode)
+
+	for _, directory := range directories {
+		root := &folderNode{path: filepath.Clean(directory), children: make(map[string]*folderNode)}
+		roots = append(roots, root)
+		rootsByPath[root.path] = root
+	}
+
+	for dir, items := range cache {
+		rootPath, relPath, ok := findRootDirectory(directories, dir)
+		if !ok {
+			continue
+		}
+
+		node := rootsByPath[rootPath]
+		if relPath != "." {
+			for _, name := range strings.Split(relPath, string(filepath.Separator)) {
+				child, ok := node.children[name]
+				if !ok {
+					child = &folderNode{
+						path:     filepath.Join(node.path, name),
+						relPath:  filepath.Join(node.relPath, name),
+						children: make(map[string]*folderNode),
+					}
+					node.children[name] = child
+				}
+
+				node = child
+			}
+		}
+
+		node.items = append(node.items, items...)
+	}
+
+	return roots
+}
+
+// Configured directory containing the path and the path relative to it, the innermost one when directories are nested
+func findRootDirectory(directories []string, path string) (string, string, bool) {
+	var found string
+	var foundRel string
+
+	for _, directory := range directories {
+		directory = filepath.Clean(directory)
+
+		relPath, err := filepath.Rel(directory, filepath.Clean(path))
+		if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+			continue
+		}
+
+		if found == "" || len(directory) > len(found) {
+			found = directory
+			foundRel = relPath
+		}
+	}
+
+	return found, foundRel, found != ""
+}
+
+// Finds the folder with this id in the trees
+func findFolder(roots []*folderNode, id string) (*folderNode, bool) {
+	for _, root := range roots {
+		if getFolderId(root.path) == id {
+			return root, true
+		}
+
+		children := make([]*folderNode, 0, len(root.children))
+		for _, child := range root.children {
+			children = append(children, child)
+		}
+
+		if node, ok := findFolder(children, id); ok {
+			return node, true
+		}
+	}
+
+	return nil, false
+}
+
+// Folder of the node with its subfolders and media in alphabetical order
+func (n *folderNode) toFolder() types.Folder {
+	folder := types.Folder{
+		Id:      getFolderId(n.path),
+		Name:    filepath.Base(n.path),
+		Path:    filepath.ToSlash(n.relPath),
+		Folders: make([]types.Folder, 0, len(n.children)),
+		Media:   make([]types.MediaItem, len(n.items)),
+	}
+
+	for _, child := range n.children {
+		folder.Folders = append(folder.Folders, child.toFolder())
+	}
+
+	sort.Slice(folder.Folders, func(i, j int) bool {
+		return strings.ToLower(folder.Folders[i].Name) < strings.ToLower(folder.Folders[j].Name)
+	})
+
+	copy(folder.Media, n.items)
+	sortMedia(folder.Media, SortName, false)
+
+	return folder
+}
+
+// Entries of the media under the folder, the archive has the folder at its root and keeps the structure within it
+func (n *folderNode) archiveEntries() []archiveEntry {
+	entries := make([]archiveEntry, 0)
+
+	var visit func(node *folderNode)
+	visit = func(node *folderNode) {
+		for _, item := range node.items {
+			relPath, err := filepath.Rel(n.path, item.Path)
+			if err != nil {
+				continue
+			}
+
+			entries = append(entries, archiveEntry{
+				id:         item.Id,
+				sourcePath: item.Path,
+				targetPath: filepath.ToSlash(filepath.Join(filepath.Base(n.path), relPath)),
+			})
+		}
+
+		for _, child := range node.children {
+			visit(child)
+		}
+	}
+
+	visit(n)
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].targetPath < entries[j].targetPath
+	})
+
+	return entries
+}
@@ -2,6 +2,7 @@ package media
 
 import (
 	"sort"
+	"strings"
 
 	"github.com/egfanboy/mediapire-media-host/internal/utils"
 	"github.com/egfanboy/mediapire-media-host/pkg/types"
@@ -12,7 +13,15 @@ import (
 type mediaGroupingFactory func(items []types.MediaItem) []types.MediaItem
 
 var groupingFactories = map[string][]mediaGroupingFactory{
-	"mp3": {mp3AlbumGrouper},
+	"mp3":  {newAlbumGrouper("mp3"), newAudiobookGrouper("mp3")},
+	"flac": {newAlbumGrouper("flac")},
+	"wav":  {newAlbumGrouper("wav")},
+	"aiff": {newAlbumGrouper("aiff")},
+	"aif":  {newAlbumGrouper("aif")},
+	"ogg":  {newAlbumGrouper("ogg")},
+	"opus": {newAlbumGrouper("opus")},
+	"m4a":  {newAlbumGrouper("m4a"), newAudiobookGrouper("m4a")},
+	"m4b":  {newAudiobookGrouper("m4b")},
 }
 
 func getGroupingFactories(mediaTypes ...string) []mediaGroupingFactory {
@@ -31,69 +40,122 @@ func getGroupingFactories(mediaTypes ...string) []mediaGroupingFactory {
 	return funcs
 }
 
-// Groups songs by albums and returns them in alphabetical order based on album
-func mp3AlbumGrouper(items []types.MediaItem) []types.MediaItem {
-	albumMap := make(map[string][]*types.MediaItem)
+// Groups songs of the extension by albums and returns them in alphabetical order based on album
+func newAlbumGrouper(extension string) mediaGroupingFactory {
+	return func(items []types.MediaItem) []types.MediaItem {
+		return albumGrouper(extension, items)
+	}
+}
 
-	for i := range items {
-		item := items[i]
-		if item.Extension != "mp3" {
-			continue
-		}
+// Groups audiobooks of the extension by series and orders them by volume instead of by album
+func newAudiobookGrouper(extension string) mediaGroupingFactory {
+	return func(items []types.MediaItem) []types.MediaItem {
+		return audiobookGrouper(extension, items)
+	}
+}
 
-		metadata := item.Metadata.(Mp3Metadata)
+// Identity of an album, titles alone are not unique across artists and releases
+type albumKey struct {
+	artist string
+	album  string
+	year   int
+}
 
-		albumTitle := metadata.Album
+func getAlbumKey(info trackInfo) albumKey {
+	// compilations are grouped under their album artist, without one the track artist is the best guess
+	artist := info.AlbumArtist
+	if artist == "" {
+		artist = info.Artist
+	}
 
-		trackOf := metadata.TrackOf
+	return albumKey{
+		artist: strings.ToLower(strings.TrimSpace(artist)),
+		album:  strings.ToLower(strings.TrimSpace(info.Album)),
+		year:   info.Year,
+	}
+}
 
-		if album, ok := albumMap[albumTitle]; !ok {
-			// we have metadata for number of tracks, create a slice of that size and put the songs in the proper order
-			if trackOf != 0 {
-				album := make([]*types.MediaItem, trackOf)
+// Orders tracks of an album by disc then track, tracks without a disc are on the first one and tracks without a number come last
+func trackLess(a trackInfo, b trackInfo) bool {
+	discA, discB := a.DiscIndex, b.DiscIndex
+	if discA <= 0 {
+		discA = 1
+	}
 
-				album[metadata.TrackIndex-1] = &item
+	if discB <= 0 {
+		discB = 1
+	}
 
-				albumMap[albumTitle] = album
-			} else {
-				// create new key for album with the current item as the first track
-				albumMap[albumTitle] = []*types.MediaItem{&item}
-			}
-		} else {
-			// we have metadata for number of tracks, add track in proper spot
-			if trackOf != 0 {
-				album[metadata.TrackIndex-1] = &item
-			} else {
-				album = append(album, &item)
-			}
-
-			albumMap[albumTitle] = album
-		}
+	if discA != discB {
+		return discA < discB
+	}
+
+	if (a.TrackIndex > 0) != (b.TrackIndex > 0) {
+		return a.TrackIndex > 0
+	}
+
+	return a.TrackIndex < b.TrackIndex
+}
 
+/*
+** Groups the items of this type by album and returns the albums in alphabetical order. Tracks with missing
+** or out of range numbers are kept, items without any tags end up together in an album without title.
+ */
+func albumGrouper(extension string, items []types.MediaItem) []types.MediaItem {
+	type albumTrack struct {
+		item types.MediaItem
+		info trackInfo
 	}
 
-	albums := make([]string, 0)
+	albumMap := make(map[albumKey][]albumTrack)
+	albums := make([]albumKey, 0)
+
+	for _, item := range items {
+		// audiobooks are left in place for the audiobook grouper
+		if item.Extension != extension || isAudiobook(item) {
+			continue
+		}
+
+		info, _ := getTrackInfo(item)
+		key := getAlbumKey(info)
+
+		if _, ok := albumMap[key]; !ok {
+			albums = append(albums, key)
+		}
 
-	for k := range albumMap {
-		albums = append(albums, k)
+		albumMap[key] = append(albumMap[key], albumTrack{item: item, info: info})
 	}
 
-	sort.Strings(albums)
+	sort.SliceStable(albums, func(i, j int) bool {
+		a, b := albums[i], albums[j]
+
+		switch {
+		case a.album != b.album:
+			return a.album < b.album
+		case a.artist != b.artist:
+			return a.artist < b.artist
+		}
+
+		return a.year < b.year
+	})
 
 	itemsGroupedByAlbum := make([]types.MediaItem, 0)
 
 	for _, album := range albums {
-		albumItems := albumMap[album]
-		for _, item := range albumItems {
-			if item != nil {
-				itemsGroupedByAlbum = append(itemsGroupedByAlbum, *item)
-			}
+		tracks := albumMap[album]
+
+		sort.SliceStable(tracks, func(i, j int) bool {
+			return trackLess(tracks[i].info, tracks[j].info)
+		})
+
+		for _, track := range tracks {
+			itemsGroupedByAlbum = append(itemsGroupedByAlbum, track.item)
 		}
 	}
 
-	// Remove mp3 items from the list since we will add them back with our grouped items
+	// Remove items of this type from the list since we will add them back with our grouped items
 	otherItems := utils.Filter(items, func(v types.MediaItem) bool {
-		return v.Extension != "mp3"
+		return v.Extension != extension || isAudiobook(v)
 	})
 
 	result := make([]types.MediaItem, 0)
@@ -103,3 +165,52 @@ func mp3AlbumGrouper(items []types.MediaItem) []types.MediaItem {
 
 	return result
 }
+
+/*
+** Orders the audiobooks of this type by series, volume in the series and then by their position within the volume.
+** Books without a series are ordered by album, parts of a book split in several files keep their disc and track order.
+ */
+func audiobookGrouper(extension string, items []types.MediaItem) []types.MediaItem {
+	isBook := func(item types.MediaItem) bool {
+		return item.Extension == extension && isAudiobook(item)
+	}
+
+	books := utils.Filter(items, isBook)
+	infos := make(map[string]trackInfo, len(books))
+
+	for _, book := range books {
+		info, _ := getTrackInfo(book)
+		infos[book.Id] = info
+	}
+
+	seriesKey := func(info trackInfo) string {
+		if info.Series != "" {
+			return strings.ToLower(info.Series)
+		}
+
+		return strings.ToLower(info.Album)
+	}
+
+	sort.SliceStable(books, func(i, j int) bool {
+		a, b := infos[books[i].Id], infos[books[j].Id]
+
+		switch {
+		case seriesKey(a) != seriesKey(b):
+			return seriesKey(a) < seriesKey(b)
+		case a.Volume != b.Volume:
+			return a.Volume < b.Volume
+		case !strings.EqualFold(a.Album, b.Album):
+			return strings.ToLower(a.Album) < strings.ToLower(b.Album)
+		case trackLess(a, b) || trackLess(b, a):
+			return trackLess(a, b)
+		}
+
+		return strings.ToLower(books[i].Name) < strings.ToLower(books[j].Name)
+	})
+
+	otherItems := utils.Filter(items, func(v types.MediaItem) bool {
+		return !isBook(v)
+	})
+
+	return append(otherItems, books...)
+}
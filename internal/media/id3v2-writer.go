@@ -0,0 +1,318 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"unicode/utf16"
+
+	"github.com/egfanboy/mediapire-common/exceptions"
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
+)
+
+const (
+	id3HeaderSize = 10
+	id3FrameSize  = 10
+
+	id3FlagUnsynchronisation = 0x80
+	id3FlagExtendedHeader    = 0x40
+	id3FlagFooter            = 0x10
+
+	id3FrontCover = 3
+)
+
+type id3Frame struct {
+	id    string
+	flags [2]byte
+	data  []byte
+}
+
+type id3Tag struct {
+	version byte
+	frames  []id3Frame
+	// bytes before the audio, header, frames, padding and footer included
+	size int64
+}
+
+func decodeSynchsafe(b []byte) int64 {
+	return int64(b[0]&0x7f)<<21 | int64(b[1]&0x7f)<<14 | int64(b[2]&0x7f)<<7 | int64(b[3]&0x7f)
+}
+
+func encodeSynchsafe(size int) []byte {
+	return []byte{byte(size>>21) & 0x7f, byte(size>>14) & 0x7f, byte(size>>7) & 0x7f, byte(size) & 0x7f}
+}
+
+// The tag of the file cannot be read or written back, it is reported like any other file the host cannot process
+func unsupportedId3Tag(err error) error {
+	return &exceptions.ApiException{StatusCode: http.StatusUnprocessableEntity, Err: err}
+}
+
+// Reads the frames of the ID3v2 tag at the start of the file, a file without a tag returns an empty v2.3 tag
+func readId3Tag(r io.Reader) (*id3Tag, error) {
+	header := make([]byte, id3HeaderSize)
+
+	_, err := io.ReadFull(r, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	if err != nil || string(header[:3]) != "ID3" {
+		return &id3Tag{version: 3}, nil
+	}
+
+	tag := &id3Tag{version: header[3]}
+	flags := header[5]
+	tagSize := decodeSynchsafe(header[6:10])
+
+	tag.size = id3HeaderSize + tagSize
+	if flags&id3FlagFooter != 0 {
+		tag.size += id3HeaderSize
+	}
+
+	// v2.2 uses three letter frames and unsynchronised tags need every frame decoded, neither are supported
+	if tag.version != 3 && tag.version != 4 {
+		return nil, unsupportedId3Tag(fmt.Errorf("ID3v2.%d tags are not supported", tag.version))
+	}
+
+	if flags&id3FlagUnsynchronisation != 0 {
+		return nil, unsupportedId3Tag(errors.New("unsynchronised ID3v2 tags are not supported"))
+	}
+
+	body := make([]byte, tagSize)
+
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// the extended header only holds a checksum and restrictions, it is dropped when the tag is written
+	if flags&id3FlagExtendedHeader != 0 {
+		if len(body) < 4 {
+			return nil, unsupportedId3Tag(errors.New("invalid ID3v2 extended header"))
+		}
+
+		extendedSize := int(binary.BigEndian.Uint32(body[:4]))
+		if tag.version == 3 {
+			// the v2.3 size does not include the size field itself
+			extendedSize += 4
+		} else {
+			extendedSize = int(decodeSynchsafe(body[:4]))
+		}
+
+		if extendedSize > len(body) {
+			return nil, unsupportedId3Tag(errors.New("invalid ID3v2 extended header"))
+		}
+
+		body = body[extendedSize:]
+	}
+
+	tag.frames, err = parseId3Frames(tag.version, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return tag, nil
+}
+
+// Splits frames until the padding, also used for the sub-frames of chapter frames
+func parseId3Frames(version byte, body []byte) ([]id3Frame, error) {
+	frames := make([]id3Frame, 0)
+
+	for len(body) >= id3FrameSize && body[0] != 0 {
+		var frameSize int64
+		if version == 4 {
+			frameSize = decodeSynchsafe(body[4:8])
+		} else {
+			frameSize = int64(binary.BigEndian.Uint32(body[4:8]))
+		}
+
+		if frameSize > int64(len(body)-id3FrameSize) {
+			return nil, unsupportedId3Tag(fmt.Errorf("ID3v2 frame %s is larger than the tag", string(body[:4])))
+		}
+
+		frame := id3Frame{id: string(body[:4]), data: body[id3FrameSize : id3FrameSize+frameSize]}
+		copy(frame.flags[:], body[8:10])
+
+		frames = append(frames, frame)
+
+		body = body[id3FrameSize+frameSize:]
+	}
+
+	return frames, nil
+}
+
+// Removes every frame with this id, keepFrame can spare some of them
+func (t *id3Tag) removeFrames(id string, keepFrame func(id3Frame) bool) {
+	frames := make([]id3Frame, 0, len(t.frames))
+
+	for _, frame := range t.frames {
+		if frame.id == id && (keepFrame == nil || !keepFrame(frame)) {
+			continue
+		}
+
+		frames = append(frames, frame)
+	}
+
+	t.frames = frames
+}
+
+// Replaces the text frame, an empty value only removes it
+func (t *id3Tag) setText(id string, value string) {
+	t.removeFrames(id, nil)
+
+	if value == "" {
+		return
+	}
+
+	t.frames = append(t.frames, id3Frame{id: id, data: t.encodeText(value)})
+}
+
+// v2.4 supports UTF-8, v2.3 needs UTF-16 with a byte order mark for anything outside of latin1
+func (t *id3Tag) encodeText(value string) []byte {
+	if t.version == 4 {
+		return append([]byte{3}, value...)
+	}
+
+	data := []byte{1, 0xff, 0xfe}
+
+	for _, unit := range utf16.Encode([]rune(value)) {
+		data = append(data, byte(unit), byte(unit>>8))
+	}
+
+	return data
+}
+
+func (t *id3Tag) setFrontCover(art []byte) {
+	t.removeFrames("APIC", func(frame id3Frame) bool {
+		return id3PictureType(frame) != id3FrontCover
+	})
+
+	mime := artFormats[detectImageFormat(art)]
+
+	// latin1 encoding, mime type, picture type and an empty description
+	data := append([]byte{0}, mime...)
+	data = append(data, 0, id3FrontCover, 0)
+	data = append(data, art...)
+
+	t.frames = append(t.frames, id3Frame{id: "APIC", data: data})
+}
+
+// Picture type of an APIC frame, -1 if the frame cannot be read
+func id3PictureType(frame id3Frame) int {
+	if len(frame.data) < 2 {
+		return -1
+	}
+
+	// skip the encoding byte and the null terminated mime type
+	mimeEnd := bytes.IndexByte(frame.data[1:], 0)
+	if mimeEnd < 0 || 1+mimeEnd+1 >= len(frame.data) {
+		return -1
+	}
+
+	return int(frame.data[1+mimeEnd+1])
+}
+
+func (t *id3Tag) encodeFrames() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	for _, frame := range t.frames {
+		buf.WriteString(frame.id)
+
+		if t.version == 4 {
+			if len(frame.data) >= 1<<28 {
+				return nil, fmt.Errorf("ID3v2 frame %s is too large", frame.id)
+			}
+
+			buf.Write(encodeSynchsafe(len(frame.data)))
+		} else {
+			binary.Write(buf, binary.BigEndian, uint32(len(frame.data)))
+		}
+
+		buf.Write(frame.flags[:])
+		buf.Write(frame.data)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Header and frames of the tag followed by padding so that it is tagSize bytes long
+func (t *id3Tag) encode(frames []byte, tagSize int) []byte {
+	tag := make([]byte, tagSize)
+
+	copy(tag, "ID3")
+	tag[3] = t.version
+	copy(tag[6:10], encodeSynchsafe(tagSize-id3HeaderSize))
+	copy(tag[id3HeaderSize:], frames)
+
+	return tag
+}
+
+/*
+** Applies the patch to the ID3v2 tag of the file. The tag keeps the size of the previous one when the new frames
+** fit in it so the audio does not move, otherwise it gets room for future edits.
+ */
+func writeId3v2Tags(item types.MediaItem, patch types.MediaMetadataPatch) ([]byte, int64, error) {
+	file, err := os.Open(item.Path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	tag, err := readId3Tag(file)
+	file.Close()
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	current, _ := getTrackInfo(item)
+
+	if patch.Title != nil {
+		tag.setText("TIT2", *patch.Title)
+	}
+
+	if patch.Artist != nil {
+		tag.setText("TPE1", *patch.Artist)
+	}
+
+	if patch.Album != nil {
+		tag.setText("TALB", *patch.Album)
+	}
+
+	if patch.Genre != nil {
+		tag.setText("TCON", *patch.Genre)
+	}
+
+	if index, of, ok := patchedTrack(patch, current); ok {
+		track := ""
+		if index > 0 {
+			track = strconv.Itoa(index)
+
+			if of > 0 {
+				track = fmt.Sprintf("%d/%d", index, of)
+			}
+		}
+
+		tag.setText("TRCK", track)
+	}
+
+	if len(patch.Art) > 0 {
+		tag.setFrontCover(patch.Art)
+	}
+
+	frames, err := tag.encodeFrames()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if tag.size > 0 && int64(id3HeaderSize+len(frames)) <= tag.size {
+		// fill the whole space of the previous tag, a footer it had is replaced by padding
+		return tag.encode(frames, int(tag.size)), tag.size, nil
+	}
+
+	return tag.encode(frames, id3HeaderSize+len(frames)+tagPadding), tag.size, nil
+}
@@ -0,0 +1,165 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/egfanboy/mediapire-common/exceptions"
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
+)
+
+func buildId3Frame(version byte, id string, data []byte) []byte {
+	size := make([]byte, 4)
+	if version == 4 {
+		copy(size, encodeSynchsafe(len(data)))
+	} else {
+		binary.BigEndian.PutUint32(size, uint32(len(data)))
+	}
+
+	frame := append([]byte(id), size...)
+	frame = append(frame, 0, 0)
+
+	return append(frame, data...)
+}
+
+func buildId3Tag(version byte, padding int, frames ...[]byte) []byte {
+	body := append(bytes.Join(frames, nil), make([]byte, padding)...)
+
+	tag := []byte{'I', 'D', '3', version, 0, 0}
+	tag = append(tag, encodeSynchsafe(len(body))...)
+
+	return append(tag, body...)
+}
+
+func latin1Text(value string) []byte {
+	return append([]byte{0}, value...)
+}
+
+func writeTestMp3(t *testing.T, version byte, padding int) types.MediaItem {
+	t.Helper()
+
+	tag := buildId3Tag(version, padding,
+		buildId3Frame(version, "TIT2", latin1Text("Old title")),
+		buildId3Frame(version, "TPE1", latin1Text("Artist")),
+		buildId3Frame(version, "TCON", latin1Text("Rock")),
+	)
+
+	return types.MediaItem{Id: "id", Extension: "mp3", Path: writeTestFile(t, "track.mp3", append(tag, fakeAudio...))}
+}
+
+func TestId3v2WriterFitsInPadding(t *testing.T) {
+	for _, version := range []byte{3, 4} {
+		item := writeTestMp3(t, version, 512)
+		original := len(readTestFile(t, item.Path))
+
+		content, fits := applyTagWriter(t, writeId3v2Tags, item, types.MediaMetadataPatch{Title: stringPtr("New title ✓")})
+
+		if !fits || len(content) != original {
+			t.Fatalf("v2.%d: tag should keep its size, file went from %d to %d bytes", version, original, len(content))
+		}
+
+		assertAudioKept(t, content)
+
+		m := readTestTags(t, content)
+		if m.Title() != "New title ✓" || m.Artist() != "Artist" {
+			t.Fatalf("v2.%d: got title %q and artist %q", version, m.Title(), m.Artist())
+		}
+
+		tag, err := readId3Tag(bytes.NewReader(content))
+		if err != nil || tag.version != version {
+			t.Fatalf("v2.%d: tag cannot be read back as the same version: %v", version, err)
+		}
+	}
+}
+
+func TestId3v2WriterGrowsTagWithPadding(t *testing.T) {
+	item := writeTestMp3(t, 3, 0)
+	title := strings.Repeat("long title ", 200)
+
+	content, fits := applyTagWriter(t, writeId3v2Tags, item, types.MediaMetadataPatch{Title: &title})
+	if fits {
+		t.Fatal("tag should have grown")
+	}
+
+	assertAudioKept(t, content)
+
+	if m := readTestTags(t, content); m.Title() != title {
+		t.Fatalf("got title %q", m.Title())
+	}
+
+	tag, err := readId3Tag(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frames, _ := tag.encodeFrames()
+	if padding := tag.size - int64(id3HeaderSize+len(frames)); padding != tagPadding {
+		t.Fatalf("expected %d bytes of padding, got %d", tagPadding, padding)
+	}
+
+	// the next edit fits in the padding
+	item.Path = writeTestFile(t, "grown.mp3", content)
+
+	_, fits = applyTagWriter(t, writeId3v2Tags, item, types.MediaMetadataPatch{Artist: stringPtr("Other artist")})
+	if !fits {
+		t.Fatal("edit after growing the tag should fit in its padding")
+	}
+}
+
+func TestId3v2WriterAddsTag(t *testing.T) {
+	item := types.MediaItem{Id: "id", Extension: "mp3", Path: writeTestFile(t, "untagged.mp3", fakeAudio)}
+
+	content, _ := applyTagWriter(t, writeId3v2Tags, item, types.MediaMetadataPatch{Artist: stringPtr("Artist")})
+
+	if !bytes.HasPrefix(content, []byte("ID3")) {
+		t.Fatal("tag was not added")
+	}
+
+	assertAudioKept(t, content)
+
+	if m := readTestTags(t, content); m.Artist() != "Artist" {
+		t.Fatalf("got artist %q", m.Artist())
+	}
+}
+
+func TestId3v2WriterTrackAndRemoval(t *testing.T) {
+	item := writeTestMp3(t, 4, 256)
+	item.Metadata = Mp3Metadata{TrackIndex: 1, TrackOf: 12}
+
+	content, _ := applyTagWriter(t, writeId3v2Tags, item, types.MediaMetadataPatch{TrackIndex: intPtr(3), Genre: stringPtr("")})
+
+	m := readTestTags(t, content)
+
+	if index, of := m.Track(); index != 3 || of != 12 {
+		t.Fatalf("got track %d/%d", index, of)
+	}
+
+	if m.Genre() != "" {
+		t.Fatalf("genre should have been removed, got %q", m.Genre())
+	}
+}
+
+func TestId3v2WriterRejectsUnsupportedTags(t *testing.T) {
+	unsynchronised := buildId3Tag(3, 0, buildId3Frame(3, "TIT2", latin1Text("Title")))
+	unsynchronised[5] |= id3FlagUnsynchronisation
+
+	files := map[string][]byte{
+		"v2.2":           append([]byte{'I', 'D', '3', 2, 0, 0, 0, 0, 0, 0}, fakeAudio...),
+		"unsynchronised": append(unsynchronised, fakeAudio...),
+	}
+
+	for name, content := range files {
+		item := types.MediaItem{Id: "id", Extension: "mp3", Path: writeTestFile(t, "track.mp3", content)}
+
+		_, _, err := writeId3v2Tags(item, types.MediaMetadataPatch{Title: stringPtr("Title")})
+
+		var apiErr *exceptions.ApiException
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnprocessableEntity {
+			t.Fatalf("%s: expected an unprocessable entity error, got %v", name, err)
+		}
+	}
+}
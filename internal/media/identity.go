@@ -0,0 +1,403 @@
+package media
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/egfanboy/mediapire-media-host/internal/utils"
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
+)
+
+const (
+	// how long a rename reported by the watcher waits for the scan of its target
+	pendingMoveTtl = time.Minute
+	// how long an item whose file was deleted can still be matched to a new file
+	vanishedItemTtl = 5 * time.Minute
+	// bytes hashed at the start and at the end of a file to recognise its content
+	fingerprintChunkSize = 64 * 1024
+)
+
+// Rename reported by the watcher, the paths can be directories
+type pendingMove struct {
+	oldPath string
+	newPath string
+	at      time.Time
+}
+
+// Item removed because its file was deleted, it may show up again under another path
+type vanishedItem struct {
+	item  types.MediaItem
+	entry mediaIndexEntry
+	at    time.Time
+}
+
+// Previous path of a moved item that must not map to its id anymore
+type stalePath struct {
+	id string
+	// updates of the mapping from this one on read it after the path was removed from it, 0 until then
+	removedBefore int
+}
+
+// New path of an item found while scanning, completed once the item is in the cache
+type mediaMove struct {
+	id           string
+	oldPath      string
+	previousName string
+	previousDir  string
+	addedAt      int64
+}
+
+/*
+** Keeps the id of media items that are renamed or moved. A new file is matched to the item it used to be
+** through the renames reported by the watcher, then through the inode and content of files that are gone.
+ */
+type identityTracker struct {
+	mu       sync.Mutex
+	moves    []pendingMove
+	vanished []vanishedItem
+	// new path -> move found by the scan of that path
+	resolved map[string]mediaMove
+	// previous path -> id, paths to drop from the id mapping
+	stalePaths map[string]stalePath
+	// updates of the id mapping in progress, from reading it to saving it
+	mappingUpdates    map[int]bool
+	lastMappingUpdate int
+	// moves to publish once their scan is done
+	completed []types.MovedMediaItem
+}
+
+var mediaIdentity = &identityTracker{
+	moves:          make([]pendingMove, 0),
+	vanished:       make([]vanishedItem, 0),
+	resolved:       make(map[string]mediaMove),
+	stalePaths:     make(map[string]stalePath),
+	mappingUpdates: make(map[int]bool),
+	completed:      make([]types.MovedMediaItem, 0),
+}
+
+// Hash of the size, the start and the end of the file, enough to recognise it without reading all of it
+func fileFingerprint(path string, size int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	hash := sha256.New()
+	binary.Write(hash, binary.BigEndian, size)
+
+	_, err = io.CopyN(hash, f, fingerprintChunkSize)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	if size > 2*fingerprintChunkSize {
+		_, err = f.Seek(-fingerprintChunkSize, io.SeekEnd)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+
+	return !os.IsNotExist(err)
+}
+
+// Path of a file within a renamed directory before the rename, false when the path is not under newPath
+func pathBeforeMove(path string, move pendingMove) (string, bool) {
+	if path == move.newPath {
+		return move.oldPath, true
+	}
+
+	if strings.HasPrefix(path, move.newPath+string(filepath.Separator)) {
+		return move.oldPath + strings.TrimPrefix(path, move.newPath), true
+	}
+
+	return "", false
+}
+
+func isPathWithin(path string, directory string) bool {
+	return path == directory || strings.HasPrefix(path, directory+string(filepath.Separator))
+}
+
+// Rename of a file or directory paired with the creation of its target by the watcher
+func (t *identityTracker) RegisterMove(oldPath string, newPath string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.moves = append(t.moves, pendingMove{oldPath: filepath.Clean(oldPath), newPath: filepath.Clean(newPath), at: time.Now()})
+}
+
+// Whether the deleted path was renamed to a path that still exists, the scan of that path keeps its items
+func (t *identityTracker) IsMoveSource(path string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, move := range t.moves {
+		if time.Since(move.at) < pendingMoveTtl && isPathWithin(path, move.oldPath) && fileExists(move.newPath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Removes the moves whose target is within the directory, they are either resolved or never will be once it is scanned
+func (t *identityTracker) TakeMoves(directory string) []pendingMove {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	taken := make([]pendingMove, 0)
+	remaining := make([]pendingMove, 0, len(t.moves))
+
+	for _, move := range t.moves {
+		if isPathWithin(move.newPath, directory) || time.Since(move.at) >= pendingMoveTtl {
+			taken = append(taken, move)
+		} else {
+			remaining = append(remaining, move)
+		}
+	}
+
+	t.moves = remaining
+
+	return taken
+}
+
+// Keeps what identifies the item of a deleted file for a while
+func (t *identityTracker) AddVanished(item types.MediaItem, entry mediaIndexEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	remaining := make([]vanishedItem, 0, len(t.vanished)+1)
+	for _, vanished := range t.vanished {
+		if time.Since(vanished.at) < vanishedItemTtl {
+			remaining = append(remaining, vanished)
+		}
+	}
+
+	t.vanished = append(remaining, vanishedItem{item: item, entry: entry, at: time.Now()})
+}
+
+/*
+** Finds the id of the item a new file used to be. Renames reported by the watcher are checked first, then indexed
+** files with the same inode or content whose path is gone and finally items whose file was recently deleted. The
+** file is only read for its fingerprint when missingFiles is set or items were recently deleted.
+ */
+func (t *identityTracker) Resolve(path string, info os.FileInfo, ids *utils.ConcurrentMap[string, string], missingFiles bool) (string, bool) {
+	move, ok := t.findMove(path, info, ids, missingFiles)
+	if !ok {
+		return "", false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// copies of a moved file cannot all take its id
+	for _, resolved := range t.resolved {
+		if resolved.id == move.id {
+			return "", false
+		}
+	}
+
+	t.resolved[path] = move
+
+	return move.id, true
+}
+
+func (t *identityTracker) findMove(path string, info os.FileInfo, ids *utils.ConcurrentMap[string, string], missingFiles bool) (mediaMove, bool) {
+	index := getMediaIndex()
+
+	t.mu.Lock()
+	moves := append([]pendingMove{}, t.moves...)
+	t.mu.Unlock()
+
+	for _, move := range moves {
+		oldPath, ok := pathBeforeMove(path, move)
+		if !ok || fileExists(oldPath) {
+			continue
+		}
+
+		if id, ok := ids.GetKey(oldPath); ok {
+			result := mediaMove{
+				id:           id,
+				oldPath:      oldPath,
+				previousName: strings.TrimSuffix(filepath.Base(oldPath), filepath.Ext(oldPath)),
+				previousDir:  filepath.Dir(oldPath),
+			}
+
+			if entry, ok := index.Entry(oldPath); ok {
+				result.addedAt = entry.AddedAt
+			}
+
+			return result, true
+		}
+	}
+
+	inode := getInode(info)
+
+	if entry, ok := index.FindByInode(inode, info.Size(), path); ok {
+		return moveFromIndexEntry(entry), true
+	}
+
+	t.mu.Lock()
+	hasVanished := len(t.vanished) > 0
+	t.mu.Unlock()
+
+	// reading the file is only worth it when there is a missing file it could be
+	if !missingFiles && !hasVanished {
+		return mediaMove{}, false
+	}
+
+	fingerprint, _ := fileFingerprint(path, info.Size())
+
+	if entry, ok := index.FindByFingerprint(fingerprint, path); ok {
+		return moveFromIndexEntry(entry), true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, vanished := range t.vanished {
+		if time.Since(vanished.at) >= vanishedItemTtl || fileExists(vanished.entry.Path) {
+			continue
+		}
+
+		sameInode := inode != 0 && vanished.entry.Inode == inode && vanished.entry.Size == info.Size()
+		sameContent := fingerprint != "" && vanished.entry.Fingerprint == fingerprint
+
+		if sameInode || sameContent {
+			move := moveFromIndexEntry(vanished.entry)
+			move.id = vanished.item.Id
+
+			// the item is back, later copies of the file are new items
+			t.vanished = append(t.vanished[:i], t.vanished[i+1:]...)
+
+			return move, true
+		}
+	}
+
+	return mediaMove{}, false
+}
+
+func moveFromIndexEntry(entry mediaIndexEntry) mediaMove {
+	return mediaMove{
+		id:           entry.Id,
+		oldPath:      entry.Path,
+		previousName: entry.Name,
+		previousDir:  entry.ParentDir,
+		addedAt:      entry.AddedAt,
+	}
+}
+
+// Returns and forgets the move found when the file at this path was scanned
+func (t *identityTracker) TakeResolved(path string) (mediaMove, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	move, ok := t.resolved[path]
+	delete(t.resolved, path)
+
+	return move, ok
+}
+
+func (t *identityTracker) MarkStale(path string, id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stalePaths[path] = stalePath{id: id}
+}
+
+/*
+** Previous paths of moved items, they must not keep mapping to the id of the item. They are kept while an update of
+** the mapping may have read them before they were removed from it, a new item at one of these paths gets a new id.
+ */
+func (t *identityTracker) StalePaths() map[string]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stale := make(map[string]string, len(t.stalePaths))
+	for k, entry := range t.stalePaths {
+		stale[k] = entry.id
+	}
+
+	return stale
+}
+
+// Registers an update of the id mapping, it must be started before the mapping is read
+func (t *identityTracker) StartMappingUpdate() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.lastMappingUpdate++
+	t.mappingUpdates[t.lastMappingUpdate] = true
+
+	return t.lastMappingUpdate
+}
+
+// Records that the mapping was saved without these stale paths, updates started from now on cannot read them
+func (t *identityTracker) MappingSaved(removed map[string]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for path, id := range removed {
+		if entry, ok := t.stalePaths[path]; ok && entry.id == id && entry.removedBefore == 0 {
+			entry.removedBefore = t.lastMappingUpdate + 1
+			t.stalePaths[path] = entry
+		}
+	}
+}
+
+// Forgets the stale paths that no update still in progress can have read
+func (t *identityTracker) FinishMappingUpdate(update int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.mappingUpdates, update)
+
+	oldest := t.lastMappingUpdate + 1
+	for inProgress := range t.mappingUpdates {
+		if inProgress < oldest {
+			oldest = inProgress
+		}
+	}
+
+	for path, entry := range t.stalePaths {
+		if entry.removedBefore != 0 && entry.removedBefore <= oldest {
+			delete(t.stalePaths, path)
+		}
+	}
+}
+
+func (t *identityTracker) AddCompleted(item types.MovedMediaItem) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.completed = append(t.completed, item)
+}
+
+func (t *identityTracker) TakeCompleted() []types.MovedMediaItem {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	completed := t.completed
+	t.completed = make([]types.MovedMediaItem, 0)
+
+	return completed
+}
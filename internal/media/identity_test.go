@@ -0,0 +1,59 @@
+package media
+
+import "testing"
+
+func newTestIdentityTracker() *identityTracker {
+	return &identityTracker{stalePaths: make(map[string]stalePath), mappingUpdates: make(map[int]bool)}
+}
+
+func TestStalePathsKeptUntilUpdatesThatReadThemFinish(t *testing.T) {
+	tracker := newTestIdentityTracker()
+
+	// read the mapping before the move
+	scan := tracker.StartMappingUpdate()
+
+	tracker.MarkStale("/music/old.mp3", "id")
+
+	save := tracker.StartMappingUpdate()
+	tracker.MappingSaved(tracker.StalePaths())
+	tracker.FinishMappingUpdate(save)
+
+	if _, ok := tracker.StalePaths()["/music/old.mp3"]; !ok {
+		t.Fatal("stale path dropped while a scan that read it is still in progress")
+	}
+
+	tracker.FinishMappingUpdate(scan)
+
+	if len(tracker.StalePaths()) != 0 {
+		t.Fatal("stale path kept after every update that could read it finished")
+	}
+}
+
+func TestStalePathsKeptUntilSaved(t *testing.T) {
+	tracker := newTestIdentityTracker()
+
+	tracker.MarkStale("/music/old.mp3", "id")
+	tracker.FinishMappingUpdate(tracker.StartMappingUpdate())
+
+	if len(tracker.StalePaths()) != 1 {
+		t.Fatal("stale path dropped before a save removed it from the mapping")
+	}
+}
+
+func TestStalePathMarkedAgainIsKept(t *testing.T) {
+	tracker := newTestIdentityTracker()
+
+	tracker.MarkStale("/music/old.mp3", "id")
+	saved := tracker.StalePaths()
+
+	// another item moved away from the same path before the save finished
+	tracker.MarkStale("/music/old.mp3", "other-id")
+
+	update := tracker.StartMappingUpdate()
+	tracker.MappingSaved(saved)
+	tracker.FinishMappingUpdate(update)
+
+	if tracker.StalePaths()["/music/old.mp3"] != "other-id" {
+		t.Fatal("stale path of the other item was dropped before it was saved")
+	}
+}
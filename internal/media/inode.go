@@ -0,0 +1,16 @@
+//go:build !windows
+
+package media
+
+import (
+	"os"
+	"syscall"
+)
+
+func getInode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+
+	return 0
+}
@@ -0,0 +1,8 @@
+package media
+
+import "os"
+
+// Windows does not expose inodes through os.FileInfo, rely on size and modification time only
+func getInode(info os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,413 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	lyricsSidecarExtension = ".lrc"
+
+	id3EncodingLatin1  = 0
+	id3EncodingUtf16   = 1
+	id3EncodingUtf16Be = 2
+
+	// SYLT timestamps in milliseconds, the other format counts mpeg frames
+	id3SyltTimestampMs = 2
+)
+
+var (
+	// one or more [mm:ss.xx] timestamps at the start of a line
+	lrcTimestamp = regexp.MustCompile(`^\[(\d+):(\d{1,2}(?:[.:]\d{1,3})?)\]`)
+	// id tags such as [ar:Artist] or [offset:+250], other bracketed lines like [Chorus: x] are lyrics
+	lrcIdTag = regexp.MustCompile(`(?i)^\[(ar|al|ti|au|by|offset|re|tool|ve|length|la):(.*)\]$`)
+)
+
+type lyricsReader func(path string) (*types.Lyrics, error)
+
+// Readers of the lyrics embedded in a file, keyed the same way as mediaTypeFactory
+var lyricsReaders = map[string]lyricsReader{
+	"mp3":  readId3Lyrics,
+	"flac": readFlacLyrics,
+	"ogg":  readOggLyrics,
+	"opus": readOggLyrics,
+}
+
+// Lyrics sidecar named after the track, ie song.lrc for song.mp3
+func getLyricsSidecarPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + lyricsSidecarExtension
+}
+
+/*
+** Lyrics of the item, nil when it has none. A sidecar is preferred over the tags since it is where edited lyrics
+** are saved. Embedded lyrics that cannot be read are logged and treated as missing.
+ */
+func findLyrics(item types.MediaItem) (*types.Lyrics, error) {
+	content, err := os.ReadFile(getLyricsSidecarPath(item.Path))
+	if err == nil {
+		lyrics := parseLrc(string(content))
+		return &lyrics, nil
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	read, ok := lyricsReaders[item.Extension]
+	if !ok {
+		return nil, nil
+	}
+
+	lyrics, err := read(item.Path)
+	if err != nil {
+		log.Err(err).Msgf("failed to read lyrics of %s", filepath.Base(item.Path))
+		return nil, nil
+	}
+
+	return lyrics, nil
+}
+
+/*
+** Parses LRC lyrics, lines can have several timestamps when they are repeated. Lyrics without any
+** timestamp are returned as plain lines, which is also how tags holding unsynced lyrics are read.
+ */
+func parseLrc(text string) types.Lyrics {
+	text = strings.TrimPrefix(text, "\ufeff")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+
+	var lyrics types.Lyrics
+	var offset int64
+	plain := make([]types.LyricsLine, 0)
+	synced := make([]types.LyricsLine, 0)
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, " \r")
+		times := make([]int64, 0)
+
+		for {
+			match := lrcTimestamp.FindStringSubmatch(line)
+			if match == nil {
+				break
+			}
+
+			times = append(times, parseLrcTime(match[1], match[2]))
+			line = line[len(match[0]):]
+		}
+
+		if len(times) == 0 {
+			if tag := lrcIdTag.FindStringSubmatch(line); tag != nil {
+				switch strings.ToLower(tag[1]) {
+				case "offset":
+					offset, _ = strconv.ParseInt(strings.TrimSpace(tag[2]), 10, 64)
+				case "la":
+					lyrics.Language = strings.TrimSpace(tag[2])
+				}
+
+				continue
+			}
+
+			plain = append(plain, types.LyricsLine{Text: line})
+			continue
+		}
+
+		for _, t := range times {
+			synced = append(synced, types.LyricsLine{Time: t, Text: strings.TrimSpace(line)})
+		}
+	}
+
+	if len(synced) == 0 {
+		lyrics.Lines = trimEmptyLyricsLines(plain)
+		return lyrics
+	}
+
+	// a positive offset shows the lines sooner
+	for i := range synced {
+		synced[i].Time -= offset
+		if synced[i].Time < 0 {
+			synced[i].Time = 0
+		}
+	}
+
+	sort.SliceStable(synced, func(i, j int) bool {
+		return synced[i].Time < synced[j].Time
+	})
+
+	lyrics.Synced = true
+	lyrics.Lines = synced
+
+	return lyrics
+}
+
+// Milliseconds of a timestamp, seconds can have hundredths or thousandths and some files use : before them
+func parseLrcTime(minutes string, seconds string) int64 {
+	m, _ := strconv.ParseInt(minutes, 10, 64)
+	s, _ := strconv.ParseFloat(strings.Replace(seconds, ":", ".", 1), 64)
+
+	return m*60000 + int64(math.Round(s*1000))
+}
+
+func trimEmptyLyricsLines(lines []types.LyricsLine) []types.LyricsLine {
+	for len(lines) > 0 && strings.TrimSpace(lines[0].Text) == "" {
+		lines = lines[1:]
+	}
+
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1].Text) == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
+
+func encodeLrc(lyrics types.Lyrics) []byte {
+	var b bytes.Buffer
+
+	if lyrics.Language != "" {
+		fmt.Fprintf(&b, "[la:%s]\n", lyrics.Language)
+	}
+
+	for _, line := range lyrics.Lines {
+		text := line.Text
+
+		if lyrics.Synced {
+			// a timestamp only applies to its own line
+			text = strings.ReplaceAll(strings.ReplaceAll(text, "\r", ""), "\n", " ")
+			fmt.Fprintf(&b, "[%02d:%02d.%02d]", line.Time/60000, line.Time/1000%60, line.Time%1000/10)
+		}
+
+		b.WriteString(text)
+		b.WriteByte('\n')
+	}
+
+	return b.Bytes()
+}
+
+func validateLyrics(lyrics types.Lyrics) error {
+	if !lyrics.Synced {
+		return nil
+	}
+
+	for _, line := range lyrics.Lines {
+		if line.Time < 0 {
+			return errors.New("synced lyrics cannot have a negative time")
+		}
+	}
+
+	return nil
+}
+
+// Synced lyrics from SYLT frames are preferred over the unsynced ones of USLT frames
+func readId3Lyrics(path string) (*types.Lyrics, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	tag, err := readId3Tag(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var unsynced *types.Lyrics
+
+	for _, frame := range tag.frames {
+		switch frame.id {
+		case "SYLT":
+			if lyrics, ok := parseSyltFrame(frame.data); ok {
+				return &lyrics, nil
+			}
+		case "USLT":
+			if lyrics, ok := parseUsltFrame(frame.data); ok && unsynced == nil {
+				unsynced = &lyrics
+			}
+		}
+	}
+
+	return unsynced, nil
+}
+
+// Encoding, language, descriptor and the lyrics, which may be LRC text
+func parseUsltFrame(data []byte) (types.Lyrics, bool) {
+	if len(data) < 4 {
+		return types.Lyrics{}, false
+	}
+
+	encoding := data[0]
+	_, text := splitId3String(encoding, data[4:])
+
+	lyrics := parseLrc(decodeId3Text(encoding, text))
+	if lyrics.Language == "" {
+		lyrics.Language = id3Language(data[1:4])
+	}
+
+	return lyrics, len(lyrics.Lines) > 0
+}
+
+// Encoding, language, timestamp format, content type and descriptor followed by null terminated lines each with their timestamp
+func parseSyltFrame(data []byte) (types.Lyrics, bool) {
+	if len(data) < 6 || data[4] != id3SyltTimestampMs {
+		return types.Lyrics{}, false
+	}
+
+	encoding := data[0]
+	lyrics := types.Lyrics{Synced: true, Language: id3Language(data[1:4]), Lines: make([]types.LyricsLine, 0)}
+
+	_, rest := splitId3String(encoding, data[6:])
+
+	for len(rest) > 0 {
+		var text string
+		text, rest = splitId3String(encoding, rest)
+
+		if len(rest) < 4 {
+			break
+		}
+
+		lyrics.Lines = append(lyrics.Lines, types.LyricsLine{
+			Time: int64(binary.BigEndian.Uint32(rest[:4])),
+			// lines often start with a line feed to tell players to start a new line
+			Text: strings.TrimSpace(text),
+		})
+
+		rest = rest[4:]
+	}
+
+	sort.SliceStable(lyrics.Lines, func(i, j int) bool {
+		return lyrics.Lines[i].Time < lyrics.Lines[j].Time
+	})
+
+	return lyrics, len(lyrics.Lines) > 0
+}
+
+func id3Language(code []byte) string {
+	language := strings.ToLower(strings.Trim(string(code), "\x00 "))
+	// xxx is used when the language is unknown
+	if language == "xxx" {
+		return ""
+	}
+
+	return language
+}
+
+// Splits a null terminated string from the data after it, the terminator is two bytes long for UTF-16
+func splitId3String(encoding byte, data []byte) (string, []byte) {
+	if encoding == id3EncodingUtf16 || encoding == id3EncodingUtf16Be {
+		for i := 0; i+1 < len(data); i += 2 {
+			if data[i] == 0 && data[i+1] == 0 {
+				return decodeId3Text(encoding, data[:i]), data[i+2:]
+			}
+		}
+
+		return decodeId3Text(encoding, data), nil
+	}
+
+	end := bytes.IndexByte(data, 0)
+	if end < 0 {
+		return decodeId3Text(encoding, data), nil
+	}
+
+	return decodeId3Text(encoding, data[:end]), data[end+1:]
+}
+
+func decodeId3Text(encoding byte, data []byte) string {
+	switch encoding {
+	case id3EncodingLatin1:
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+
+		return strings.TrimRight(string(runes), "\x00")
+	case id3EncodingUtf16, id3EncodingUtf16Be:
+		var order binary.ByteOrder = binary.BigEndian
+
+		if len(data) >= 2 {
+			switch {
+			case data[0] == 0xff && data[1] == 0xfe:
+				order = binary.LittleEndian
+				data = data[2:]
+			case data[0] == 0xfe && data[1] == 0xff:
+				data = data[2:]
+			}
+		}
+
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			units[i] = order.Uint16(data[2*i:])
+		}
+
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	default:
+		return strings.TrimRight(string(data), "\x00")
+	}
+}
+
+func readFlacLyrics(path string) (*types.Lyrics, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	metadata, err := readFlacMetadata(f)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, block := range metadata.blocks {
+		if block.blockType != flacVorbisCommentBlock {
+			continue
+		}
+
+		comments, err := parseVorbisComments(block.data)
+		if err != nil {
+			return nil, err
+		}
+
+		return lyricsFromComments(comments), nil
+	}
+
+	return nil, nil
+}
+
+func readOggLyrics(path string) (*types.Lyrics, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	info, err := readOggStreamInfo(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return lyricsFromComments(info.Comments), nil
+}
+
+// LYRICS is the common comment for lyrics, UNSYNCEDLYRICS is what some taggers write instead
+func lyricsFromComments(comments *vorbisComments) *types.Lyrics {
+	text := comments.get("LYRICS", "UNSYNCEDLYRICS")
+	if text == "" {
+		return nil
+	}
+
+	lyrics := parseLrc(text)
+
+	return &lyrics
+}
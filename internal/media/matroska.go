@@ -0,0 +1,573 @@
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"strings"
+)
+
+// EBML element ids used by the factory and the art extractor
+const (
+	ebmlIdHeader  = 0x1A45DFA3
+	ebmlIdDocType = 0x4282
+
+	mkvIdSegment     = 0x18538067
+	mkvIdSeekHead    = 0x114D9B74
+	mkvIdSeek        = 0x4DBB
+	mkvIdSeekId      = 0x53AB
+	mkvIdSeekPos     = 0x53AC
+	mkvIdInfo        = 0x1549A966
+	mkvIdTracks      = 0x1654AE6B
+	mkvIdAttachments = 0x1941A469
+	mkvIdCluster     = 0x1F43B675
+
+	mkvIdTimecodeScale = 0x2AD7B1
+	mkvIdDuration      = 0x4489
+	mkvIdTitle         = 0x7BA9
+
+	mkvIdTrackEntry    = 0xAE
+	mkvIdTrackNumber   = 0xD7
+	mkvIdTrackType     = 0x83
+	mkvIdCodecId       = 0x86
+	mkvIdLanguage      = 0x22B59C
+	mkvIdLanguageBCP47 = 0x22B59D
+	mkvIdName          = 0x536E
+	mkvIdFlagDefault   = 0x88
+	mkvIdVideo         = 0xE0
+	mkvIdPixelWidth    = 0xB0
+	mkvIdPixelHeight   = 0xBA
+
+	mkvIdAttachedFile = 0x61A7
+	mkvIdFileName     = 0x466E
+	mkvIdFileMimeType = 0x4660
+	mkvIdFileData     = 0x465C
+
+	mkvTrackTypeVideo    = 1
+	mkvTrackTypeAudio    = 2
+	mkvTrackTypeSubtitle = 17
+
+	// timestamps are in nanoseconds unless the file says otherwise
+	mkvDefaultTimecodeScale = 1000000
+	// elements read in memory, clusters holding the media data are skipped and never read
+	mkvMaxElementSize = 64 << 20
+)
+
+// size of elements that continue until the end of their parent, mostly used by live streams
+const ebmlUnknownSize = -1
+
+type ebmlElement struct {
+	id   uint32
+	size int64
+	data []byte
+}
+
+// Reads a variable length integer, the length marker is kept for ids and removed for sizes
+func readEbmlVint(r io.Reader, keepMarker bool) (value uint64, length int, err error) {
+	first := make([]byte, 1)
+
+	_, err = io.ReadFull(r, first)
+	if err != nil {
+		return
+	}
+
+	length = 1
+	for mask := byte(0x80); mask != 0 && first[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+
+	if length > 8 {
+		err = errors.New("invalid EBML variable length integer")
+		return
+	}
+
+	rest := make([]byte, length-1)
+
+	_, err = io.ReadFull(r, rest)
+	if err != nil {
+		return
+	}
+
+	value = uint64(first[0])
+	if !keepMarker {
+		value &= uint64(0xff >> length)
+	}
+
+	for _, b := range rest {
+		value = value<<8 | uint64(b)
+	}
+
+	return
+}
+
+func readEbmlHeader(r io.Reader) (id uint32, size int64, headerLength int, err error) {
+	rawId, idLength, err := readEbmlVint(r, true)
+	if err != nil {
+		return
+	}
+
+	rawSize, sizeLength, err := readEbmlVint(r, false)
+	if err != nil {
+		return
+	}
+
+	id = uint32(rawId)
+	size = int64(rawSize)
+	headerLength = idLength + sizeLength
+
+	// every bit of the value set means the size is unknown
+	if rawSize == 1<<(7*sizeLength)-1 {
+		size = ebmlUnknownSize
+	}
+
+	return
+}
+
+// Splits the content of a master element in its children
+func parseEbmlElements(data []byte) ([]ebmlElement, error) {
+	elements := make([]ebmlElement, 0)
+	r := &sliceReader{data: data}
+
+	for r.offset < len(data) {
+		id, size, _, err := readEbmlHeader(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if size == ebmlUnknownSize || size > int64(len(data)-r.offset) {
+			size = int64(len(data) - r.offset)
+		}
+
+		elements = append(elements, ebmlElement{id: id, size: size, data: data[r.offset : r.offset+int(size)]})
+		r.offset += int(size)
+	}
+
+	return elements, nil
+}
+
+type sliceReader struct {
+	data   []byte
+	offset int
+}
+
+func (r *sliceReader) Read(p []byte) (int, error) {
+	if r.offset >= len(r.data) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, r.data[r.offset:])
+	r.offset += n
+
+	return n, nil
+}
+
+func ebmlUint(data []byte) uint64 {
+	var value uint64
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+
+	return value
+}
+
+func ebmlFloat(data []byte) float64 {
+	switch len(data) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(data))
+	default:
+		return 0
+	}
+}
+
+func ebmlString(data []byte) string {
+	// strings may be padded with null bytes
+	return strings.TrimRight(string(data), "\x00")
+}
+
+type mkvTrack struct {
+	Type     int
+	Number   int
+	Codec    string
+	Language string
+	Name     string
+	Default  bool
+	Width    int
+	Height   int
+}
+
+type mkvInfo struct {
+	Title  string
+	Length float64
+	Tracks []mkvTrack
+}
+
+type mkvAttachment struct {
+	Name     string
+	MimeType string
+	Data     []byte
+}
+
+/*
+** Reads the top level elements of the segment that are needed, the clusters with the media data are skipped.
+** Elements that come after the clusters, usually attachments, are found through the seek head.
+ */
+func readMatroskaElements(r io.ReadSeeker, wanted ...uint32) (map[uint32][]byte, error) {
+	id, size, _, err := readEbmlHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if id != ebmlIdHeader || size == ebmlUnknownSize || size > mkvMaxElementSize {
+		return nil, errors.New("file is not an EBML document")
+	}
+
+	header := make([]byte, size)
+
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkMatroskaDocType(header); err != nil {
+		return nil, err
+	}
+
+	id, segmentSize, _, err := readEbmlHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if id != mkvIdSegment {
+		return nil, errors.New("matroska file has no segment")
+	}
+
+	segmentStart, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	segmentEnd := int64(math.MaxInt64)
+	if segmentSize != ebmlUnknownSize {
+		segmentEnd = segmentStart + segmentSize
+	}
+
+	isWanted := make(map[uint32]bool)
+	for _, id := range wanted {
+		isWanted[id] = true
+	}
+
+	found := make(map[uint32][]byte)
+	// positions of the top level elements relative to the start of the segment
+	seekPositions := make(map[uint32]int64)
+
+	position := segmentStart
+	for position < segmentEnd {
+		id, size, headerLength, err := readEbmlHeader(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return nil, err
+		}
+
+		// clusters hold the media, the rest of the elements can only be reached through the seek head
+		if id == mkvIdCluster || size == ebmlUnknownSize {
+			break
+		}
+
+		if (isWanted[id] || id == mkvIdSeekHead) && size <= mkvMaxElementSize {
+			data := make([]byte, size)
+
+			_, err = io.ReadFull(r, data)
+			if err != nil {
+				return nil, err
+			}
+
+			if id == mkvIdSeekHead {
+				parseMatroskaSeekHead(data, seekPositions)
+			} else if _, ok := found[id]; !ok {
+				found[id] = data
+			}
+		} else {
+			_, err = r.Seek(size, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		position += int64(headerLength) + size
+	}
+
+	for _, id := range wanted {
+		if _, ok := found[id]; ok {
+			continue
+		}
+
+		relative, ok := seekPositions[id]
+		if !ok {
+			continue
+		}
+
+		_, err := r.Seek(segmentStart+relative, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+
+		elementId, size, _, err := readEbmlHeader(r)
+		if err != nil || elementId != id || size == ebmlUnknownSize || size > mkvMaxElementSize {
+			continue
+		}
+
+		data := make([]byte, size)
+
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, err
+		}
+
+		found[id] = data
+	}
+
+	return found, nil
+}
+
+func checkMatroskaDocType(header []byte) error {
+	elements, err := parseEbmlElements(header)
+	if err != nil {
+		return err
+	}
+
+	for _, element := range elements {
+		if element.id != ebmlIdDocType {
+			continue
+		}
+
+		docType := ebmlString(element.data)
+		if docType != "matroska" && docType != "webm" {
+			return errors.New("EBML document is neither matroska nor webm")
+		}
+
+		return nil
+	}
+
+	return errors.New("EBML document has no doc type")
+}
+
+func parseMatroskaSeekHead(data []byte, positions map[uint32]int64) {
+	seeks, err := parseEbmlElements(data)
+	if err != nil {
+		return
+	}
+
+	for _, seek := range seeks {
+		if seek.id != mkvIdSeek {
+			continue
+		}
+
+		children, err := parseEbmlElements(seek.data)
+		if err != nil {
+			continue
+		}
+
+		var id uint32
+		position := int64(-1)
+
+		for _, child := range children {
+			switch child.id {
+			case mkvIdSeekId:
+				id = uint32(ebmlUint(child.data))
+			case mkvIdSeekPos:
+				position = int64(ebmlUint(child.data))
+			}
+		}
+
+		if _, ok := positions[id]; !ok && id != 0 && position >= 0 {
+			positions[id] = position
+		}
+	}
+}
+
+func readMatroskaInfo(r io.ReadSeeker) (info mkvInfo, err error) {
+	elements, err := readMatroskaElements(r, mkvIdInfo, mkvIdTracks)
+	if err != nil {
+		return
+	}
+
+	if data, ok := elements[mkvIdInfo]; ok {
+		info.Title, info.Length, err = parseMatroskaSegmentInfo(data)
+		if err != nil {
+			return
+		}
+	}
+
+	if data, ok := elements[mkvIdTracks]; ok {
+		info.Tracks, err = parseMatroskaTracks(data)
+	}
+
+	return
+}
+
+func parseMatroskaSegmentInfo(data []byte) (title string, length float64, err error) {
+	elements, err := parseEbmlElements(data)
+	if err != nil {
+		return
+	}
+
+	timecodeScale := uint64(mkvDefaultTimecodeScale)
+	duration := 0.0
+
+	for _, element := range elements {
+		switch element.id {
+		case mkvIdTimecodeScale:
+			timecodeScale = ebmlUint(element.data)
+		case mkvIdDuration:
+			duration = ebmlFloat(element.data)
+		case mkvIdTitle:
+			title = ebmlString(element.data)
+		}
+	}
+
+	// the duration is expressed in ticks of timecodeScale nanoseconds
+	length = duration * float64(timecodeScale) / 1e9
+
+	return
+}
+
+func parseMatroskaTracks(data []byte) ([]mkvTrack, error) {
+	entries, err := parseEbmlElements(data)
+	if err != nil {
+		return nil, err
+	}
+
+	tracks := make([]mkvTrack, 0, len(entries))
+
+	for _, entry := range entries {
+		if entry.id != mkvIdTrackEntry {
+			continue
+		}
+
+		elements, err := parseEbmlElements(entry.data)
+		if err != nil {
+			return nil, err
+		}
+
+		// tracks are english and default unless they say otherwise
+		track := mkvTrack{Language: "eng", Default: true}
+		bcp47 := ""
+
+		for _, element := range elements {
+			switch element.id {
+			case mkvIdTrackNumber:
+				track.Number = int(ebmlUint(element.data))
+			case mkvIdTrackType:
+				track.Type = int(ebmlUint(element.data))
+			case mkvIdCodecId:
+				track.Codec = ebmlString(element.data)
+			case mkvIdLanguage:
+				track.Language = ebmlString(element.data)
+			case mkvIdLanguageBCP47:
+				bcp47 = ebmlString(element.data)
+			case mkvIdName:
+				track.Name = ebmlString(element.data)
+			case mkvIdFlagDefault:
+				track.Default = ebmlUint(element.data) == 1
+			case mkvIdVideo:
+				video, err := parseEbmlElements(element.data)
+				if err != nil {
+					return nil, err
+				}
+
+				for _, v := range video {
+					switch v.id {
+					case mkvIdPixelWidth:
+						track.Width = int(ebmlUint(v.data))
+					case mkvIdPixelHeight:
+						track.Height = int(ebmlUint(v.data))
+					}
+				}
+			}
+		}
+
+		// the BCP 47 tag takes precedence over the older ISO 639-2 language when both are present
+		if bcp47 != "" {
+			track.Language = bcp47
+		}
+
+		tracks = append(tracks, track)
+	}
+
+	return tracks, nil
+}
+
+func readMatroskaAttachments(r io.ReadSeeker) ([]mkvAttachment, error) {
+	elements, err := readMatroskaElements(r, mkvIdAttachments)
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := elements[mkvIdAttachments]
+	if !ok {
+		return nil, nil
+	}
+
+	files, err := parseEbmlElements(data)
+	if err != nil {
+		return nil, err
+	}
+
+	attachments := make([]mkvAttachment, 0, len(files))
+
+	for _, file := range files {
+		if file.id != mkvIdAttachedFile {
+			continue
+		}
+
+		elements, err := parseEbmlElements(file.data)
+		if err != nil {
+			return nil, err
+		}
+
+		var attachment mkvAttachment
+
+		for _, element := range elements {
+			switch element.id {
+			case mkvIdFileName:
+				attachment.Name = ebmlString(element.data)
+			case mkvIdFileMimeType:
+				attachment.MimeType = ebmlString(element.data)
+			case mkvIdFileData:
+				attachment.Data = element.data
+			}
+		}
+
+		attachments = append(attachments, attachment)
+	}
+
+	return attachments, nil
+}
+
+// Cover art is attached as cover.jpg or cover.png by convention, any other image attachment is a fallback
+func matroskaCover(attachments []mkvAttachment) []byte {
+	var fallback []byte
+
+	for _, attachment := range attachments {
+		if !strings.HasPrefix(attachment.MimeType, "image/") || len(attachment.Data) == 0 {
+			continue
+		}
+
+		name := strings.ToLower(attachment.Name)
+		if strings.HasPrefix(name, "cover.") {
+			return attachment.Data
+		}
+
+		if fallback == nil {
+			fallback = attachment.Data
+		}
+	}
+
+	return fallback
+}
@@ -2,22 +2,43 @@ package media
 
 import (
 	"context"
+	"io"
 
 	"github.com/egfanboy/mediapire-media-host/pkg/types"
 )
 
 type MediaApi interface {
-	GetMedia(ctx context.Context, mediaTypes []string) ([]types.MediaItem, error)
+	GetMedia(ctx context.Context, query MediaQuery) (types.MediaPage, error)
+	SearchMedia(ctx context.Context, search string, query MediaQuery) (types.MediaPage, error)
+	GetArtists(ctx context.Context, query MediaQuery) (types.ArtistPage, error)
+	GetAlbums(ctx context.Context, query MediaQuery) (types.AlbumPage, error)
+	GetGenres(ctx context.Context, query MediaQuery) (types.GenrePage, error)
+	GetAlbumTracks(ctx context.Context, albumId string, query MediaQuery) (types.MediaPage, error)
+	GetFolders(ctx context.Context) ([]types.Folder, error)
+	GetFolder(ctx context.Context, id string) (types.Folder, error)
+	DownloadFolder(ctx context.Context, id string, w io.Writer) error
+	// Lists where the template would move the items without moving them
+	PreviewOrganise(ctx context.Context, request types.OrganiseRequest) (types.OrganisePlan, error)
+	OrganiseMedia(ctx context.Context, request types.OrganiseRequest) (types.OrganisePlan, error)
 	ScanDirectory(directory string) error
 	ScanDirectories(directories ...string) error
-	StreamMedia(ctx context.Context, id string) ([]byte, error)
+	StreamMedia(ctx context.Context, id string) (MediaStream, error)
 	UnsetDirectory(directory string) error
-	DownloadMedia(ctx context.Context, ids []string) ([]byte, error)
+	DownloadMedia(ctx context.Context, ids []string, w io.Writer) error
 	DeleteMedia(ctx context.Context, ids []string) error
 	CleanupDownloadContent(ctx context.Context, transferId string) error
-	GetMediaArt(ctx context.Context, id string) ([]byte, error)
+	GetMediaArt(ctx context.Context, id string, options ArtOptions) ([]byte, error)
+	GetMediaSubtitles(ctx context.Context, id string, language string, format string) ([]byte, error)
+	GetMediaChapters(ctx context.Context, id string) ([]types.Chapter, error)
+	GetMediaLyrics(ctx context.Context, id string) (types.Lyrics, error)
+	SaveMediaLyrics(ctx context.Context, id string, lyrics types.Lyrics) (types.Lyrics, error)
 	HandleFileSystemDeletions(ctx context.Context, files []string) error
+	// Rename of a file or directory seen by the watcher, items under it keep their id once the new path is scanned
+	RegisterMove(oldPath string, newPath string)
 	UpdateItem(ctx context.Context, id string, newContent []byte) (types.MediaItem, error)
+	RestoreItem(ctx context.Context, id string) (types.MediaItem, error)
+	DiscardItemBackup(ctx context.Context, id string) error
+	PatchItemMetadata(ctx context.Context, id string, patch types.MediaMetadataPatch) (types.MediaItem, error)
 	GetMediaItemById(ctx context.Context, id string) (types.MediaItem, error)
 	GetMediaItemByIdWithContent(ctx context.Context, id string) (types.MediaItemWithContent, error)
 }
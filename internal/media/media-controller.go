@@ -1,23 +1,59 @@
 package media
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/egfanboy/mediapire-media-host/internal/app"
+	"github.com/egfanboy/mediapire-media-host/internal/utils"
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
 
+	"github.com/egfanboy/mediapire-common/exceptions"
 	"github.com/egfanboy/mediapire-common/router"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
 )
 
 const (
-	basePath = "/media"
-	pathArt  = "/media/{mediaId}/art"
+	basePath     = "/media"
+	pathArt      = "/media/{mediaId}/art"
+	pathMetadata = "/media/{mediaId}/metadata"
+	pathSubtitle = "/media/{mediaId}/subtitles/{lang}"
+	pathLyrics   = "/media/{mediaId}/lyrics"
+	pathChapters = "/media/{mediaId}/chapters"
+	pathSearch   = "/media/search"
+	pathArtists  = "/artists"
+	pathAlbums   = "/albums"
+	pathGenres   = "/genres"
+	pathTracks   = "/albums/{albumId}/tracks"
+	pathFolders  = "/folders"
+	pathFolder   = "/folders/{folderId}"
+	pathOrganise = "/organise"
+	// lists the moves of an organise run without moving anything
+	pathOrganisePreview = "/organise/preview"
+	// not built by the v1 route builder so they need the full api path
+	pathStream   = "/api/v1/media/stream"
+	pathDownload = "/api/v1/media/download"
+	// folder archives are streamed like media downloads
+	pathFolderDownload = "/api/v1/folders/{folderId}/download"
 )
 
 var (
 	queryParamOptionalMediaType = router.QueryParam{Name: "mediaType", Required: false}
 	queryParamMediaId           = router.QueryParam{Name: "mediaId", Required: true}
 	queryParamReturnContent     = router.QueryParam{Name: "returnContent", Required: true}
+	queryParamSort              = router.QueryParam{Name: "sort", Required: false}
+	queryParamOrder             = router.QueryParam{Name: "order", Required: false}
+	queryParamOffset            = router.QueryParam{Name: "offset", Required: false}
+	queryParamLimit             = router.QueryParam{Name: "limit", Required: false}
+	queryParamCursor            = router.QueryParam{Name: "cursor", Required: false}
+	queryParamSearch            = router.QueryParam{Name: "q", Required: true}
+	queryParamArtSize           = router.QueryParam{Name: "size", Required: false}
+	queryParamArtWidth          = router.QueryParam{Name: "width", Required: false}
+	queryParamSubtitleFormat    = router.QueryParam{Name: "format", Required: false}
 )
 
 type mediaController struct {
@@ -35,21 +71,253 @@ func (c mediaController) GetApis() (routes []router.RouteBuilder) {
 }
 
 func (c mediaController) GetMedia() router.RouteBuilder {
-	return router.NewV1RouteBuilder().
+	builder := router.NewV1RouteBuilder().
 		SetMethod(http.MethodOptions, http.MethodGet).
 		AddQueryParam(queryParamOptionalMediaType).
+		AddQueryParam(queryParamSort).
+		AddQueryParam(queryParamOrder).
+		AddQueryParam(queryParamOffset).
+		AddQueryParam(queryParamLimit).
+		AddQueryParam(queryParamCursor)
+
+	for field := range filterFields {
+		builder = builder.AddQueryParam(router.QueryParam{Name: field, Required: false})
+	}
+
+	return builder.
 		SetPath(basePath).
 		SetReturnCode(http.StatusOK).
 		SetHandler(func(request *http.Request, p router.RouteParams) (interface{}, error) {
-			mediaTypes := make([]string, 0)
+			query, err := mediaQueryFromParams(p)
+			if err != nil {
+				return nil, err
+			}
 
-			mediaTypeParam := p.Params[queryParamOptionalMediaType.Name]
-			if mediaTypeParam != "" {
-				mediaTypes = strings.Split(mediaTypeParam, ",")
+			page, err := c.service.GetMedia(request.Context(), query)
+			if err != nil {
+				return nil, err
 			}
 
-			items, err := c.service.GetMedia(request.Context(), mediaTypes)
-			return items, err
+			// keep returning a plain list to clients that do not paginate
+			if !query.IsPaginated() {
+				return page.Items, nil
+			}
+
+			return page, nil
+		})
+}
+
+func (c mediaController) SearchMedia() router.RouteBuilder {
+	builder := router.NewV1RouteBuilder().
+		SetMethod(http.MethodOptions, http.MethodGet).
+		AddQueryParam(queryParamSearch).
+		AddQueryParam(queryParamOptionalMediaType).
+		AddQueryParam(queryParamOffset).
+		AddQueryParam(queryParamLimit).
+		AddQueryParam(queryParamCursor)
+
+	for field := range filterFields {
+		builder = builder.AddQueryParam(router.QueryParam{Name: field, Required: false})
+	}
+
+	return builder.
+		SetPath(pathSearch).
+		SetReturnCode(http.StatusOK).
+		SetHandler(func(request *http.Request, p router.RouteParams) (interface{}, error) {
+			query, err := mediaQueryFromParams(p)
+			if err != nil {
+				return nil, err
+			}
+
+			return c.service.SearchMedia(request.Context(), router.MustGetQueryValue(p, queryParamSearch), query)
+		})
+}
+
+func mediaQueryFromParams(p router.RouteParams) (query MediaQuery, err error) {
+	query.MediaTypes = make([]string, 0)
+
+	mediaTypeParam := p.Params[queryParamOptionalMediaType.Name]
+	if mediaTypeParam != "" {
+		query.MediaTypes = strings.Split(mediaTypeParam, ",")
+	}
+
+	query.Sort = p.Params[queryParamSort.Name]
+	query.Order = p.Params[queryParamOrder.Name]
+	query.Cursor = p.Params[queryParamCursor.Name]
+
+	query.Offset, err = intQueryParam(p, queryParamOffset)
+	if err != nil {
+		return
+	}
+
+	query.Limit, err = intQueryParam(p, queryParamLimit)
+	if err != nil {
+		return
+	}
+
+	query.Filters = make(map[string]string)
+
+	for field := range filterFields {
+		if value := p.Params[field]; value != "" {
+			query.Filters[field] = value
+		}
+	}
+
+	return
+}
+
+// Query of the listings that only support pagination
+func pageQueryFromParams(p router.RouteParams) (query MediaQuery, err error) {
+	query.Cursor = p.Params[queryParamCursor.Name]
+
+	query.Offset, err = intQueryParam(p, queryParamOffset)
+	if err != nil {
+		return
+	}
+
+	query.Limit, err = intQueryParam(p, queryParamLimit)
+
+	return
+}
+
+func intQueryParam(p router.RouteParams, param router.QueryParam) (int, error) {
+	value := p.Params[param.Name]
+	if value == "" {
+		return 0, nil
+	}
+
+	result, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, &exceptions.ApiException{
+			StatusCode: http.StatusBadRequest,
+			Err:        fmt.Errorf("query parameter %s must be a number", param.Name),
+		}
+	}
+
+	return result, nil
+}
+
+func (c mediaController) GetArtists() router.RouteBuilder {
+	return router.NewV1RouteBuilder().
+		SetMethod(http.MethodOptions, http.MethodGet).
+		AddQueryParam(queryParamOffset).
+		AddQueryParam(queryParamLimit).
+		AddQueryParam(queryParamCursor).
+		SetPath(pathArtists).
+		SetReturnCode(http.StatusOK).
+		SetHandler(func(request *http.Request, p router.RouteParams) (interface{}, error) {
+			query, err := pageQueryFromParams(p)
+			if err != nil {
+				return nil, err
+			}
+
+			return c.service.GetArtists(request.Context(), query)
+		})
+}
+
+func (c mediaController) GetAlbums() router.RouteBuilder {
+	return router.NewV1RouteBuilder().
+		SetMethod(http.MethodOptions, http.MethodGet).
+		AddQueryParam(queryParamOffset).
+		AddQueryParam(queryParamLimit).
+		AddQueryParam(queryParamCursor).
+		SetPath(pathAlbums).
+		SetReturnCode(http.StatusOK).
+		SetHandler(func(request *http.Request, p router.RouteParams) (interface{}, error) {
+			query, err := pageQueryFromParams(p)
+			if err != nil {
+				return nil, err
+			}
+
+			return c.service.GetAlbums(request.Context(), query)
+		})
+}
+
+func (c mediaController) GetGenres() router.RouteBuilder {
+	return router.NewV1RouteBuilder().
+		SetMethod(http.MethodOptions, http.MethodGet).
+		AddQueryParam(queryParamOffset).
+		AddQueryParam(queryParamLimit).
+		AddQueryParam(queryParamCursor).
+		SetPath(pathGenres).
+		SetReturnCode(http.StatusOK).
+		SetHandler(func(request *http.Request, p router.RouteParams) (interface{}, error) {
+			query, err := pageQueryFromParams(p)
+			if err != nil {
+				return nil, err
+			}
+
+			return c.service.GetGenres(request.Context(), query)
+		})
+}
+
+func (c mediaController) GetAlbumTracks() router.RouteBuilder {
+	return router.NewV1RouteBuilder().
+		SetMethod(http.MethodOptions, http.MethodGet).
+		AddQueryParam(queryParamOffset).
+		AddQueryParam(queryParamLimit).
+		AddQueryParam(queryParamCursor).
+		SetPath(pathTracks).
+		SetReturnCode(http.StatusOK).
+		SetHandler(func(request *http.Request, p router.RouteParams) (interface{}, error) {
+			query, err := pageQueryFromParams(p)
+			if err != nil {
+				return nil, err
+			}
+
+			return c.service.GetAlbumTracks(request.Context(), p.Params["albumId"], query)
+		})
+}
+
+func (c mediaController) GetFolders() router.RouteBuilder {
+	return router.NewV1RouteBuilder().
+		SetMethod(http.MethodOptions, http.MethodGet).
+		SetPath(pathFolders).
+		SetReturnCode(http.StatusOK).
+		SetHandler(func(request *http.Request, p router.RouteParams) (interface{}, error) {
+			return c.service.GetFolders(request.Context())
+		})
+}
+
+func (c mediaController) GetFolder() router.RouteBuilder {
+	return router.NewV1RouteBuilder().
+		SetMethod(http.MethodOptions, http.MethodGet).
+		SetPath(pathFolder).
+		SetReturnCode(http.StatusOK).
+		SetHandler(func(request *http.Request, p router.RouteParams) (interface{}, error) {
+			return c.service.GetFolder(request.Context(), p.Params["folderId"])
+		})
+}
+
+func (c mediaController) PreviewOrganise() router.RouteBuilder {
+	return router.NewV1RouteBuilder().
+		SetMethod(http.MethodOptions, http.MethodPost).
+		SetPath(pathOrganisePreview).
+		SetReturnCode(http.StatusOK).
+		SetHandler(func(request *http.Request, p router.RouteParams) (interface{}, error) {
+			var body types.OrganiseRequest
+			err := p.PopulateBody(&body)
+			if err != nil {
+				return nil, err
+			}
+
+			return c.service.PreviewOrganise(request.Context(), body)
+		})
+}
+
+func (c mediaController) OrganiseMedia() router.RouteBuilder {
+	return router.NewV1RouteBuilder().
+		SetMethod(http.MethodOptions, http.MethodPost).
+		SetPath(pathOrganise).
+		SetReturnCode(http.StatusOK).
+		SetHandler(func(request *http.Request, p router.RouteParams) (interface{}, error) {
+			var body types.OrganiseRequest
+			err := p.PopulateBody(&body)
+			if err != nil {
+				return nil, err
+			}
+
+			return c.service.OrganiseMedia(request.Context(), body)
 		})
 }
 
@@ -77,59 +345,237 @@ func (c mediaController) GetMediaArt() router.RouteBuilder {
 	return router.NewV1RouteBuilder().
 		SetMethod(http.MethodOptions, http.MethodGet).
 		SetPath(pathArt).
+		AddQueryParam(queryParamArtSize).
+		AddQueryParam(queryParamArtWidth).
 		SetReturnCode(http.StatusOK).
 		SetDataType(router.DataTypeFile).
 		SetHandler(func(request *http.Request, p router.RouteParams) (interface{}, error) {
 			mediaId := p.Params["mediaId"]
 
-			items, err := c.service.GetMediaArt(request.Context(), mediaId)
+			var options ArtOptions
+			var err error
+
+			options.Size, err = intQueryParam(p, queryParamArtSize)
+			if err != nil {
+				return nil, err
+			}
+
+			options.Width, err = intQueryParam(p, queryParamArtWidth)
+			if err != nil {
+				return nil, err
+			}
+
+			items, err := c.service.GetMediaArt(request.Context(), mediaId, options)
 			return items, err
 		})
 }
 
-func (c mediaController) StreamMedia() router.RouteBuilder {
+func (c mediaController) GetMediaSubtitles() router.RouteBuilder {
 	return router.NewV1RouteBuilder().
 		SetMethod(http.MethodOptions, http.MethodGet).
-		SetPath(basePath + "/stream").
-		SetReturnCode(200).
+		SetPath(pathSubtitle).
+		AddQueryParam(queryParamSubtitleFormat).
+		SetReturnCode(http.StatusOK).
 		SetDataType(router.DataTypeFile).
-		AddQueryParam(router.QueryParam{Name: "id", Required: true}).
 		SetHandler(func(request *http.Request, p router.RouteParams) (interface{}, error) {
-			id := p.Params["id"]
-			return c.service.StreamMedia(request.Context(), id)
+			// srt subtitles are converted to vtt when requested so browsers can use them
+			return c.service.GetMediaSubtitles(request.Context(), p.Params["mediaId"], p.Params["lang"], p.Params[queryParamSubtitleFormat.Name])
 		})
 }
 
-func (c mediaController) DownloadMedia() router.RouteBuilder {
+func (c mediaController) GetMediaChapters() router.RouteBuilder {
 	return router.NewV1RouteBuilder().
-		SetMethod(http.MethodOptions, http.MethodPost).
-		SetPath(basePath + "/download").
-		SetReturnCode(200).
-		SetDataType(router.DataTypeFile).
+		SetMethod(http.MethodOptions, http.MethodGet).
+		SetPath(pathChapters).
+		SetReturnCode(http.StatusOK).
+		SetHandler(func(request *http.Request, p router.RouteParams) (interface{}, error) {
+			return c.service.GetMediaChapters(request.Context(), p.Params["mediaId"])
+		})
+}
+
+func (c mediaController) GetMediaLyrics() router.RouteBuilder {
+	return router.NewV1RouteBuilder().
+		SetMethod(http.MethodOptions, http.MethodGet).
+		SetPath(pathLyrics).
+		SetReturnCode(http.StatusOK).
+		SetHandler(func(request *http.Request, p router.RouteParams) (interface{}, error) {
+			return c.service.GetMediaLyrics(request.Context(), p.Params["mediaId"])
+		})
+}
+
+func (c mediaController) SaveMediaLyrics() router.RouteBuilder {
+	return router.NewV1RouteBuilder().
+		SetMethod(http.MethodOptions, http.MethodPut).
+		SetPath(pathLyrics).
+		SetReturnCode(http.StatusOK).
 		SetHandler(func(request *http.Request, p router.RouteParams) (interface{}, error) {
-			var body []string
+			var body types.Lyrics
 			err := p.PopulateBody(&body)
 			if err != nil {
 				return nil, err
 			}
-			return c.service.DownloadMedia(request.Context(), body)
+
+			return c.service.SaveMediaLyrics(request.Context(), p.Params["mediaId"], body)
 		})
 }
 
+func (c mediaController) PatchMediaMetadata() router.RouteBuilder {
+	return router.NewV1RouteBuilder().
+		SetMethod(http.MethodOptions, http.MethodPatch).
+		SetPath(pathMetadata).
+		SetReturnCode(http.StatusOK).
+		SetHandler(func(request *http.Request, p router.RouteParams) (interface{}, error) {
+			var body types.MediaMetadataPatch
+			err := p.PopulateBody(&body)
+			if err != nil {
+				return nil, err
+			}
+
+			item, err := c.service.PatchItemMetadata(request.Context(), p.Params["mediaId"], body)
+			if err != nil {
+				return nil, err
+			}
+
+			// a single patch is never rolled back, its previous content is not needed
+			err = c.service.DiscardItemBackup(request.Context(), item.Id)
+			if err != nil {
+				log.Err(err).Msgf("Failed to remove previous content of item %s", item.Id)
+			}
+
+			return item, nil
+		})
+}
+
+/*
+** Streaming is served directly on the mux router instead of through a route builder since it needs
+** the response writer to answer range and conditional requests without loading the whole file in memory.
+ */
+func (c mediaController) StreamMedia(w http.ResponseWriter, request *http.Request) {
+	if request.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	id := request.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "query parameter id is required", http.StatusBadRequest)
+		return
+	}
+
+	stream, err := c.service.StreamMedia(request.Context(), id)
+	if err != nil {
+		utils.WriteHttpError(w, err)
+		return
+	}
+
+	defer stream.Content.Close()
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("ETag", stream.ETag())
+
+	// handles Range, If-Range, If-None-Match and If-Modified-Since as well as setting Last-Modified
+	http.ServeContent(w, request, fmt.Sprintf("%s.%s", stream.Item.Name, stream.Item.Extension), stream.ModTime, stream.Content)
+}
+
+// Archive is written to the response as it is created, served directly on the mux router for the same reason as StreamMedia
+func (c mediaController) DownloadMedia(w http.ResponseWriter, request *http.Request) {
+	if request.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var body []string
+	err := json.NewDecoder(request.Body).Decode(&body)
+	if err != nil {
+		utils.WriteHttpError(w, &exceptions.ApiException{StatusCode: http.StatusBadRequest, Err: err})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="media.zip"`)
+
+	response := &countingWriter{w: w}
+
+	err = c.service.DownloadMedia(request.Context(), body, response)
+	if err != nil {
+		if response.written == 0 {
+			w.Header().Del("Content-Disposition")
+			utils.WriteHttpError(w, err)
+			return
+		}
+
+		// part of the archive was already sent, the client will get a truncated archive
+		log.Err(err).Msg("Failed to write archive to the response")
+	}
+}
+
+func (c mediaController) DownloadFolder(w http.ResponseWriter, request *http.Request) {
+	if request.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	folderId := mux.Vars(request)["folderId"]
+
+	folder, err := c.service.GetFolder(request.Context(), folderId)
+	if err != nil {
+		utils.WriteHttpError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", folder.Name+".zip"))
+
+	response := &countingWriter{w: w}
+
+	err = c.service.DownloadFolder(request.Context(), folderId, response)
+	if err != nil {
+		if response.written == 0 {
+			w.Header().Del("Content-Disposition")
+			utils.WriteHttpError(w, err)
+			return
+		}
+
+		// part of the archive was already sent, the client will get a truncated archive
+		log.Err(err).Msg("Failed to write folder archive to the response")
+	}
+}
+
 func initController() mediaController {
 	c := mediaController{service: NewMediaService()}
 
 	c.builders = append(c.builders,
 		c.GetMedia,
-		c.StreamMedia,
-		c.DownloadMedia,
+		c.SearchMedia,
+		c.GetArtists,
+		c.GetAlbums,
+		c.GetGenres,
+		c.GetAlbumTracks,
+		c.GetFolders,
+		c.GetFolder,
+		c.PreviewOrganise,
+		c.OrganiseMedia,
 		c.GetMediaArt,
+		c.GetMediaSubtitles,
+		c.GetMediaChapters,
+		c.GetMediaLyrics,
+		c.SaveMediaLyrics,
 		c.GetMediaById,
+		c.PatchMediaMetadata,
 	)
 
 	return c
 }
 
+// Registers the routes that cannot be expressed through a route builder
+func BuildRawRoutes(r *mux.Router) {
+	c := mediaController{service: NewMediaService()}
+
+	r.HandleFunc(pathStream, c.StreamMedia).Methods(http.MethodOptions, http.MethodGet, http.MethodHead)
+	r.HandleFunc(pathDownload, c.DownloadMedia).Methods(http.MethodOptions, http.MethodPost)
+	r.HandleFunc(pathFolderDownload, c.DownloadFolder).Methods(http.MethodOptions, http.MethodGet)
+}
+
 func init() {
-	app.GetApp().ControllerRegistry.Register(initController())
+	app.RegisterController(initController())
 }
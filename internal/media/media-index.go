@@ -0,0 +1,574 @@
+package media
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/egfanboy/mediapire-media-host/internal/app"
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Bump when the layout of mediaIndexEntry or of any metadata struct changes
+	mediaIndexSchemaVersion = 1
+	mediaIndexFileName      = "index.json"
+	// changes made within this delay of each other are written to disk at once
+	mediaIndexSaveDelay = 5 * time.Second
+)
+
+type metadataDecoder func(raw json.RawMessage) (interface{}, error)
+
+// Decoders for the metadata of each media type, keyed the same way as mediaTypeFactory
+var metadataDecoders = map[string]metadataDecoder{
+	"mp3":  decodeMetadata[Mp3Metadata],
+	"flac": decodeMetadata[FlacMetadata],
+	"wav":  decodeMetadata[PcmMetadata],
+	"aiff": decodeMetadata[PcmMetadata],
+	"aif":  decodeMetadata[PcmMetadata],
+	"ogg":  decodeMetadata[OggMetadata],
+	"opus": decodeMetadata[OggMetadata],
+	"mp4":  decodeMetadata[Mp4Metadata],
+	"m4a":  decodeMetadata[Mp4Metadata],
+	"m4b":  decodeMetadata[Mp4Metadata],
+	"m4v":  decodeMetadata[Mp4Metadata],
+	"mkv":  decodeMetadata[MatroskaMetadata],
+	"mka":  decodeMetadata[MatroskaMetadata],
+	"webm": decodeMetadata[MatroskaMetadata],
+}
+
+/*
+** Migrations from a schema version to the next one. When the index on disk has a version
+** that cannot be migrated to the current one it is discarded and rebuilt by the next scan.
+ */
+var mediaIndexMigrations = map[int]func(entries map[string]mediaIndexEntry) (map[string]mediaIndexEntry, error){}
+
+// Clears the modification time of the entries of these media types so the next scan parses them again
+func invalidateIndexEntries(entries map[string]mediaIndexEntry, extensions ...string) map[string]mediaIndexEntry {
+	for k, entry := range entries {
+		for _, ext := range extensions {
+			if entry.Extension == ext {
+				entry.ModTime = 0
+				entries[k] = entry
+			}
+		}
+	}
+
+	return entries
+}
+
+func decodeMetadata[T any](raw json.RawMessage) (interface{}, error) {
+	var metadata T
+
+	err := json.Unmarshal(raw, &metadata)
+
+	return metadata, err
+}
+
+// Everything we know about a media file on disk, keyed by its path in the index
+type mediaIndexEntry struct {
+	Id        string          `json:"id"`
+	Name      string          `json:"name"`
+	Extension string          `json:"extension"`
+	Path      string          `json:"path"`
+	ParentDir string          `json:"parentDir"`
+	Metadata  json.RawMessage `json:"metadata"`
+	Size      int64           `json:"size"`
+	ModTime   int64           `json:"modTime"`
+	Inode     uint64          `json:"inode"`
+	AddedAt   int64           `json:"addedAt"`
+	// recognises the file when it is moved to another file system, see fileFingerprint
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+type mediaIndexFile struct {
+	SchemaVersion int                        `json:"schemaVersion"`
+	Entries       map[string]mediaIndexEntry `json:"entries"`
+	// whether mp3 entries were parsed with the exact duration
+	ExactMp3Duration bool `json:"exactMp3Duration"`
+}
+
+type mediaIndex struct {
+	mu      sync.Mutex
+	entries map[string]mediaIndexEntry
+	// paths of the entries by inode and by fingerprint, used to find where a moved file was indexed
+	byInode       map[uint64]string
+	byFingerprint map[string]string
+	dirty         bool
+	// pending save of the changes, see ScheduleSave
+	saveTimer *time.Timer
+	// only one save writes the file at a time
+	saveMu sync.Mutex
+}
+
+var (
+	index     *mediaIndex
+	indexOnce sync.Once
+)
+
+func getMediaIndex() *mediaIndex {
+	indexOnce.Do(func() {
+		index = &mediaIndex{
+			entries:       make(map[string]mediaIndexEntry),
+			byInode:       make(map[uint64]string),
+			byFingerprint: make(map[string]string),
+		}
+
+		err := index.load()
+		if err != nil {
+			log.Err(err).Msg("Failed to load the media index, it will be rebuilt")
+		}
+	})
+
+	return index
+}
+
+func getMediaIndexPath() (string, error) {
+	basePath, err := app.GetBasePath()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(basePath, mediaIndexFileName), nil
+}
+
+func (i *mediaIndex) load() error {
+	indexPath, err := getMediaIndexPath()
+	if err != nil {
+		return err
+	}
+
+	content, err := os.ReadFile(indexPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	var indexFile mediaIndexFile
+	err = json.Unmarshal(content, &indexFile)
+	if err != nil {
+		return err
+	}
+
+	entries := indexFile.Entries
+
+	for version := indexFile.SchemaVersion; version < mediaIndexSchemaVersion; version++ {
+		migrate, ok := mediaIndexMigrations[version]
+		if !ok {
+			log.Info().Msgf("No migration for media index schema version %d, rebuilding the index", version)
+			return nil
+		}
+
+		entries, err = migrate(entries)
+		if err != nil {
+			return err
+		}
+	}
+
+	if indexFile.SchemaVersion > mediaIndexSchemaVersion {
+		log.Info().Msgf("Media index schema version %d is newer than supported version %d, rebuilding the index", indexFile.SchemaVersion, mediaIndexSchemaVersion)
+		return nil
+	}
+
+	for filePath, entry := range entries {
+		i.setEntry(filePath, entry)
+	}
+
+	if indexFile.ExactMp3Duration != app.GetApp().Scan.ExactMp3Duration {
+		log.Info().Msg("Mp3 duration mode changed, mp3 files will be parsed again")
+		i.entries = invalidateIndexEntries(i.entries, "mp3")
+		i.dirty = true
+	}
+
+	return nil
+}
+
+// Returns the indexed item for the file if the file did not change since it was indexed
+func (i *mediaIndex) Lookup(filePath string, info os.FileInfo) (types.MediaItem, bool) {
+	i.mu.Lock()
+	entry, ok := i.entries[filePath]
+	i.mu.Unlock()
+
+	if !ok || entry.Size != info.Size() || entry.ModTime != info.ModTime().UnixNano() || entry.Inode != getInode(info) {
+		return types.MediaItem{}, false
+	}
+
+	item := types.MediaItem{
+		Id:        entry.Id,
+		Name:      entry.Name,
+		Extension: entry.Extension,
+		Path:      entry.Path,
+		ParentDir: entry.ParentDir,
+	}
+
+	if decode, ok := metadataDecoders[entry.Extension]; ok && len(entry.Metadata) > 0 {
+		metadata, err := decode(entry.Metadata)
+		if err != nil {
+			log.Err(err).Msgf("Failed to decode indexed metadata for %s", filepath.Base(filePath))
+			return types.MediaItem{}, false
+		}
+
+		item.Metadata = metadata
+	}
+
+	return item, true
+}
+
+func (i *mediaIndex) Add(item types.MediaItem, info os.FileInfo) {
+	metadata, err := json.Marshal(item.Metadata)
+	if err != nil {
+		log.Err(err).Msgf("Failed to index metadata for item %s", item.Id)
+		return
+	}
+
+	fingerprint, err := fileFingerprint(item.Path, info.Size())
+	if err != nil {
+		log.Debug().Err(err).Msgf("Failed to fingerprint item %s", item.Id)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	addedAt := time.Now().UnixNano()
+	// re-indexing a changed file does not make it a new addition
+	if existing, ok := i.entries[item.Path]; ok && existing.AddedAt != 0 {
+		addedAt = existing.AddedAt
+	}
+
+	i.setEntry(item.Path, mediaIndexEntry{
+		Id:          item.Id,
+		Name:        item.Name,
+		Extension:   item.Extension,
+		Path:        item.Path,
+		ParentDir:   item.ParentDir,
+		Metadata:    metadata,
+		Size:        info.Size(),
+		ModTime:     info.ModTime().UnixNano(),
+		Inode:       getInode(info),
+		AddedAt:     addedAt,
+		Fingerprint: fingerprint,
+	})
+	i.dirty = true
+}
+
+// Keeps the lookups by inode and fingerprint in sync with the entries, the caller holds the lock
+func (i *mediaIndex) setEntry(filePath string, entry mediaIndexEntry) {
+	i.deleteEntry(filePath)
+
+	i.entries[filePath] = entry
+
+	if entry.Inode != 0 {
+		i.byInode[entry.Inode] = filePath
+	}
+
+	if entry.Fingerprint != "" {
+		i.byFingerprint[entry.Fingerprint] = filePath
+	}
+}
+
+func (i *mediaIndex) deleteEntry(filePath string) {
+	entry, ok := i.entries[filePath]
+	if !ok {
+		return
+	}
+
+	if i.byInode[entry.Inode] == filePath {
+		delete(i.byInode, entry.Inode)
+	}
+
+	if i.byFingerprint[entry.Fingerprint] == filePath {
+		delete(i.byFingerprint, entry.Fingerprint)
+	}
+
+	delete(i.entries, filePath)
+}
+
+func (i *mediaIndex) Entry(filePath string) (mediaIndexEntry, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	entry, ok := i.entries[filePath]
+
+	return entry, ok
+}
+
+// Indexed file with this inode and size that is no longer on disk, ie it was renamed to filePath
+func (i *mediaIndex) FindByInode(inode uint64, size int64, filePath string) (mediaIndexEntry, bool) {
+	if inode == 0 {
+		return mediaIndexEntry{}, false
+	}
+
+	i.mu.Lock()
+	indexedPath, ok := i.byInode[inode]
+	entry := i.entries[indexedPath]
+	i.mu.Unlock()
+
+	if !ok || indexedPath == filePath || entry.Size != size || fileExists(indexedPath) {
+		return mediaIndexEntry{}, false
+	}
+
+	return entry, true
+}
+
+// Indexed file with this fingerprint that is no longer on disk, ie it was moved to filePath
+func (i *mediaIndex) FindByFingerprint(fingerprint string, filePath string) (mediaIndexEntry, bool) {
+	if fingerprint == "" {
+		return mediaIndexEntry{}, false
+	}
+
+	i.mu.Lock()
+	indexedPath, ok := i.byFingerprint[fingerprint]
+	entry := i.entries[indexedPath]
+	i.mu.Unlock()
+
+	if !ok || indexedPath == filePath || fileExists(indexedPath) {
+		return mediaIndexEntry{}, false
+	}
+
+	return entry, true
+}
+
+/*
+** Whether some indexed file is no longer at its path, ie it was moved and can be found again by its fingerprint.
+** Only stats the files, it stops at the first one that is gone.
+ */
+func (i *mediaIndex) HasMissingFiles() bool {
+	i.mu.Lock()
+	paths := make([]string, 0, len(i.entries))
+	for filePath := range i.entries {
+		paths = append(paths, filePath)
+	}
+	i.mu.Unlock()
+
+	for _, filePath := range paths {
+		if !fileExists(filePath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Fingerprints an entry indexed before fingerprints were recorded
+func (i *mediaIndex) BackfillFingerprint(filePath string, info os.FileInfo) {
+	i.mu.Lock()
+	entry, ok := i.entries[filePath]
+	i.mu.Unlock()
+
+	if !ok || entry.Fingerprint != "" {
+		return
+	}
+
+	fingerprint, err := fileFingerprint(filePath, info.Size())
+	if err != nil {
+		return
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if entry, ok := i.entries[filePath]; ok {
+		entry.Fingerprint = fingerprint
+		i.setEntry(filePath, entry)
+		i.dirty = true
+	}
+}
+
+// Keeps when a moved item was first indexed
+func (i *mediaIndex) SetAddedAt(filePath string, addedAt int64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if entry, ok := i.entries[filePath]; ok {
+		entry.AddedAt = addedAt
+		i.entries[filePath] = entry
+		i.dirty = true
+	}
+}
+
+// Moves the entry of a file to its new path, its content did not change so it does not need to be parsed again
+func (i *mediaIndex) Move(oldPath string, item types.MediaItem, info os.FileInfo) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	entry, ok := i.entries[oldPath]
+	if !ok {
+		return
+	}
+
+	i.deleteEntry(oldPath)
+
+	entry.Name = item.Name
+	entry.Path = item.Path
+	entry.ParentDir = item.ParentDir
+	// a copy across file systems is a new file
+	entry.ModTime = info.ModTime().UnixNano()
+	entry.Inode = getInode(info)
+
+	i.setEntry(item.Path, entry)
+	i.dirty = true
+}
+
+// Returns when the file was first indexed, zero time if it is not indexed
+func (i *mediaIndex) AddedAt(filePath string) time.Time {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if entry, ok := i.entries[filePath]; ok && entry.AddedAt != 0 {
+		return time.Unix(0, entry.AddedAt)
+	}
+
+	return time.Time{}
+}
+
+// Forces the next lookup of the file to miss while keeping when it was added
+func (i *mediaIndex) Invalidate(filePath string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if entry, ok := i.entries[filePath]; ok {
+		entry.ModTime = 0
+		i.entries[filePath] = entry
+		i.dirty = true
+	}
+}
+
+func (i *mediaIndex) Remove(filePath string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if _, ok := i.entries[filePath]; ok {
+		i.deleteEntry(filePath)
+		i.dirty = true
+	}
+}
+
+// Ids of the indexed items, items are indexed before their art is extracted and the index is loaded before any scan
+func (i *mediaIndex) Ids() map[string]bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	ids := make(map[string]bool, len(i.entries))
+	for _, entry := range i.entries {
+		ids[entry.Id] = true
+	}
+
+	return ids
+}
+
+// Removes the entries under a directory that were not found when scanning it
+func (i *mediaIndex) Prune(directory string, seen map[string]bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	prefix := strings.TrimSuffix(directory, string(filepath.Separator)) + string(filepath.Separator)
+
+	for filePath := range i.entries {
+		if strings.HasPrefix(filePath, prefix) && !seen[filePath] {
+			i.deleteEntry(filePath)
+			i.dirty = true
+		}
+	}
+}
+
+// Saves the index once changes stop coming in for a moment instead of on every change
+func (i *mediaIndex) ScheduleSave() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.saveTimer != nil {
+		return
+	}
+
+	i.saveTimer = time.AfterFunc(mediaIndexSaveDelay, func() {
+		i.mu.Lock()
+		i.saveTimer = nil
+		i.mu.Unlock()
+
+		i.Save()
+	})
+}
+
+// Writes the changes that are waiting for their scheduled save, called before the host stops
+func SaveMediaIndex() {
+	err := getMediaIndex().Save()
+	if err != nil {
+		log.Err(err).Msg("Failed to save the media index")
+	}
+}
+
+/*
+** Writes the index to disk if it changed since the last save. The entries are copied under the lock and written
+** without it so lookups are not blocked while the index is encoded.
+ */
+func (i *mediaIndex) Save() error {
+	i.saveMu.Lock()
+	defer i.saveMu.Unlock()
+
+	i.mu.Lock()
+
+	if !i.dirty {
+		i.mu.Unlock()
+		return nil
+	}
+
+	entries := make(map[string]mediaIndexEntry, len(i.entries))
+	for k, entry := range i.entries {
+		entries[k] = entry
+	}
+
+	i.dirty = false
+	i.mu.Unlock()
+
+	err := writeMediaIndex(entries)
+	if err != nil {
+		// written again with the next save
+		i.mu.Lock()
+		i.dirty = true
+		i.mu.Unlock()
+	}
+
+	return err
+}
+
+func writeMediaIndex(entries map[string]mediaIndexEntry) error {
+	content, err := json.Marshal(mediaIndexFile{
+		SchemaVersion:    mediaIndexSchemaVersion,
+		Entries:          entries,
+		ExactMp3Duration: app.GetApp().Scan.ExactMp3Duration,
+	})
+	if err != nil {
+		return err
+	}
+
+	indexPath, err := getMediaIndexPath()
+	if err != nil {
+		return err
+	}
+
+	// write next to the index and rename so a crash never leaves a partially written index
+	tmpPath := indexPath + ".tmp"
+
+	err = os.WriteFile(tmpPath, content, os.ModePerm)
+	if err != nil {
+		log.Err(err).Msg("Failed to write media index to disk")
+		return err
+	}
+
+	err = os.Rename(tmpPath, indexPath)
+	if err != nil {
+		log.Err(err).Msg("Failed to replace media index on disk")
+		return err
+	}
+
+	return nil
+}
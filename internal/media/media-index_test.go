@@ -0,0 +1,34 @@
+package media
+
+import "testing"
+
+func TestMediaIndexScheduleSaveCoalescesChanges(t *testing.T) {
+	i := &mediaIndex{entries: make(map[string]mediaIndexEntry)}
+
+	i.ScheduleSave()
+	timer := i.saveTimer
+
+	i.ScheduleSave()
+
+	if timer == nil || i.saveTimer != timer {
+		t.Fatal("changes made before the pending save should share it")
+	}
+
+	timer.Stop()
+}
+
+func TestMediaIndexHasMissingFiles(t *testing.T) {
+	present := writeTestFile(t, "present.mp3", fakeAudio)
+
+	i := &mediaIndex{entries: map[string]mediaIndexEntry{present: {Path: present}}}
+	if i.HasMissingFiles() {
+		t.Fatal("no indexed file is missing")
+	}
+
+	missing := present + ".moved"
+	i.entries[missing] = mediaIndexEntry{Path: missing}
+
+	if !i.HasMissingFiles() {
+		t.Fatal("indexed file that is not on disk should be reported")
+	}
+}
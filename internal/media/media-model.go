@@ -1,28 +1,424 @@
 package media
 
 import (
+	"fmt"
+	"io"
+	"time"
+
 	"github.com/dhowden/tag"
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
 )
 
+// Open content of a media item, the caller is responsible for closing it
+type MediaStream struct {
+	Item    types.MediaItem
+	Content io.ReadSeekCloser
+	Size    int64
+	ModTime time.Time
+}
+
+// Strong validator derived from the item, its size and the last time it was modified on disk
+func (s MediaStream) ETag() string {
+	return fmt.Sprintf(`"%s-%x-%x"`, s.Item.Id, s.Size, s.ModTime.UnixNano())
+}
+
 type Mp3Metadata struct {
-	Artist     string  `json:"artist"`
-	Title      string  `json:"title"`
-	Album      string  `json:"album"`
-	Genre      string  `json:"genre"`
-	TrackIndex int     `json:"trackIndex"`
-	TrackOf    int     `json:"trackOf"`
-	Length     float64 `json:"length"`
+	Artist      string  `json:"artist"`
+	AlbumArtist string  `json:"albumArtist"`
+	Title       string  `json:"title"`
+	Album       string  `json:"album"`
+	Genre       string  `json:"genre"`
+	Year        int     `json:"year"`
+	TrackIndex  int     `json:"trackIndex"`
+	TrackOf     int     `json:"trackOf"`
+	DiscIndex   int     `json:"discIndex"`
+	DiscOf      int     `json:"discOf"`
+	Length      float64 `json:"length"`
+	// kbps, the average is over the audio frames only. The peak of variable bitrate files is 0 unless they were
+	// scanned with an exact duration since it requires decoding every frame
+	BitrateAvg  int       `json:"bitrateAvg"`
+	BitratePeak int       `json:"bitratePeak"`
+	SampleRate  int       `json:"sampleRate"`
+	ChannelMode string    `json:"channelMode"`
+	Vbr         bool      `json:"vbr"`
+	Encoder     string    `json:"encoder"`
+	FileSize    int64     `json:"fileSize"`
+	ModTime     time.Time `json:"modTime"`
+	// audiobooks and podcasts
+	Series   string          `json:"series,omitempty"`
+	Volume   float64         `json:"volume,omitempty"`
+	Chapters []types.Chapter `json:"chapters,omitempty"`
+}
+
+type FlacMetadata struct {
+	Artist      string  `json:"artist"`
+	AlbumArtist string  `json:"albumArtist"`
+	Title       string  `json:"title"`
+	Album       string  `json:"album"`
+	Genre       string  `json:"genre"`
+	Year        int     `json:"year"`
+	TrackIndex  int     `json:"trackIndex"`
+	TrackOf     int     `json:"trackOf"`
+	DiscIndex   int     `json:"discIndex"`
+	DiscOf      int     `json:"discOf"`
+	Length      float64 `json:"length"`
+	SampleRate  int     `json:"sampleRate"`
+	BitDepth    int     `json:"bitDepth"`
+	Channels    int     `json:"channels"`
+}
+
+// Uncompressed audio of wav and aiff files
+type PcmMetadata struct {
+	Artist      string  `json:"artist"`
+	AlbumArtist string  `json:"albumArtist"`
+	Title       string  `json:"title"`
+	Album       string  `json:"album"`
+	Genre       string  `json:"genre"`
+	Year        int     `json:"year"`
+	TrackIndex  int     `json:"trackIndex"`
+	TrackOf     int     `json:"trackOf"`
+	DiscIndex   int     `json:"discIndex"`
+	DiscOf      int     `json:"discOf"`
+	Length      float64 `json:"length"`
+	SampleRate  int     `json:"sampleRate"`
+	BitDepth    int     `json:"bitDepth"`
+	Channels    int     `json:"channels"`
+}
+
+type OggMetadata struct {
+	Artist      string  `json:"artist"`
+	AlbumArtist string  `json:"albumArtist"`
+	Title       string  `json:"title"`
+	Album       string  `json:"album"`
+	Genre       string  `json:"genre"`
+	Year        int     `json:"year"`
+	TrackIndex  int     `json:"trackIndex"`
+	TrackOf     int     `json:"trackOf"`
+	DiscIndex   int     `json:"discIndex"`
+	DiscOf      int     `json:"discOf"`
+	Length      float64 `json:"length"`
+	SampleRate  int     `json:"sampleRate"`
+	Channels    int     `json:"channels"`
+	// vorbis or opus, the extension does not always match the codec
+	Codec string `json:"codec"`
+}
+
+type VideoMetadata struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// fourcc of the mp4 sample description, ie avc1, or matroska codec id, ie V_MPEG4/ISO/AVC
+	Codec string `json:"codec"`
+}
+
+type Mp4Metadata struct {
+	Artist      string  `json:"artist"`
+	AlbumArtist string  `json:"albumArtist"`
+	Title       string  `json:"title"`
+	Album       string  `json:"album"`
+	Genre       string  `json:"genre"`
+	Year        int     `json:"year"`
+	TrackIndex  int     `json:"trackIndex"`
+	TrackOf     int     `json:"trackOf"`
+	DiscIndex   int     `json:"discIndex"`
+	DiscOf      int     `json:"discOf"`
+	Length      float64 `json:"length"`
+	// fourcc of the audio sample description, ie mp4a or alac
+	AudioCodec string `json:"audioCodec,omitempty"`
+	// only set when the file has a video track
+	Video *VideoMetadata `json:"video,omitempty"`
+	// subtitle files next to the video
+	Subtitles []SubtitleMetadata `json:"subtitles,omitempty"`
+	// audiobooks and videos
+	Series   string          `json:"series,omitempty"`
+	Volume   float64         `json:"volume,omitempty"`
+	Chapters []types.Chapter `json:"chapters,omitempty"`
+}
+
+type TrackMetadata struct {
+	Number int `json:"number"`
+	// ISO 639-2 or BCP 47 language of the track
+	Language string `json:"language"`
+	Codec    string `json:"codec"`
+	Name     string `json:"name,omitempty"`
+	Default  bool   `json:"default"`
+}
+
+type MatroskaMetadata struct {
+	Title  string  `json:"title"`
+	Length float64 `json:"length"`
+	// only set when the file has a video track
+	Video          *VideoMetadata  `json:"video,omitempty"`
+	AudioTracks    []TrackMetadata `json:"audioTracks"`
+	SubtitleTracks []TrackMetadata `json:"subtitleTracks"`
+	// subtitle files next to the video, the embedded ones are listed in SubtitleTracks
+	Subtitles []SubtitleMetadata `json:"subtitles,omitempty"`
+}
+
+// Fields shared by the metadata of the different audio media types
+type trackInfo struct {
+	Artist      string
+	AlbumArtist string
+	Title       string
+	Album       string
+	Genre       string
+	Year        int
+	TrackIndex  int
+	TrackOf     int
+	DiscIndex   int
+	DiscOf      int
+	Length      float64
+	// position of an audiobook in its series
+	Series string
+	Volume float64
+}
+
+type trackMetadata interface {
+	trackInfo() trackInfo
+}
+
+// Returns the common track information of an item if its metadata has any
+func getTrackInfo(item types.MediaItem) (trackInfo, bool) {
+	if metadata, ok := item.Metadata.(trackMetadata); ok {
+		return metadata.trackInfo(), true
+	}
+
+	return trackInfo{}, false
+}
+
+func (m Mp3Metadata) trackInfo() trackInfo {
+	return trackInfo{
+		Artist:      m.Artist,
+		AlbumArtist: m.AlbumArtist,
+		Title:       m.Title,
+		Album:       m.Album,
+		Genre:       m.Genre,
+		Year:        m.Year,
+		TrackIndex:  m.TrackIndex,
+		TrackOf:     m.TrackOf,
+		DiscIndex:   m.DiscIndex,
+		DiscOf:      m.DiscOf,
+		Length:      m.Length,
+		Series:      m.Series,
+		Volume:      m.Volume,
+	}
+}
+
+func (m FlacMetadata) trackInfo() trackInfo {
+	return trackInfo{
+		Artist:      m.Artist,
+		AlbumArtist: m.AlbumArtist,
+		Title:       m.Title,
+		Album:       m.Album,
+		Genre:       m.Genre,
+		Year:        m.Year,
+		TrackIndex:  m.TrackIndex,
+		TrackOf:     m.TrackOf,
+		DiscIndex:   m.DiscIndex,
+		DiscOf:      m.DiscOf,
+		Length:      m.Length,
+	}
+}
+
+func (m PcmMetadata) trackInfo() trackInfo {
+	return trackInfo{
+		Artist:      m.Artist,
+		AlbumArtist: m.AlbumArtist,
+		Title:       m.Title,
+		Album:       m.Album,
+		Genre:       m.Genre,
+		Year:        m.Year,
+		TrackIndex:  m.TrackIndex,
+		TrackOf:     m.TrackOf,
+		DiscIndex:   m.DiscIndex,
+		DiscOf:      m.DiscOf,
+		Length:      m.Length,
+	}
+}
+
+func (m OggMetadata) trackInfo() trackInfo {
+	return trackInfo{
+		Artist:      m.Artist,
+		AlbumArtist: m.AlbumArtist,
+		Title:       m.Title,
+		Album:       m.Album,
+		Genre:       m.Genre,
+		Year:        m.Year,
+		TrackIndex:  m.TrackIndex,
+		TrackOf:     m.TrackOf,
+		DiscIndex:   m.DiscIndex,
+		DiscOf:      m.DiscOf,
+		Length:      m.Length,
+	}
+}
+
+func (m Mp4Metadata) trackInfo() trackInfo {
+	return trackInfo{
+		Artist:      m.Artist,
+		AlbumArtist: m.AlbumArtist,
+		Title:       m.Title,
+		Album:       m.Album,
+		Genre:       m.Genre,
+		Year:        m.Year,
+		TrackIndex:  m.TrackIndex,
+		TrackOf:     m.TrackOf,
+		DiscIndex:   m.DiscIndex,
+		DiscOf:      m.DiscOf,
+		Length:      m.Length,
+		Series:      m.Series,
+		Volume:      m.Volume,
+	}
+}
+
+func (m MatroskaMetadata) trackInfo() trackInfo {
+	return trackInfo{
+		Title:  m.Title,
+		Length: m.Length,
+	}
 }
 
 func mp3MetadataFromTag(m tag.Metadata) Mp3Metadata {
 	trackIndex, trackOf := m.Track()
+	discIndex, discOf := m.Disc()
 	return Mp3Metadata{
-		Artist:     m.Artist(),
-		Title:      m.Title(),
-		Album:      m.Album(),
-		Genre:      m.Genre(),
-		TrackIndex: trackIndex,
-		TrackOf:    trackOf,
+		Artist:      m.Artist(),
+		AlbumArtist: m.AlbumArtist(),
+		Title:       m.Title(),
+		Album:       m.Album(),
+		Genre:       m.Genre(),
+		Year:        m.Year(),
+		TrackIndex:  trackIndex,
+		TrackOf:     trackOf,
+		DiscIndex:   discIndex,
+		DiscOf:      discOf,
+	}
+
+}
+
+func flacMetadataFromTag(m tag.Metadata) FlacMetadata {
+	trackIndex, trackOf := m.Track()
+	discIndex, discOf := m.Disc()
+	return FlacMetadata{
+		Artist:      m.Artist(),
+		AlbumArtist: m.AlbumArtist(),
+		Title:       m.Title(),
+		Album:       m.Album(),
+		Genre:       m.Genre(),
+		Year:        m.Year(),
+		TrackIndex:  trackIndex,
+		TrackOf:     trackOf,
+		DiscIndex:   discIndex,
+		DiscOf:      discOf,
+	}
+}
+
+func oggMetadataFromComments(c *vorbisComments) OggMetadata {
+	trackIndex, trackOf := c.position("TRACKNUMBER", "TRACKTOTAL", "TOTALTRACKS")
+	discIndex, discOf := c.position("DISCNUMBER", "DISCTOTAL", "TOTALDISCS")
+	return OggMetadata{
+		Artist:      c.get("ARTIST"),
+		AlbumArtist: c.get("ALBUMARTIST", "ALBUM ARTIST"),
+		Title:       c.get("TITLE"),
+		Album:       c.get("ALBUM"),
+		Genre:       c.get("GENRE"),
+		Year:        c.year(),
+		TrackIndex:  trackIndex,
+		TrackOf:     trackOf,
+		DiscIndex:   discIndex,
+		DiscOf:      discOf,
+	}
+}
+
+func mp4MetadataFromInfo(i mp4Info) Mp4Metadata {
+	trackIndex, trackOf := i.position("trkn")
+	discIndex, discOf := i.position("disk")
+	metadata := Mp4Metadata{
+		Artist:      i.text("\xa9ART"),
+		AlbumArtist: i.text("aART"),
+		Title:       i.text("\xa9nam"),
+		Album:       i.text("\xa9alb"),
+		Genre:       i.text("\xa9gen"),
+		Year:        i.year(),
+		TrackIndex:  trackIndex,
+		TrackOf:     trackOf,
+		DiscIndex:   discIndex,
+		DiscOf:      discOf,
+		Length:      i.Length,
+		AudioCodec:  i.AudioCodec,
+		Series:      i.series(),
+		Volume:      i.volume(),
+		Chapters:    i.Chapters,
 	}
 
+	if i.Video != nil {
+		metadata.Video = &VideoMetadata{Width: i.Video.Width, Height: i.Video.Height, Codec: i.Video.Codec}
+	}
+
+	return metadata
+}
+
+func matroskaMetadataFromInfo(i mkvInfo) MatroskaMetadata {
+	metadata := MatroskaMetadata{
+		Title:          i.Title,
+		Length:         i.Length,
+		AudioTracks:    make([]TrackMetadata, 0),
+		SubtitleTracks: make([]TrackMetadata, 0),
+	}
+
+	for _, track := range i.Tracks {
+		trackMetadata := TrackMetadata{
+			Number:   track.Number,
+			Language: track.Language,
+			Codec:    track.Codec,
+			Name:     track.Name,
+			Default:  track.Default,
+		}
+
+		switch track.Type {
+		case mkvTrackTypeVideo:
+			if metadata.Video == nil {
+				metadata.Video = &VideoMetadata{Width: track.Width, Height: track.Height, Codec: track.Codec}
+			}
+		case mkvTrackTypeAudio:
+			metadata.AudioTracks = append(metadata.AudioTracks, trackMetadata)
+		case mkvTrackTypeSubtitle:
+			metadata.SubtitleTracks = append(metadata.SubtitleTracks, trackMetadata)
+		}
+	}
+
+	return metadata
+}
+
+// The id3 chunk is preferred over LIST/INFO and AIFF text chunks since it is richer
+func pcmMetadataFromInfo(i pcmInfo) PcmMetadata {
+	metadata := PcmMetadata{
+		Length:     i.Length,
+		SampleRate: i.SampleRate,
+		BitDepth:   i.BitDepth,
+		Channels:   i.Channels,
+	}
+
+	if i.Id3 != nil {
+		trackIndex, trackOf := i.Id3.Track()
+		discIndex, discOf := i.Id3.Disc()
+
+		metadata.Artist = i.Id3.Artist()
+		metadata.AlbumArtist = i.Id3.AlbumArtist()
+		metadata.Title = i.Id3.Title()
+		metadata.Album = i.Id3.Album()
+		metadata.Genre = i.Id3.Genre()
+		metadata.Year = i.Id3.Year()
+		metadata.TrackIndex, metadata.TrackOf = trackIndex, trackOf
+		metadata.DiscIndex, metadata.DiscOf = discIndex, discOf
+
+		return metadata
+	}
+
+	metadata.Artist = i.Text["artist"]
+	metadata.Title = i.Text["title"]
+	metadata.Album = i.Text["album"]
+	metadata.Genre = i.Text["genre"]
+	metadata.Year = i.year()
+	metadata.TrackIndex, metadata.TrackOf = i.track()
+
+	return metadata
 }
@@ -0,0 +1,242 @@
+package media
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/egfanboy/mediapire-common/exceptions"
+	"github.com/egfanboy/mediapire-media-host/internal/utils"
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
+)
+
+const (
+	SortName   = "name"
+	SortArtist = "artist"
+	SortAlbum  = "album"
+	SortAdded  = "added"
+	SortLength = "length"
+
+	OrderAsc  = "asc"
+	OrderDesc = "desc"
+)
+
+// Metadata fields that can be used to filter media, values must match exactly (case insensitive)
+var filterFields = map[string]func(info trackInfo) string{
+	"artist":      func(info trackInfo) string { return info.Artist },
+	"albumArtist": func(info trackInfo) string { return info.AlbumArtist },
+	"album":       func(info trackInfo) string { return info.Album },
+	"genre":       func(info trackInfo) string { return info.Genre },
+	"title":       func(info trackInfo) string { return info.Title },
+	"year":        func(info trackInfo) string { return strconv.Itoa(info.Year) },
+}
+
+type MediaQuery struct {
+	MediaTypes []string
+	// metadata field to expected value
+	Filters map[string]string
+	// one of the Sort constants, when empty the grouping functions decide the order
+	Sort  string
+	Order string
+	// Pagination, Cursor takes precedence over Offset
+	Offset int
+	Limit  int
+	Cursor string
+}
+
+func (q MediaQuery) IsPaginated() bool {
+	return q.Limit > 0 || q.Cursor != ""
+}
+
+func (q MediaQuery) validate() error {
+	switch q.Sort {
+	case "", SortName, SortArtist, SortAlbum, SortAdded, SortLength:
+	default:
+		return &exceptions.ApiException{StatusCode: http.StatusBadRequest, Err: fmt.Errorf("unsupported sort key %q", q.Sort)}
+	}
+
+	switch q.Order {
+	case "", OrderAsc, OrderDesc:
+	default:
+		return &exceptions.ApiException{StatusCode: http.StatusBadRequest, Err: fmt.Errorf("unsupported sort order %q", q.Order)}
+	}
+
+	for field := range q.Filters {
+		if _, ok := filterFields[field]; !ok {
+			return &exceptions.ApiException{StatusCode: http.StatusBadRequest, Err: fmt.Errorf("unsupported filter %q", field)}
+		}
+	}
+
+	if q.Offset < 0 || q.Limit < 0 {
+		return &exceptions.ApiException{StatusCode: http.StatusBadRequest, Err: fmt.Errorf("offset and limit must be positive")}
+	}
+
+	return nil
+}
+
+func (q MediaQuery) matches(item types.MediaItem) bool {
+	if len(q.MediaTypes) > 0 && !utils.Contains(q.MediaTypes, item.Extension) {
+		return false
+	}
+
+	if len(q.Filters) == 0 {
+		return true
+	}
+
+	info, ok := getTrackInfo(item)
+	if !ok {
+		return false
+	}
+
+	for field, expected := range q.Filters {
+		if !strings.EqualFold(filterFields[field](info), expected) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Order of the items before they are grouped, the groupers keep it for items they do not reorder
+func sortByPath(items []types.MediaItem) {
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Path < items[j].Path
+	})
+}
+
+func sortMedia(items []types.MediaItem, sortKey string, descending bool) {
+	// compute the sort values once instead of on every comparison
+	textKeys := make([]string, len(items))
+	numberKeys := make([]int64, len(items))
+
+	var addedIndex *mediaIndex
+	if sortKey == SortAdded {
+		addedIndex = getMediaIndex()
+	}
+
+	for i, item := range items {
+		info, _ := getTrackInfo(item)
+
+		switch sortKey {
+		case SortArtist:
+			textKeys[i] = strings.ToLower(info.Artist)
+		case SortAlbum:
+			textKeys[i] = strings.ToLower(info.Album)
+		case SortLength:
+			numberKeys[i] = int64(info.Length * 1000)
+		case SortAdded:
+			numberKeys[i] = addedIndex.AddedAt(item.Path).UnixNano()
+		default:
+			textKeys[i] = strings.ToLower(item.Name)
+		}
+	}
+
+	less := func(i, j int) bool {
+		switch {
+		case (sortKey == SortLength || sortKey == SortAdded) && numberKeys[i] != numberKeys[j]:
+			return numberKeys[i] < numberKeys[j]
+		case textKeys[i] != textKeys[j]:
+			return textKeys[i] < textKeys[j]
+		}
+
+		// items come from a map, equal keys are ordered by id so pages do not repeat or skip items
+		return items[i].Id < items[j].Id
+	}
+
+	order := make([]int, len(items))
+	for i := range order {
+		order[i] = i
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		if descending {
+			return less(order[j], order[i])
+		}
+
+		return less(order[i], order[j])
+	})
+
+	sorted := make([]types.MediaItem, len(items))
+	for i, idx := range order {
+		sorted[i] = items[idx]
+	}
+
+	copy(items, sorted)
+}
+
+// Opaque position in a listing, the id keeps the position stable when items are added or removed before it
+type mediaCursor struct {
+	Id     string `json:"id"`
+	Offset int    `json:"offset"`
+}
+
+func encodeCursor(c mediaCursor) string {
+	content, _ := json.Marshal(c)
+
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+func decodeCursor(cursor string) (c mediaCursor, err error) {
+	content, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		err = json.Unmarshal(content, &c)
+	}
+
+	if err != nil || c.Offset < 0 {
+		err = &exceptions.ApiException{StatusCode: http.StatusBadRequest, Err: fmt.Errorf("invalid cursor")}
+	}
+
+	return
+}
+
+// Returns the page of items requested by the query, items must already be filtered and sorted
+func paginate(items []types.MediaItem, q MediaQuery) (page types.MediaPage, err error) {
+	page.Items, page.Offset, page.NextCursor, err = paginateValues(items, q, func(item types.MediaItem) string { return item.Id })
+	page.Total = len(items)
+	page.Limit = q.Limit
+
+	return
+}
+
+// Returns the values of the page requested by the query, its offset and the cursor of the next page
+func paginateValues[T any](values []T, q MediaQuery, getId func(T) string) (page []T, offset int, nextCursor string, err error) {
+	offset = q.Offset
+
+	if q.Cursor != "" {
+		cursor, errC := decodeCursor(q.Cursor)
+		if errC != nil {
+			err = errC
+			return
+		}
+
+		offset = cursor.Offset
+		// start right after the last value of the previous page if it is still there
+		for i, value := range values {
+			if getId(value) == cursor.Id {
+				offset = i + 1
+				break
+			}
+		}
+	}
+
+	if offset > len(values) {
+		offset = len(values)
+	}
+
+	end := len(values)
+	if q.Limit > 0 && offset+q.Limit < end {
+		end = offset + q.Limit
+	}
+
+	page = values[offset:end]
+
+	if end < len(values) && end > offset {
+		nextCursor = encodeCursor(mediaCursor{Id: getId(values[end-1]), Offset: end})
+	}
+
+	return
+}
@@ -0,0 +1,59 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/egfanboy/mediapire-common/exceptions"
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
+)
+
+func TestPaginateRejectsNegativeCursorOffset(t *testing.T) {
+	items := []types.MediaItem{{Id: "a"}, {Id: "b"}}
+
+	_, err := paginate(items, MediaQuery{Limit: 1, Cursor: encodeCursor(mediaCursor{Id: "missing", Offset: -5})})
+
+	var apiErr *exceptions.ApiException
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a bad request, got %v", err)
+	}
+}
+
+func TestPaginateFollowsCursor(t *testing.T) {
+	items := []types.MediaItem{{Id: "a"}, {Id: "b"}, {Id: "c"}}
+
+	first, err := paginate(items, MediaQuery{Limit: 2})
+	if err != nil || len(first.Items) != 2 || first.NextCursor == "" {
+		t.Fatalf("unexpected first page %+v: %v", first, err)
+	}
+
+	// an item added before the cursor does not repeat the last item of the previous page
+	items = append([]types.MediaItem{{Id: "new"}}, items...)
+
+	second, err := paginate(items, MediaQuery{Limit: 2, Cursor: first.NextCursor})
+	if err != nil || len(second.Items) != 1 || second.Items[0].Id != "c" {
+		t.Fatalf("unexpected second page %+v: %v", second, err)
+	}
+}
+
+func TestSortMediaOrdersEqualKeysById(t *testing.T) {
+	items := make([]types.MediaItem, 0)
+	for i := 9; i >= 0; i-- {
+		items = append(items, types.MediaItem{Id: fmt.Sprintf("id-%d", i), Name: "Same name", Metadata: Mp3Metadata{Artist: "Artist"}})
+	}
+
+	for _, sortKey := range []string{SortName, SortArtist, SortAlbum, SortLength} {
+		for _, descending := range []bool{false, true} {
+			sorted := append([]types.MediaItem{}, items...)
+			sortMedia(sorted, sortKey, descending)
+
+			for i := 1; i < len(sorted); i++ {
+				if (sorted[i-1].Id < sorted[i].Id) == descending {
+					t.Fatalf("%s: items with equal keys are not ordered by id: %s before %s", sortKey, sorted[i-1].Id, sorted[i].Id)
+				}
+			}
+		}
+	}
+}
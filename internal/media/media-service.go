@@ -1,15 +1,13 @@
 package media
 
 import (
-	"archive/zip"
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-
 	"io/fs"
+
 	"net/http"
 	"os"
 	"path"
@@ -27,8 +25,11 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-type mediaService struct {
-	app *app.App
+type mediaService struct{}
+
+// The config is read on first use, the service is created when the package is initialised
+func (s *mediaService) app() *app.App {
+	return app.GetApp()
 }
 
 var mediaCache = utils.NewConcurrentMap[string, []types.MediaItem]()
@@ -43,46 +44,355 @@ func unwrapCache() (unwrappedItems []types.MediaItem) {
 	return
 }
 
-func (s *mediaService) GetMedia(ctx context.Context, mediaTypes []string) (items []types.MediaItem, err error) {
-	items = make([]types.MediaItem, 0)
+func (s *mediaService) GetMedia(ctx context.Context, query MediaQuery) (page types.MediaPage, err error) {
+	page.Items = make([]types.MediaItem, 0)
+
+	err = query.validate()
+	if err != nil {
+		return
+	}
 
 	if mediaCache.Len() == 0 {
 		err = errors.New("no media found")
 		return
 	}
 
-	unwrappedCache := unwrapCache()
+	items := utils.Filter(unwrapCache(), query.matches)
 
-	if len(mediaTypes) == 0 {
-		groupingFuncs := getGroupingFactories(s.app.FileTypes...)
+	if query.Sort != "" {
+		sortMedia(items, query.Sort, query.Order == OrderDesc)
+	} else {
+		mediaTypes := query.MediaTypes
+		if len(mediaTypes) == 0 {
+			mediaTypes = s.app().FileTypes
+		}
 
-		items = unwrappedCache
+		sortByPath(items)
 
-		for _, fn := range groupingFuncs {
+		for _, fn := range getGroupingFactories(mediaTypes...) {
 			items = fn(items)
 		}
 
+		if query.Order == OrderDesc {
+			for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+				items[i], items[j] = items[j], items[i]
+			}
+		}
+	}
+
+	return paginate(items, query)
+}
+
+func (s *mediaService) SearchMedia(ctx context.Context, search string, query MediaQuery) (page types.MediaPage, err error) {
+	page.Items = make([]types.MediaItem, 0)
+
+	if strings.TrimSpace(search) == "" {
+		err = &exceptions.ApiException{StatusCode: http.StatusBadRequest, Err: errors.New("search query cannot be empty")}
 		return
+	}
 
+	err = query.validate()
+	if err != nil {
+		return
 	}
 
-	for _, item := range unwrappedCache {
-		mediaTypesToCheck := strings.Join(mediaTypes, ",")
-		if strings.Contains(mediaTypesToCheck, item.Extension) {
-			items = append(items, item)
+	items := make([]types.MediaItem, 0)
+
+	// results are already ranked, only apply the filters of the query
+	for _, result := range mediaSearchIndex.Search(search) {
+		if query.matches(result.item) {
+			items = append(items, result.item)
 		}
+	}
+
+	return paginate(items, query)
+}
 
+func (s *mediaService) GetArtists(ctx context.Context, query MediaQuery) (page types.ArtistPage, err error) {
+	err = query.validate()
+	if err != nil {
+		return
 	}
 
-	groupingFuncs := getGroupingFactories(mediaTypes...)
+	artists := mediaBrowseIndex.Artists()
 
-	for _, fn := range groupingFuncs {
-		items = fn(items)
+	page.Items, page.Offset, page.NextCursor, err = paginateValues(artists, query, func(a types.Artist) string { return a.Id })
+	page.Total = len(artists)
+	page.Limit = query.Limit
+
+	return
+}
+
+func (s *mediaService) GetAlbums(ctx context.Context, query MediaQuery) (page types.AlbumPage, err error) {
+	err = query.validate()
+	if err != nil {
+		return
 	}
 
+	albums := mediaBrowseIndex.Albums()
+
+	page.Items, page.Offset, page.NextCursor, err = paginateValues(albums, query, func(a types.Album) string { return a.Id })
+	page.Total = len(albums)
+	page.Limit = query.Limit
+
 	return
 }
 
+func (s *mediaService) GetGenres(ctx context.Context, query MediaQuery) (page types.GenrePage, err error) {
+	err = query.validate()
+	if err != nil {
+		return
+	}
+
+	genres := mediaBrowseIndex.Genres()
+
+	page.Items, page.Offset, page.NextCursor, err = paginateValues(genres, query, func(g types.Genre) string { return g.Id })
+	page.Total = len(genres)
+	page.Limit = query.Limit
+
+	return
+}
+
+func (s *mediaService) GetAlbumTracks(ctx context.Context, albumId string, query MediaQuery) (page types.MediaPage, err error) {
+	err = query.validate()
+	if err != nil {
+		return
+	}
+
+	items, ok := mediaBrowseIndex.AlbumTracks(albumId)
+	if !ok {
+		err = &exceptions.ApiException{Err: fmt.Errorf("no album with id %s", albumId), StatusCode: http.StatusNotFound}
+		return
+	}
+
+	return paginate(items, query)
+}
+
+func (s *mediaService) GetFolders(ctx context.Context) ([]types.Folder, error) {
+	roots := buildFolderTrees(s.app().GetDirectories(), mediaCache.Get())
+
+	folders := make([]types.Folder, len(roots))
+	for i, root := range roots {
+		folders[i] = root.toFolder()
+	}
+
+	return folders, nil
+}
+
+func (s *mediaService) GetFolder(ctx context.Context, id string) (types.Folder, error) {
+	node, ok := findFolder(buildFolderTrees(s.app().GetDirectories(), mediaCache.Get()), id)
+	if !ok {
+		return types.Folder{}, &exceptions.ApiException{Err: fmt.Errorf("no folder with id %s", id), StatusCode: http.StatusNotFound}
+	}
+
+	return node.toFolder(), nil
+}
+
+func (s *mediaService) DownloadFolder(ctx context.Context, id string, w io.Writer) error {
+	node, ok := findFolder(buildFolderTrees(s.app().GetDirectories(), mediaCache.Get()), id)
+	if !ok {
+		return &exceptions.ApiException{Err: fmt.Errorf("no folder with id %s", id), StatusCode: http.StatusNotFound}
+	}
+
+	log.Info().Msgf("Start: downloading folder %q", id)
+
+	err := writeArchive(w, node.archiveEntries())
+
+	log.Info().Msgf("Finished: downloading folder %q", id)
+
+	return err
+}
+
+func (s *mediaService) RegisterMove(oldPath string, newPath string) {
+	mediaIdentity.RegisterMove(oldPath, newPath)
+}
+
+// Plan of an organise run, the template and the items default to the template of the host and all of its media
+func (s *mediaService) getOrganisePlan(ctx context.Context, request types.OrganiseRequest) ([]organiseStep, types.OrganisePlan, error) {
+	template := request.Template
+	if template == "" {
+		template = s.app().Organise.Template
+	}
+
+	err := validateOrganiseTemplate(template)
+	if err != nil {
+		return nil, types.OrganisePlan{}, err
+	}
+
+	items := unwrapCache()
+
+	if len(request.MediaIds) > 0 {
+		items = make([]types.MediaItem, 0, len(request.MediaIds))
+		seen := make(map[string]bool)
+
+		for _, id := range request.MediaIds {
+			if seen[id] {
+				continue
+			}
+
+			seen[id] = true
+
+			item, err := s.GetMediaItemById(ctx, id)
+			if err != nil {
+				return nil, types.OrganisePlan{}, err
+			}
+
+			items = append(items, item)
+		}
+	}
+
+	steps, plan := planOrganise(items, template, s.app().GetDirectories())
+
+	return steps, plan, nil
+}
+
+func (s *mediaService) PreviewOrganise(ctx context.Context, request types.OrganiseRequest) (types.OrganisePlan, error) {
+	_, plan, err := s.getOrganisePlan(ctx, request)
+
+	return plan, err
+}
+
+/*
+** Moves the items to the path the template gives them. Items keep their id, moves that fail are reported as
+** conflicts and do not stop the others.
+ */
+func (s *mediaService) OrganiseMedia(ctx context.Context, request types.OrganiseRequest) (types.OrganisePlan, error) {
+	organiseMu.Lock()
+	defer organiseMu.Unlock()
+
+	steps, plan, err := s.getOrganisePlan(ctx, request)
+	if err != nil {
+		return types.OrganisePlan{}, err
+	}
+
+	log.Info().Msgf("Start: organising %d items", len(steps))
+
+	result := types.OrganisePlan{Moves: make([]types.OrganiseMove, 0, len(steps)), Conflicts: plan.Conflicts, Unchanged: plan.Unchanged}
+	moved := make([]types.MovedMediaItem, 0, len(steps))
+	mapping := utils.NewConcurrentMap[string, string]()
+
+	for i, step := range steps {
+		item, err := s.moveItem(step)
+		if err != nil {
+			log.Err(err).Msgf("Failed to move item with id %q", step.item.Id)
+
+			result.Conflicts = append(result.Conflicts, types.OrganiseConflict{
+				MediaId: step.item.Id,
+				From:    plan.Moves[i].From,
+				To:      plan.Moves[i].To,
+				Reason:  getOrganiseErrorReason(err),
+			})
+
+			continue
+		}
+
+		result.Moves = append(result.Moves, plan.Moves[i])
+		mapping.Add(item.Path, item.Id)
+
+		moved = append(moved, types.MovedMediaItem{
+			MediaId:          item.Id,
+			Name:             item.Name,
+			FolderId:         getFolderId(item.ParentDir),
+			PreviousName:     step.item.Name,
+			PreviousFolderId: getFolderId(step.item.ParentDir),
+		})
+	}
+
+	if len(moved) > 0 {
+		// saved before returning so scans of the new folders find the ids
+		mappingUpdate := mediaIdentity.StartMappingUpdate()
+		err = s.saveIdToPathMapping(mapping)
+		mediaIdentity.FinishMappingUpdate(mappingUpdate)
+
+		if err != nil {
+			log.Err(err).Msg("Failed to save the paths of organised items")
+		}
+
+		getMediaIndex().ScheduleSave()
+		go sendMediaMovedMessage(context.Background(), moved)
+	}
+
+	log.Info().Msgf("Finished: organising, %d items moved and %d conflicts", len(result.Moves), len(result.Conflicts))
+
+	return result, nil
+}
+
+// Moves the file of the item and its sidecars to the target, the item keeps its id and indexed metadata
+func (s *mediaService) moveItem(step organiseStep) (types.MediaItem, error) {
+	item := step.item
+
+	ignoredFiles := []string{item.Path, step.target}
+	for _, sidecar := range step.sidecars {
+		ignoredFiles = append(ignoredFiles, sidecar, getMovedSidecarPath(sidecar, item, step.target))
+	}
+
+	// new folders are not ignored, the watcher has to start watching them
+	ignoreList := ignorelist.GetIgnoreList()
+	for _, f := range ignoredFiles {
+		ignoreList.AddFile(f)
+		defer ignoreList.RemoveFile(f)
+	}
+
+	err := os.MkdirAll(filepath.Dir(step.target), os.ModePerm)
+	if err != nil {
+		return types.MediaItem{}, &organiseError{reason: "could not create folder", err: err}
+	}
+
+	err = moveFile(item.Path, step.target)
+	if errors.Is(err, fs.ErrExist) {
+		return types.MediaItem{}, &organiseError{reason: "another file already has this path", err: err}
+	}
+
+	if err != nil {
+		return types.MediaItem{}, &organiseError{reason: "could not move file", err: err}
+	}
+
+	for _, sidecar := range step.sidecars {
+		err = moveFile(sidecar, getMovedSidecarPath(sidecar, item, step.target))
+		if err != nil {
+			log.Err(err).Msgf("Failed to move %s with item %q", filepath.Base(sidecar), item.Id)
+		}
+	}
+
+	info, err := os.Stat(step.target)
+	if err != nil {
+		return types.MediaItem{}, &organiseError{reason: "could not read moved file", err: err}
+	}
+
+	newItem := item
+	newItem.Path = step.target
+	newItem.ParentDir = filepath.Dir(step.target)
+	newItem.Name = strings.Replace(filepath.Base(step.target), "."+item.Extension, "", 1)
+	newItem = withSidecarSubtitles(newItem)
+
+	getMediaIndex().Move(item.Path, newItem, info)
+	mediaIdentity.MarkStale(item.Path, item.Id)
+
+	if dirItems, ok := mediaCache.GetKey(item.ParentDir); ok {
+		remaining := utils.Filter(dirItems, func(cached types.MediaItem) bool {
+			return cached.Id != item.Id
+		})
+
+		// the folder is removed below when nothing else is in it, it should not be listed anymore
+		if len(remaining) == 0 {
+			mediaCache.Delete(item.ParentDir)
+		} else {
+			mediaCache.Add(item.ParentDir, remaining)
+		}
+	}
+
+	dirItems, _ := mediaCache.GetKey(newItem.ParentDir)
+	mediaCache.Add(newItem.ParentDir, append(dirItems, newItem))
+
+	mediaLookup.Add(newItem.Id, newItem)
+	mediaSearchIndex.Add(newItem)
+	mediaBrowseIndex.Add(newItem)
+
+	removeEmptyDirectories(item.ParentDir, step.root)
+
+	return newItem, nil
+}
+
 func (s *mediaService) ScanDirectories(directories ...string) (err error) {
 	failed := make([]string, 0)
 
@@ -97,12 +407,20 @@ func (s *mediaService) ScanDirectories(directories ...string) (err error) {
 
 	if len(failed) > 0 {
 		err = fmt.Errorf("failed to scan the following directories: %s", strings.Join(failed, ", "))
+		// do not remove art of media that could not be scanned
+		return
 	}
 
+	go s.collectUnusedArt()
+
 	return
 }
 
-func (s *mediaService) scanDirectory(directory string, wg *sync.WaitGroup, wp utils.WorkerPool, cache *utils.ConcurrentMap[string, string], items chan<- types.MediaItem) error {
+/*
+** Walks the directory and processes its files. missingFiles tells whether some indexed file was not at its path
+** when the scan started, files are only fingerprinted to find where they moved from when it is set.
+ */
+func (s *mediaService) scanDirectory(directory string, missingFiles bool, wg *sync.WaitGroup, wp utils.WorkerPool, cache *utils.ConcurrentMap[string, string], items chan<- types.MediaItem) error {
 	defer wg.Done()
 
 	visit := func(path string, info os.FileInfo, err error) error {
@@ -113,14 +431,14 @@ func (s *mediaService) scanDirectory(directory string, wg *sync.WaitGroup, wp ut
 		// ignore itself to avoid infinite loop
 		if info.Mode().IsDir() && path != directory {
 			wg.Add(1)
-			go s.scanDirectory(path, wg, wp, cache, items)
+			go s.scanDirectory(path, missingFiles, wg, wp, cache, items)
 			// this will skip this directory since we spawn a goroutine to handle it
 			return filepath.SkipDir
 		}
 
 		if info.Mode().IsRegular() && info.Size() > 0 {
 			wg.Add(1)
-			go s.processFile(path, wg, wp, cache, items)
+			go s.processFile(path, missingFiles, wg, wp, cache, items)
 		}
 
 		return nil
@@ -133,7 +451,7 @@ func (s *mediaService) scanDirectory(directory string, wg *sync.WaitGroup, wp ut
 	return filepath.Walk(directory, visit)
 }
 
-func (s *mediaService) processFile(path string, wg *sync.WaitGroup, wp utils.WorkerPool, cache *utils.ConcurrentMap[string, string], items chan<- types.MediaItem) {
+func (s *mediaService) processFile(path string, missingFiles bool, wg *sync.WaitGroup, wp utils.WorkerPool, cache *utils.ConcurrentMap[string, string], items chan<- types.MediaItem) {
 	defer wg.Done()
 
 	ext := filepath.Ext(path)
@@ -143,44 +461,133 @@ func (s *mediaService) processFile(path string, wg *sync.WaitGroup, wp utils.Wor
 		ext = strings.ReplaceAll(ext, ".", "")
 	}
 
-	if !s.app.IsMediaSupported(ext) {
+	if !s.app().IsMediaSupported(ext) {
 		return
 	}
 
 	wp.Work()
 	defer wp.Done()
 
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Err(err).Msgf("failed to stat file %s", filepath.Base(path))
+		return
+	}
+
+	mediaIndex := getMediaIndex()
+
+	// file did not change since it was last indexed, no need to parse it again
+	if item, ok := mediaIndex.Lookup(path, info); ok {
+		if missingFiles {
+			mediaIndex.BackfillFingerprint(path, info)
+		}
+
+		// sidecars can change without the video changing, they are looked up on every scan
+		items <- withSidecarSubtitles(item)
+		return
+	}
+
+	// a path without an id can be an item that was renamed or moved, it keeps its id
+	if _, ok := cache.GetKey(path); !ok {
+		if id, ok := mediaIdentity.Resolve(path, info, cache, missingFiles); ok {
+			cache.Add(path, id)
+		}
+	}
+
 	factory := getFactory(ext)
 
 	item, err := factory(path, ext, cache)
 	if err != nil {
+		mediaIdentity.TakeResolved(path)
 		log.Err(err).Msgf("failed to create media item for file %s", filepath.Base(path))
 		return
 	}
 
-	items <- item
+	mediaIndex.Add(item, info)
+	// file is new or changed, its art has to be extracted again
+	getArtStore().Remove(item.Id)
+
+	items <- withSidecarSubtitles(item)
 }
 
 func (s *mediaService) processItems(items <-chan types.MediaItem, result chan<- map[string][]types.MediaItem, cache *utils.ConcurrentMap[string, string]) {
 	mediaItems := map[string][]types.MediaItem{}
 
 	for item := range items {
-		// TODO: Make this dynamic for extension type
-		if item.Extension == "mp3" {
-			mp3ItemChan <- item
+		if isArtSupported(item.Extension) {
+			artItemChan <- item
 		}
 
 		mediaItems[item.ParentDir] = append(mediaItems[item.ParentDir], item)
 
 		cache.Add(item.Path, item.Id)
+
+		mediaSearchIndex.Add(item)
+		mediaBrowseIndex.Add(item)
+
+		if move, ok := mediaIdentity.TakeResolved(item.Path); ok {
+			s.completeMove(move, item, cache)
+		}
 	}
 
 	result <- mediaItems
 }
 
+// Drops what is left of the previous path of a moved item, its id now belongs to the new path
+func (s *mediaService) completeMove(move mediaMove, item types.MediaItem, cache *utils.ConcurrentMap[string, string]) {
+	log.Info().Msgf("Item with id %q was renamed or moved", item.Id)
+
+	mediaIndex := getMediaIndex()
+	mediaIndex.Remove(move.oldPath)
+
+	if move.addedAt != 0 {
+		mediaIndex.SetAddedAt(item.Path, move.addedAt)
+	}
+
+	cache.Delete(move.oldPath)
+	mediaIdentity.MarkStale(move.oldPath, item.Id)
+
+	mediaLookup.Delete(item.Id)
+
+	if dirItems, ok := mediaCache.GetKey(move.previousDir); ok {
+		mediaCache.Add(move.previousDir, utils.Filter(dirItems, func(cached types.MediaItem) bool {
+			return cached.Path != move.oldPath
+		}))
+	}
+
+	mediaIdentity.AddCompleted(types.MovedMediaItem{
+		MediaId:          item.Id,
+		Name:             item.Name,
+		FolderId:         getFolderId(item.ParentDir),
+		PreviousName:     move.previousName,
+		PreviousFolderId: getFolderId(move.previousDir),
+	})
+}
+
+// Removes the items at or under the path whose file is no longer on disk
+func (s *mediaService) removeMissingItems(path string) {
+	for dir, items := range mediaCache.Get() {
+		if !isPathWithin(dir, path) && dir != filepath.Dir(path) {
+			continue
+		}
+
+		for _, item := range items {
+			if isPathWithin(item.Path, path) && !fileExists(item.Path) {
+				err := s.removeItemFromCache(item)
+				if err != nil {
+					log.Err(err).Msgf("failed to remove item %s from cache", item.Name)
+				}
+			}
+		}
+	}
+}
+
 func (s *mediaService) ScanDirectory(directory string) (err error) {
+	mappingUpdate := mediaIdentity.StartMappingUpdate()
+
 	cache, err := s.readMediaCache()
 	if err != nil {
+		mediaIdentity.FinishMappingUpdate(mappingUpdate)
 		return
 	}
 
@@ -194,10 +601,13 @@ func (s *mediaService) ScanDirectory(directory string) (err error) {
 
 	go s.processItems(items, result, cache)
 
+	// checked once for the whole scan rather than for every file
+	missingFiles := getMediaIndex().HasMissingFiles()
+
 	wg.Add(1)
 
 	// will walk through directories and spawn goroutines to handle subdirectories and files
-	s.scanDirectory(directory, wg, wp, cache, items)
+	s.scanDirectory(directory, missingFiles, wg, wp, cache, items)
 
 	wg.Wait()
 
@@ -205,44 +615,66 @@ func (s *mediaService) ScanDirectory(directory string) (err error) {
 	close(items)
 
 	results := <-result
+
+	seen := make(map[string]bool)
 	for k, v := range results {
 		mediaCache.Add(k, v)
-	}
 
-	go s.saveIdToPathMapping(cache)
+		for _, item := range v {
+			seen[item.Path] = true
+		}
+	}
 
-	return
-}
+	mediaIndex := getMediaIndex()
+	// files that are indexed but no longer on disk
+	mediaIndex.Prune(directory, seen)
 
-func (s *mediaService) StreamMedia(ctx context.Context, id string) ([]byte, error) {
-	filePath, err := s.getFilePathFromId(ctx, id)
-	if err != nil {
-		return nil, err
+	// renames whose target did not turn out to be a media item, ie a file renamed to an unsupported extension
+	for _, move := range mediaIdentity.TakeMoves(directory) {
+		s.removeMissingItems(move.oldPath)
 	}
 
-	file, err := os.Open(filePath)
-	if err != nil && errors.Is(err, os.ErrInvalid) || errors.Is(err, os.ErrNotExist) {
-		return nil, &exceptions.ApiException{Err: err, StatusCode: http.StatusNotFound}
+	if moved := mediaIdentity.TakeCompleted(); len(moved) > 0 {
+		go sendMediaMovedMessage(context.Background(), moved)
 	}
 
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return nil, err
-	}
+	go func() {
+		s.saveIdToPathMapping(cache)
+		mediaIdentity.FinishMappingUpdate(mappingUpdate)
+	}()
 
-	b := make([]byte, fileInfo.Size())
+	mediaIndex.ScheduleSave()
 
-	_, err = file.Read(b)
-	return b, err
+	return
 }
 
-func (s *mediaService) getFilePathFromId(ctx context.Context, id string) (string, error) {
+func (s *mediaService) StreamMedia(ctx context.Context, id string) (MediaStream, error) {
 	item, err := s.GetMediaItemById(ctx, id)
 	if err != nil {
-		return "", err
+		return MediaStream{}, err
+	}
+
+	file, err := os.Open(item.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrInvalid) || errors.Is(err, os.ErrNotExist) {
+			return MediaStream{}, &exceptions.ApiException{Err: err, StatusCode: http.StatusNotFound}
+		}
+
+		return MediaStream{}, err
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return MediaStream{}, err
 	}
 
-	return item.Path, nil
+	return MediaStream{
+		Item:    item,
+		Content: file,
+		Size:    fileInfo.Size(),
+		ModTime: fileInfo.ModTime(),
+	}, nil
 }
 
 func (s *mediaService) GetMediaItemById(ctx context.Context, id string) (types.MediaItem, error) {
@@ -261,71 +693,61 @@ func (s *mediaService) GetMediaItemById(ctx context.Context, id string) (types.M
 }
 
 func (s *mediaService) UnsetDirectory(directory string) error {
+	if items, ok := mediaCache.GetKey(directory); ok {
+		for _, item := range items {
+			mediaSearchIndex.Remove(item.Id)
+			mediaBrowseIndex.Remove(item.Id)
+			getArtStore().Remove(item.Id)
+		}
+	}
+
 	mediaCache.Delete(directory)
 
 	return nil
 }
 
-func (s *mediaService) DownloadMedia(ctx context.Context, ids []string) ([]byte, error) {
+func (s *mediaService) DownloadMedia(ctx context.Context, ids []string, w io.Writer) error {
 	log.Info().Msg("Start: downloading media")
-	buf := new(bytes.Buffer)
-
-	zipWriter := zip.NewWriter(buf)
 
 	items := make([]types.MediaItem, len(ids))
 
+	// resolve every item before writing anything so a bad id fails the request as a whole
 	for i, itemId := range ids {
 		item, err := s.GetMediaItemById(ctx, itemId)
 		if err != nil {
 			log.Err(err).Msgf("Failed to get item with id %q", itemId)
-			return nil, err
+			return err
 		}
 
 		items[i] = item
 	}
 
-	groupingFuncs := getGroupingFactories(s.app.FileTypes...)
+	groupingFuncs := getGroupingFactories(s.app().FileTypes...)
 
 	for _, fn := range groupingFuncs {
 		items = fn(items)
 	}
 
-	for _, item := range items {
-		log.Debug().Msgf("adding item with id %q to archive", item.Id)
-
-		file, err := os.Open(item.Path)
-		if err != nil {
-			log.Err(err).Msgf("Failed to open item with id %q", item.Id)
-			return nil, err
-		}
+	entries := make([]archiveEntry, len(items))
+	used := make(map[string]bool, len(items))
 
+	for i, item := range items {
 		itemPath := fmt.Sprintf("%s.%s", item.Name, item.Extension)
 
-		// if the item we are handling is an MP3 file, save it as Album/song.mp3
-		if metatada, ok := item.Metadata.(Mp3Metadata); ok {
-			log.Debug().Msgf("item with id %q is an mp3 file, save it under an folder for the album", item.Id)
-			itemPath = fmt.Sprintf("%s/%s.%s", metatada.Album, item.Name, item.Extension)
+		// if the item we are handling has album metadata, save it as Album/song.ext
+		if album := getArchiveAlbumFolder(item); album != "" {
+			log.Debug().Msgf("item with id %q has album metadata, save it under an folder for the album", item.Id)
+			itemPath = fmt.Sprintf("%s/%s.%s", album, item.Name, item.Extension)
 		}
 
-		writer, err := zipWriter.Create(itemPath)
-		if err != nil {
-			log.Err(err)
-			return nil, err
-		}
-
-		if _, err := io.Copy(writer, file); err != nil {
-			log.Err(err).Msgf("Failed to copy file to archive for item with id %q", item.Id)
-			return nil, err
-		}
-
-		file.Close()
+		entries[i] = archiveEntry{id: item.Id, sourcePath: item.Path, targetPath: uniqueArchivePath(used, itemPath)}
 	}
 
-	err := zipWriter.Close()
+	err := writeArchive(w, entries)
 
 	log.Info().Msg("Finished: downloading media")
 
-	return buf.Bytes(), err
+	return err
 }
 
 func (s *mediaService) DeleteMedia(ctx context.Context, ids []string) error {
@@ -351,6 +773,9 @@ func (s *mediaService) DeleteMedia(ctx context.Context, ids []string) error {
 
 	}
 
+	getMediaIndex().ScheduleSave()
+	go s.collectUnusedArt()
+
 	if len(failedToDelete) > 0 {
 		return fmt.Errorf("encountered the following errors during delete: %s", strings.Join(failedToDelete, "\n"))
 	}
@@ -364,6 +789,13 @@ func (s *mediaService) removeItemFromCache(item types.MediaItem) error {
 	// remove the item from the lookup
 	mediaLookup.Delete(item.Id)
 
+	mediaSearchIndex.Remove(item.Id)
+	mediaBrowseIndex.Remove(item.Id)
+
+	getArtStore().Remove(item.Id)
+
+	getMediaIndex().Remove(item.Path)
+
 	if parentDirCache, ok := mediaCache.GetKey(item.ParentDir); !ok {
 		return fmt.Errorf("parent dir for item %q is not in the cache", item.Id)
 	} else {
@@ -385,7 +817,7 @@ func (s *mediaService) removeItemFromCache(item types.MediaItem) error {
 func (s *mediaService) CleanupDownloadContent(ctx context.Context, transferId string) error {
 	log.Info().Msgf("Deleting content for transfer with id %s", transferId)
 
-	err := os.RemoveAll(path.Join(s.app.DownloadPath, transferId+".zip"))
+	err := os.RemoveAll(path.Join(s.app().DownloadPath, transferId+".zip"))
 	if err != nil {
 		log.Err(err).Msgf("Failed to delete content for transfer with id %s", transferId)
 	}
@@ -393,56 +825,211 @@ func (s *mediaService) CleanupDownloadContent(ctx context.Context, transferId st
 	return nil
 }
 
-func (s *mediaService) GetMediaArt(ctx context.Context, id string) ([]byte, error) {
+func (s *mediaService) GetMediaArt(ctx context.Context, id string, options ArtOptions) ([]byte, error) {
+	err := options.validate()
+	if err != nil {
+		return nil, err
+	}
+
 	item, err := s.GetMediaItemById(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
-	if item.Extension != "mp3" {
-		return nil, &exceptions.ApiException{
-			StatusCode: http.StatusBadRequest,
-			Err:        fmt.Errorf("media art is not supported for media of type %s", item.Extension),
+	if !options.isResized() {
+		art, err := s.getOriginalArt(item)
+		if err != nil {
+			return nil, err
+		}
+
+		return art.Data, nil
+	}
+
+	if _, ref, err := getArtStore().Path(item.Id); err == nil {
+		if data, ok := readCachedThumbnail(ref.Hash, options); ok {
+			return data, nil
 		}
 	}
 
-	// Assume only mp3 works from this point on, refactor for other types in the future
-	artPath, err := getArtPathForMp3Item(item)
+	art, err := s.getOriginalArt(item)
 	if err != nil {
 		return nil, err
 	}
 
-	artFile, err := os.OpenFile(artPath, 0, fs.FileMode(os.O_RDONLY))
+	resized, err := resizeArt(art, options)
 	if err != nil {
-		if os.IsNotExist(err) {
-			log.Debug().Msgf("art for item %q not saved on disk, reading file to get album art", item.Id)
+		log.Err(err).Msgf("Failed to resize art for item %q", item.Id)
+		return nil, err
+	}
 
-			art, err := getArtForMp3Item(item)
-			if err != nil {
-				errMsg := fmt.Sprintf("failed to open file for media item %q", item.Id)
-				log.Err(err).Msg(errMsg)
-				return nil, errors.New(errMsg)
-			}
-			// Send to channel so it can be processed and cached for the next run
-			mp3ItemChan <- item
+	// art that could not be decoded is returned as is, nothing to cache
+	if resized != art {
+		go cacheThumbnail(hashArt(art.Data), options, resized)
+	}
+
+	return resized.Data, nil
+}
+
+func (s *mediaService) GetMediaSubtitles(ctx context.Context, id string, language string, format string) ([]byte, error) {
+	item, err := s.GetMediaItemById(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var subtitles []SubtitleMetadata
+	if metadata, ok := item.Metadata.(subtitledMetadata); ok {
+		subtitles = metadata.subtitles()
+	}
+
+	subtitle, ok := findSubtitle(subtitles, language)
+	if !ok {
+		return nil, &exceptions.ApiException{
+			StatusCode: http.StatusNotFound,
+			Err:        fmt.Errorf("media item %s has no %s subtitles", item.Id, language),
+		}
+	}
+
+	if format != "" && format != subtitle.Format && !(format == SubtitleFormatVtt && subtitle.Format == SubtitleFormatSrt) {
+		return nil, &exceptions.ApiException{
+			StatusCode: http.StatusBadRequest,
+			Err:        fmt.Errorf("%s subtitles cannot be converted to %s", subtitle.Format, format),
+		}
+	}
 
-			return art, nil
+	content, err := os.ReadFile(filepath.Join(item.ParentDir, subtitle.FileName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = &exceptions.ApiException{Err: err, StatusCode: http.StatusNotFound}
 		}
 
-		// all other errors
 		return nil, err
 	}
 
-	defer artFile.Close()
+	if format == SubtitleFormatVtt && subtitle.Format == SubtitleFormatSrt {
+		return srtToVtt(content), nil
+	}
 
-	buf := new(bytes.Buffer)
+	return content, nil
+}
 
-	_, err = io.Copy(buf, artFile)
+// Chapters of the item in playback order, empty when it has none
+func (s *mediaService) GetMediaChapters(ctx context.Context, id string) ([]types.Chapter, error) {
+	item, err := s.GetMediaItemById(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
-	return buf.Bytes(), nil
+	if metadata, ok := item.Metadata.(chapteredMetadata); ok && metadata.chapters() != nil {
+		return metadata.chapters(), nil
+	}
+
+	return make([]types.Chapter, 0), nil
+}
+
+func (s *mediaService) GetMediaLyrics(ctx context.Context, id string) (types.Lyrics, error) {
+	item, err := s.GetMediaItemById(ctx, id)
+	if err != nil {
+		return types.Lyrics{}, err
+	}
+
+	lyrics, err := findLyrics(item)
+	if err != nil {
+		return types.Lyrics{}, err
+	}
+
+	if lyrics == nil {
+		return types.Lyrics{}, &exceptions.ApiException{
+			StatusCode: http.StatusNotFound,
+			Err:        fmt.Errorf("media item %s has no lyrics", item.Id),
+		}
+	}
+
+	return *lyrics, nil
+}
+
+/*
+** Saves edited lyrics in a LRC sidecar next to the item so they work for every media type and keep their timing.
+** Saving lyrics without lines removes the sidecar, the lyrics embedded in the file are then used again.
+ */
+func (s *mediaService) SaveMediaLyrics(ctx context.Context, id string, lyrics types.Lyrics) (types.Lyrics, error) {
+	item, err := s.GetMediaItemById(ctx, id)
+	if err != nil {
+		return types.Lyrics{}, err
+	}
+
+	err = validateLyrics(lyrics)
+	if err != nil {
+		return types.Lyrics{}, &exceptions.ApiException{StatusCode: http.StatusBadRequest, Err: err}
+	}
+
+	sidecarPath := getLyricsSidecarPath(item.Path)
+	ignoredFiles := []string{sidecarPath, getUpdatePath(sidecarPath)}
+
+	ignoreList := ignorelist.GetIgnoreList()
+	for _, f := range ignoredFiles {
+		ignoreList.AddFile(f)
+		defer ignoreList.RemoveFile(f)
+	}
+
+	if len(lyrics.Lines) == 0 {
+		err = os.Remove(sidecarPath)
+		if err != nil && !os.IsNotExist(err) {
+			return types.Lyrics{}, err
+		}
+	} else {
+		err = replaceSidecarContent(sidecarPath, encodeLrc(lyrics))
+		if err != nil {
+			log.Err(err).Msgf("Failed to write lyrics for file %s", item.Id)
+
+			return types.Lyrics{}, err
+		}
+	}
+
+	saved, err := findLyrics(item)
+	if err != nil || saved == nil {
+		return types.Lyrics{Lines: make([]types.LyricsLine, 0)}, err
+	}
+
+	return *saved, nil
+}
+
+func (s *mediaService) getOriginalArt(item types.MediaItem) (*mediaArt, error) {
+	artPath, ref, err := getArtStore().Path(item.Id)
+	if err == nil {
+		data, err := os.ReadFile(artPath)
+		if err != nil {
+			return nil, err
+		}
+
+		return &mediaArt{Data: data, Format: ref.Format}, nil
+	}
+
+	log.Debug().Msgf("art for item %q not saved on disk, reading file to get album art", item.Id)
+
+	art, err := getArtForItem(item)
+	if err != nil {
+		errMsg := fmt.Sprintf("failed to read art for media item %q", item.Id)
+		log.Err(err).Msg(errMsg)
+		return nil, errors.New(errMsg)
+	}
+
+	if art == nil {
+		return nil, &exceptions.ApiException{
+			StatusCode: http.StatusNotFound,
+			Err:        fmt.Errorf("media item %s has no art", item.Id),
+		}
+	}
+
+	// Send to channel so it can be processed and cached for the next run
+	artItemChan <- item
+
+	return art, nil
+}
+
+// Removes art that is no longer referenced by any media
+// Items still being scanned are not in the cache yet, the index already knows them
+func (s *mediaService) collectUnusedArt() {
+	getArtStore().CollectGarbage(getMediaIndex().Ids())
 }
 
 func (s *mediaService) HandleFileSystemDeletions(ctx context.Context, files []string) error {
@@ -464,6 +1051,12 @@ func (s *mediaService) HandleFileSystemDeletions(ctx context.Context, files []st
 			continue
 		}
 
+		// the file was renamed, the scan of its new path keeps its items
+		if mediaIdentity.IsMoveSource(file) {
+			log.Debug().Msgf("file %s was renamed, not removing it", file)
+			continue
+		}
+
 		dir := filepath.Dir(file)
 
 		if mediaForDirectory, ok := mediaCache.GetKey(dir); !ok {
@@ -474,6 +1067,11 @@ func (s *mediaService) HandleFileSystemDeletions(ctx context.Context, files []st
 		mediaLoop:
 			for _, media := range mediaForDirectory {
 				if media.Path == file || media.ParentDir == file {
+					// the file may show up again under another path if it was moved
+					if entry, ok := getMediaIndex().Entry(media.Path); ok {
+						mediaIdentity.AddVanished(media, entry)
+					}
+
 					err := s.removeItemFromCache(media)
 					if err != nil {
 						log.Err(err).Msgf("failed to remove delete item %s from cache", media.Name)
@@ -486,6 +1084,9 @@ func (s *mediaService) HandleFileSystemDeletions(ctx context.Context, files []st
 
 	}
 
+	getMediaIndex().ScheduleSave()
+	go s.collectUnusedArt()
+
 	return nil
 
 }
@@ -496,51 +1097,181 @@ func (s *mediaService) UpdateItem(ctx context.Context, id string, newContent []b
 		return types.MediaItem{}, err
 	}
 
+	ignoredFiles := []string{item.Path, getUpdatePath(item.Path), getBackupPath(item.Path)}
+
+	ignoreList := ignorelist.GetIgnoreList()
+	for _, f := range ignoredFiles {
+		ignoreList.AddFile(f)
+		defer ignoreList.RemoveFile(f)
+	}
+
+	err = replaceFileContent(item, newContent)
+	if err != nil {
+		log.Err(err).Msgf("Failed to write new content for file %s", item.Id)
+
+		return types.MediaItem{}, err
+	}
+
+	newItem, err := s.refreshItem(item)
+	if err != nil {
+		// the caller only rolls back items that were updated, do not leave this one changed
+		if restoreErr := restoreFileBackup(item.Path); restoreErr != nil {
+			log.Err(restoreErr).Msgf("Failed to restore previous content for file %s", item.Id)
+		}
+
+		return types.MediaItem{}, err
+	}
+
+	return newItem, nil
+}
+
+// Puts back the content the item had before its last update
+func (s *mediaService) RestoreItem(ctx context.Context, id string) (types.MediaItem, error) {
+	item, err := s.GetMediaItemById(ctx, id)
+	if err != nil {
+		return types.MediaItem{}, err
+	}
+
+	backupPath := getBackupPath(item.Path)
+
 	ignoreList := ignorelist.GetIgnoreList()
 	ignoreList.AddFile(item.Path)
+	ignoreList.AddFile(backupPath)
 	defer ignoreList.RemoveFile(item.Path)
+	defer ignoreList.RemoveFile(backupPath)
 
-	err = os.WriteFile(item.Path, newContent, os.ModeType)
+	err = restoreFileBackup(item.Path)
 	if err != nil {
-		log.Err(err).Msgf("Failed to write new content for file %s", item.Id)
+		log.Err(err).Msgf("Failed to restore previous content for file %s", item.Id)
+
+		return types.MediaItem{}, err
+	}
+
+	return s.refreshItem(item)
+}
+
+// Deletes the previous content kept by the last update of the item once it no longer needs to be rolled back
+func (s *mediaService) DiscardItemBackup(ctx context.Context, id string) error {
+	item, err := s.GetMediaItemById(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	backupPath := getBackupPath(item.Path)
+
+	ignoreList := ignorelist.GetIgnoreList()
+	ignoreList.AddFile(backupPath)
+	defer ignoreList.RemoveFile(backupPath)
+
+	err = os.Remove(backupPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *mediaService) PatchItemMetadata(ctx context.Context, id string, patch types.MediaMetadataPatch) (types.MediaItem, error) {
+	item, err := s.GetMediaItemById(ctx, id)
+	if err != nil {
+		return types.MediaItem{}, err
+	}
+
+	writeTags, err := getTagWriter(item.Extension)
+	if err != nil {
+		return types.MediaItem{}, err
+	}
+
+	tags, audioOffset, err := writeTags(item, patch)
+	if err != nil {
+		log.Err(err).Msgf("Failed to write tags for file %s", item.Id)
+
+		return types.MediaItem{}, err
+	}
+
+	ignoredFiles := []string{item.Path, getUpdatePath(item.Path), getBackupPath(item.Path)}
+
+	ignoreList := ignorelist.GetIgnoreList()
+	for _, f := range ignoredFiles {
+		ignoreList.AddFile(f)
+		defer ignoreList.RemoveFile(f)
+	}
+
+	// the file is replaced like updated content so its previous content is kept until the changeset is done
+	err = replaceTags(item, tags, audioOffset)
+	if err != nil {
+		log.Err(err).Msgf("Failed to write tags for file %s", item.Id)
+
+		return types.MediaItem{}, err
+	}
+
+	newItem, err := s.refreshItem(item)
+	if err != nil {
+		// the caller only rolls back items that were patched, do not leave this one changed
+		if restoreErr := restoreFileBackup(item.Path); restoreErr != nil {
+			log.Err(restoreErr).Msgf("Failed to restore previous content for file %s", item.Id)
+		}
 
 		return types.MediaItem{}, err
 	}
 
-	// File is now changed, re-process it
+	return newItem, nil
+}
+
+// Parses an item again after its file changed and replaces it in the caches and indexes
+func (s *mediaService) refreshItem(item types.MediaItem) (types.MediaItem, error) {
+	// File is now changed, make sure it is parsed again instead of read from the index
+	getMediaIndex().Invalidate(item.Path)
+
+	// re-process it
 	wp := utils.NewWorkerPool(1)
 	items := make(chan types.MediaItem, 1)
 	wg := new(sync.WaitGroup)
 
 	wg.Add(1)
 	// Only processing the one file and we already have the id of it so pass the cache as just the item for this item
-	s.processFile(item.Path, wg, wp, utils.NewConcurrentMapFromData(map[string]string{item.Path: item.Id}), items)
+	s.processFile(item.Path, false, wg, wp, utils.NewConcurrentMapFromData(map[string]string{item.Path: item.Id}), items)
 	wg.Wait()
+	close(items)
 
-	newItem := <-items
+	newItem, ok := <-items
+	if !ok {
+		return types.MediaItem{}, fmt.Errorf("item %q could not be parsed after it changed", item.Id)
+	}
 
 	// Update the lookup cache with the new item
 	mediaLookup.Add(item.Id, newItem)
+
+	mediaSearchIndex.Add(newItem)
+	mediaBrowseIndex.Add(newItem)
+
+	// art may have changed with the content, the previous art was dropped when the file was processed again
+	if isArtSupported(newItem.Extension) {
+		artItemChan <- newItem
+	}
+
 	// Update the cache top level cache with the new item
-	if parentDirCache, ok := mediaCache.GetKey(item.ParentDir); !ok {
+	parentDirCache, ok := mediaCache.GetKey(item.ParentDir)
+	if !ok {
 		return types.MediaItem{}, fmt.Errorf("parent dir for item %q is not in the cache", item.Id)
-	} else {
-		newCache := make([]types.MediaItem, len(parentDirCache))
-
-		for i, cachedItem := range parentDirCache {
-			// same item as the input, need to set it to the updated item
-			if cachedItem.Id == item.Id {
-				newCache[i] = newItem
-			} else {
-				newCache[i] = cachedItem
-			}
-		}
+	}
 
-		mediaCache.Add(item.ParentDir, newCache)
+	newCache := make([]types.MediaItem, len(parentDirCache))
 
-		return newItem, nil
+	for i, cachedItem := range parentDirCache {
+		// same item as the input, need to set it to the updated item
+		if cachedItem.Id == item.Id {
+			newCache[i] = newItem
+		} else {
+			newCache[i] = cachedItem
+		}
 	}
 
+	mediaCache.Add(item.ParentDir, newCache)
+
+	getMediaIndex().ScheduleSave()
+
+	return newItem, nil
 }
 
 func (s *mediaService) GetMediaItemByIdWithContent(ctx context.Context, id string) (result types.MediaItemWithContent, err error) {
@@ -550,8 +1281,12 @@ func (s *mediaService) GetMediaItemByIdWithContent(ctx context.Context, id strin
 		return
 	}
 
-	content, err := s.StreamMedia(ctx, id)
+	content, err := os.ReadFile(mediaItem.Path)
 	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = &exceptions.ApiException{Err: err, StatusCode: http.StatusNotFound}
+		}
+
 		return
 	}
 
@@ -573,6 +1308,14 @@ func (s *mediaService) saveIdToPathMapping(newCache *utils.ConcurrentMap[string,
 		cache.Add(k, v)
 	}
 
+	// previous paths of moved items
+	stalePaths := mediaIdentity.StalePaths()
+	for k, id := range stalePaths {
+		if existing, ok := cache.GetKey(k); ok && existing == id {
+			cache.Delete(k)
+		}
+	}
+
 	mappingBytes, err := json.Marshal(cache.Get())
 	if err != nil {
 		log.Error().Msg("Failed to marshal id to path mapping")
@@ -591,6 +1334,8 @@ func (s *mediaService) saveIdToPathMapping(newCache *utils.ConcurrentMap[string,
 		return
 	}
 
+	mediaIdentity.MappingSaved(stalePaths)
+
 	return nil
 }
 
@@ -629,5 +1374,5 @@ func (s *mediaService) readMediaCache() (result *utils.ConcurrentMap[string, str
 }
 
 func NewMediaService() MediaApi {
-	return &mediaService{app: app.GetApp()}
+	return &mediaService{}
 }
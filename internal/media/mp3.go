@@ -0,0 +1,306 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+
+	"github.com/tcolgate/mp3"
+)
+
+const (
+	// frames looked at before assuming a file without header has a constant bitrate
+	mp3CbrProbeFrames = 8
+	mp3Id3v1TagSize   = 128
+)
+
+// Channel modes as exposed in the metadata
+var mp3ChannelModes = map[mp3.FrameChannelMode]string{
+	mp3.Stereo:        "stereo",
+	mp3.JointStereo:   "joint_stereo",
+	mp3.DualChannel:   "dual_channel",
+	mp3.SingleChannel: "mono",
+}
+
+// Xing, Info or VBRI header stored by encoders in a silent first frame
+type mp3InfoTag struct {
+	Vbr bool
+	// amount of audio frames and their size in bytes, 0 if the encoder did not write them
+	Frames  uint32
+	Bytes   uint32
+	Encoder string
+}
+
+type mp3StreamInfo struct {
+	Length      float64
+	SampleRate  int
+	ChannelMode string
+	// kbps
+	BitrateAvg  int
+	BitratePeak int
+	Vbr         bool
+	Encoder     string
+}
+
+// Moves the reader after the ID3v2 tag at the start of the file so its content is not mistaken for audio frames
+func skipId3v2Tag(r io.ReadSeeker) error {
+	_, err := r.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, id3HeaderSize)
+
+	_, err = io.ReadFull(r, header)
+	if err != nil || string(header[:3]) != "ID3" {
+		_, err = r.Seek(0, io.SeekStart)
+		return err
+	}
+
+	size := id3HeaderSize + decodeSynchsafe(header[6:10])
+	if header[5]&id3FlagFooter != 0 {
+		size += id3HeaderSize
+	}
+
+	_, err = r.Seek(size, io.SeekStart)
+
+	return err
+}
+
+// Looks for a Xing/Info header after the side information or a VBRI header at its fixed offset
+func parseMp3InfoTag(frame *mp3.Frame) *mp3InfoTag {
+	data, err := io.ReadAll(frame.Reader())
+	if err != nil {
+		return nil
+	}
+
+	sideInfoLength, err := frame.SideInfoLength()
+	if err != nil {
+		return nil
+	}
+
+	offset := 4 + sideInfoLength
+	if frame.Header().Protection() {
+		offset += 2
+	}
+
+	if offset+8 <= len(data) {
+		id := string(data[offset : offset+4])
+
+		if id == "Xing" || id == "Info" {
+			return parseXingTag(data[offset:], id == "Xing")
+		}
+	}
+
+	// VBRI always sits 32 bytes after the frame header
+	if len(data) >= 4+32+18 && string(data[36:40]) == "VBRI" {
+		return &mp3InfoTag{Vbr: true, Bytes: binary.BigEndian.Uint32(data[46:50]), Frames: binary.BigEndian.Uint32(data[50:54])}
+	}
+
+	return nil
+}
+
+func parseXingTag(data []byte, vbr bool) *mp3InfoTag {
+	tag := &mp3InfoTag{Vbr: vbr}
+	flags := binary.BigEndian.Uint32(data[4:8])
+	offset := 8
+
+	if flags&0x1 != 0 && offset+4 <= len(data) {
+		tag.Frames = binary.BigEndian.Uint32(data[offset : offset+4])
+		offset += 4
+	}
+
+	if flags&0x2 != 0 && offset+4 <= len(data) {
+		tag.Bytes = binary.BigEndian.Uint32(data[offset : offset+4])
+		offset += 4
+	}
+
+	// table of contents and quality are not needed
+
+	if flags&0x4 != 0 {
+		offset += 100
+	}
+
+	if flags&0x8 != 0 {
+		offset += 4
+	}
+
+	// LAME and compatible encoders follow with a 9 character version, ie LAME3.100
+	if offset+9 <= len(data) {
+		encoder := strings.TrimRight(string(bytes.TrimRight(data[offset:offset+9], "\x00")), " ")
+		if isPrintable(encoder) {
+			tag.Encoder = encoder
+		}
+	}
+
+	return tag
+}
+
+func isPrintable(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, c := range s {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Offset after the last audio frame, ignoring an ID3v1 tag at the end of the file
+func getMp3AudioEnd(r io.ReadSeeker, size int64) (int64, error) {
+	if size < mp3Id3v1TagSize {
+		return size, nil
+	}
+
+	_, err := r.Seek(size-mp3Id3v1TagSize, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	marker := make([]byte, 3)
+
+	_, err = io.ReadFull(r, marker)
+	if err != nil {
+		return 0, err
+	}
+
+	if string(marker) == "TAG" {
+		return size - mp3Id3v1TagSize, nil
+	}
+
+	return size, nil
+}
+
+/*
+** Reads the duration and bitrates of the stream starting at the current position of the reader. Unless exact is set
+** the duration comes from the frame count of the Xing/Info/VBRI header, or is estimated from the size of the file when
+** the first frames all share the same bitrate. Every frame is decoded only when neither is possible.
+** The header frame is silent so it is never counted as audio.
+ */
+func readMp3StreamInfo(r io.ReadSeeker, size int64, exact bool) (info mp3StreamInfo, err error) {
+	position, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return
+	}
+
+	d := mp3.NewDecoder(r)
+
+	var frame mp3.Frame
+	var infoTag *mp3InfoTag
+	var audioStart int64
+	skipped := 0
+	frames := 0
+	totalBytes := 0
+	minBitrate := 0
+
+	for {
+		errD := d.Decode(&frame, &skipped)
+		if errD != nil {
+			if errD == io.EOF || errD == io.ErrUnexpectedEOF {
+				break
+			}
+
+			err = errD
+			return
+		}
+
+		header := frame.Header()
+		bitrate := int(header.BitRate()) / 1000
+
+		if info.SampleRate == 0 {
+			audioStart = position + int64(skipped)
+			info.SampleRate = int(header.SampleRate())
+			info.ChannelMode = mp3ChannelModes[header.ChannelMode()]
+
+			infoTag = parseMp3InfoTag(&frame)
+			if infoTag != nil {
+				audioStart += int64(frame.Size())
+
+				if !exact && infoTag.Frames > 0 && info.SampleRate > 0 {
+					return infoFromMp3Header(r, size, audioStart, info, infoTag, float64(frame.Samples()), bitrate)
+				}
+
+				continue
+			}
+		}
+
+		if bitrate > info.BitratePeak {
+			info.BitratePeak = bitrate
+		}
+
+		if minBitrate == 0 || bitrate < minBitrate {
+			minBitrate = bitrate
+		}
+
+		frames++
+		totalBytes += frame.Size()
+		info.Length += frame.Duration().Seconds()
+
+		if !exact && frames == mp3CbrProbeFrames && minBitrate == info.BitratePeak && (infoTag == nil || !infoTag.Vbr) {
+			return estimateCbrMp3Info(r, size, audioStart, info, infoTag)
+		}
+	}
+
+	if info.Length > 0 {
+		info.BitrateAvg = int(float64(totalBytes)*8/info.Length/1000 + 0.5)
+	}
+
+	// files without a header are variable bitrate if their frames do not all share the same bitrate
+	info.Vbr = minBitrate != info.BitratePeak
+
+	if infoTag != nil {
+		info.Vbr = infoTag.Vbr
+		info.Encoder = infoTag.Encoder
+	}
+
+	return
+}
+
+// Duration from the amount of frames in the header, the peak bitrate of variable bitrate files is unknown without decoding them
+func infoFromMp3Header(r io.ReadSeeker, size int64, audioStart int64, info mp3StreamInfo, infoTag *mp3InfoTag, samplesPerFrame float64, bitrate int) (mp3StreamInfo, error) {
+	info.Length = float64(infoTag.Frames) * samplesPerFrame / float64(info.SampleRate)
+	info.Vbr = infoTag.Vbr
+	info.Encoder = infoTag.Encoder
+
+	if !infoTag.Vbr {
+		info.BitratePeak = bitrate
+	}
+
+	audioBytes := int64(infoTag.Bytes)
+	if audioBytes == 0 {
+		audioEnd, err := getMp3AudioEnd(r, size)
+		if err != nil {
+			return info, err
+		}
+
+		audioBytes = audioEnd - audioStart
+	}
+
+	if info.Length > 0 {
+		info.BitrateAvg = int(float64(audioBytes)*8/info.Length/1000 + 0.5)
+	}
+
+	return info, nil
+}
+
+// Constant bitrate files have the same amount of audio per byte so the duration follows from the size of the audio
+func estimateCbrMp3Info(r io.ReadSeeker, size int64, audioStart int64, info mp3StreamInfo, infoTag *mp3InfoTag) (mp3StreamInfo, error) {
+	audioEnd, err := getMp3AudioEnd(r, size)
+	if err != nil {
+		return info, err
+	}
+
+	info.BitrateAvg = info.BitratePeak
+	info.Length = float64(audioEnd-audioStart) * 8 / float64(info.BitratePeak*1000)
+
+	if infoTag != nil {
+		info.Encoder = infoTag.Encoder
+	}
+
+	return info, nil
+}
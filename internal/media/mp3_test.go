@@ -0,0 +1,166 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+const (
+	// MPEG1 Layer III at 48kHz, 1152 samples per frame
+	testMp3FrameDuration = 1152.0 / 48000
+	testMp3Bitrate128    = 9
+	testMp3Bitrate160    = 10
+	// offset of the Xing and VBRI headers in the frame of a stereo stream, after the frame header and side information
+	testMp3InfoTagOffset = 4 + 32
+)
+
+// Silent stereo MPEG1 Layer III frame, 128kbps frames are 384 bytes and 160kbps ones 480 bytes
+func buildMp3Frame(bitrateIndex byte) []byte {
+	header := []byte{0xff, 0xfb, bitrateIndex<<4 | 0x1<<2, 0x00}
+	size := 144 * map[byte]int{testMp3Bitrate128: 128000, testMp3Bitrate160: 160000}[bitrateIndex] / 48000
+
+	return append(header, make([]byte, size-len(header))...)
+}
+
+// Frames alternating between 128 and 160kbps when vbr is set
+func buildMp3Audio(frames int, vbr bool) []byte {
+	audio := new(bytes.Buffer)
+
+	for i := 0; i < frames; i++ {
+		if vbr && i%2 == 1 {
+			audio.Write(buildMp3Frame(testMp3Bitrate160))
+		} else {
+			audio.Write(buildMp3Frame(testMp3Bitrate128))
+		}
+	}
+
+	return audio.Bytes()
+}
+
+func buildXingMp3(frames int) []byte {
+	audio := buildMp3Audio(frames, true)
+	frame := buildMp3Frame(testMp3Bitrate128)
+
+	tag := frame[testMp3InfoTagOffset:]
+	copy(tag, "Xing")
+	// frame count and byte count are present
+	binary.BigEndian.PutUint32(tag[4:8], 0x3)
+	binary.BigEndian.PutUint32(tag[8:12], uint32(frames))
+	binary.BigEndian.PutUint32(tag[12:16], uint32(len(audio)))
+	copy(tag[16:], "LAME3.100")
+
+	id3 := buildId3Tag(4, 64, buildId3Frame(4, "TIT2", latin1Text("Title")))
+
+	return append(append(id3, frame...), audio...)
+}
+
+func buildVbriMp3(frames int) []byte {
+	audio := buildMp3Audio(frames, true)
+	frame := buildMp3Frame(testMp3Bitrate128)
+
+	tag := frame[testMp3InfoTagOffset:]
+	copy(tag, "VBRI")
+	binary.BigEndian.PutUint32(tag[10:14], uint32(len(audio)))
+	binary.BigEndian.PutUint32(tag[14:18], uint32(frames))
+
+	return append(frame, audio...)
+}
+
+func buildCbrMp3(frames int) []byte {
+	return buildMp3Audio(frames, false)
+}
+
+func readTestMp3(t testing.TB, content []byte, exact bool) mp3StreamInfo {
+	t.Helper()
+
+	r := bytes.NewReader(content)
+
+	err := skipId3v2Tag(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := readMp3StreamInfo(r, int64(len(content)), exact)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return info
+}
+
+func TestMp3DurationMatchesFullDecode(t *testing.T) {
+	const frames = 500
+
+	expected := frames * testMp3FrameDuration
+
+	files := map[string]struct {
+		content []byte
+		vbr     bool
+		encoder string
+	}{
+		"xing": {content: buildXingMp3(frames), vbr: true, encoder: "LAME3.100"},
+		"vbri": {content: buildVbriMp3(frames), vbr: true},
+		"cbr":  {content: buildCbrMp3(frames)},
+	}
+
+	for name, file := range files {
+		fast := readTestMp3(t, file.content, false)
+		exact := readTestMp3(t, file.content, true)
+
+		for _, info := range []mp3StreamInfo{fast, exact} {
+			if math.Abs(info.Length-expected) > 0.05 {
+				t.Errorf("%s: expected a duration of %.3fs, got %.3fs", name, expected, info.Length)
+			}
+
+			if info.SampleRate != 48000 || info.ChannelMode != "stereo" {
+				t.Errorf("%s: got sample rate %d and channel mode %q", name, info.SampleRate, info.ChannelMode)
+			}
+
+			if info.Vbr != file.vbr || info.Encoder != file.encoder {
+				t.Errorf("%s: got vbr %t and encoder %q", name, info.Vbr, info.Encoder)
+			}
+		}
+
+		if math.Abs(float64(fast.BitrateAvg-exact.BitrateAvg)) > 1 {
+			t.Errorf("%s: average bitrate of %d differs from the decoded %d", name, fast.BitrateAvg, exact.BitrateAvg)
+		}
+	}
+}
+
+func TestMp3DurationIgnoresId3v1Tag(t *testing.T) {
+	content := append(buildCbrMp3(100), append([]byte("TAG"), make([]byte, mp3Id3v1TagSize-3)...)...)
+
+	info := readTestMp3(t, content, false)
+	if math.Abs(info.Length-100*testMp3FrameDuration) > 0.05 {
+		t.Fatalf("expected a duration of %.3fs, got %.3fs", 100*testMp3FrameDuration, info.Length)
+	}
+}
+
+// about 4 minutes of audio
+const benchmarkMp3Frames = 10000
+
+func benchmarkMp3Duration(b *testing.B, content []byte, exact bool) {
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		readTestMp3(b, content, exact)
+	}
+}
+
+func BenchmarkMp3DurationXingHeader(b *testing.B) {
+	benchmarkMp3Duration(b, buildXingMp3(benchmarkMp3Frames), false)
+}
+
+func BenchmarkMp3DurationVbriHeader(b *testing.B) {
+	benchmarkMp3Duration(b, buildVbriMp3(benchmarkMp3Frames), false)
+}
+
+func BenchmarkMp3DurationCbrEstimate(b *testing.B) {
+	benchmarkMp3Duration(b, buildCbrMp3(benchmarkMp3Frames), false)
+}
+
+func BenchmarkMp3DurationFullDecode(b *testing.B) {
+	benchmarkMp3Duration(b, buildXingMp3(benchmarkMp3Frames), true)
+}
@@ -0,0 +1,720 @@
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
+)
+
+const (
+	mp4AtomHeaderSize = 8
+	// the moov atom holds the tags and art, anything larger than this is not a valid file
+	mp4MaxMoovSize = 64 << 20
+	// chapter track samples are a title each, anything larger is not read
+	mp4MaxChapters      = 4096
+	mp4MaxChapterSample = 64 << 10
+	// nero chapter start times are in 100 nanoseconds
+	mp4ChplTimescale = 10000000
+)
+
+// Atoms that only contain other atoms
+var mp4ContainerAtoms = map[string]bool{
+	"moov": true,
+	"trak": true,
+	"mdia": true,
+	"minf": true,
+	"stbl": true,
+	"udta": true,
+	"ilst": true,
+}
+
+type mp4Atom struct {
+	kind string
+	data []byte
+}
+
+// Splits the content of a container atom in its children
+func parseMp4Atoms(data []byte) ([]mp4Atom, error) {
+	atoms := make([]mp4Atom, 0)
+
+	for len(data) >= mp4AtomHeaderSize {
+		size := uint64(binary.BigEndian.Uint32(data[:4]))
+		kind := string(data[4:8])
+		headerSize := uint64(mp4AtomHeaderSize)
+
+		switch size {
+		case 0:
+			// the atom extends to the end of its parent
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, errors.New("truncated mp4 atom header")
+			}
+
+			size = binary.BigEndian.Uint64(data[8:16])
+			headerSize = 16
+		}
+
+		if size < headerSize || size > uint64(len(data)) {
+			return nil, errors.New("invalid mp4 atom size")
+		}
+
+		atoms = append(atoms, mp4Atom{kind: kind, data: data[headerSize:size]})
+		data = data[size:]
+	}
+
+	return atoms, nil
+}
+
+// Reads the moov atom, the media data around it is skipped without being read
+func readMp4Moov(r io.ReadSeeker) ([]byte, error) {
+	header := make([]byte, mp4AtomHeaderSize)
+
+	for {
+		_, err := io.ReadFull(r, header)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, errors.New("no moov atom in mp4 file")
+			}
+
+			return nil, err
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		kind := string(header[4:8])
+		headerSize := int64(mp4AtomHeaderSize)
+
+		switch size {
+		case 0:
+			if kind != "moov" {
+				return nil, errors.New("no moov atom in mp4 file")
+			}
+
+			return io.ReadAll(io.LimitReader(r, mp4MaxMoovSize))
+		case 1:
+			largeSize := make([]byte, 8)
+
+			_, err = io.ReadFull(r, largeSize)
+			if err != nil {
+				return nil, err
+			}
+
+			size = int64(binary.BigEndian.Uint64(largeSize))
+			headerSize = 16
+		}
+
+		if size < headerSize {
+			return nil, errors.New("invalid mp4 atom size")
+		}
+
+		if kind != "moov" {
+			_, err = r.Seek(size-headerSize, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if size-headerSize > mp4MaxMoovSize {
+			return nil, errors.New("mp4 moov atom is too large")
+		}
+
+		moov := make([]byte, size-headerSize)
+
+		_, err = io.ReadFull(r, moov)
+
+		return moov, err
+	}
+}
+
+type mp4VideoTrack struct {
+	Width  int
+	Height int
+	Codec  string
+}
+
+type mp4Info struct {
+	Length     float64
+	AudioCodec string
+	Video      *mp4VideoTrack
+	Tags       map[string][]byte
+	Chapters   []types.Chapter
+}
+
+/*
+** Reads the duration from mvhd, the codecs of the first audio and video tracks and the iTunes style
+** tags from moov.udta.meta.ilst. Tags are keyed by their atom name, ie ©nam, with the raw value of their data atom.
+** Chapters come from a nero chpl atom or else from the text track the audio track points to, as written by iTunes.
+ */
+func readMp4Info(r io.ReadSeeker) (info mp4Info, err error) {
+	moov, err := readMp4Moov(r)
+	if err != nil {
+		return
+	}
+
+	atoms, err := parseMp4Atoms(moov)
+	if err != nil {
+		return
+	}
+
+	info.Tags = make(map[string][]byte)
+	traks := make([][]byte, 0)
+
+	for _, atom := range atoms {
+		switch atom.kind {
+		case "mvhd":
+			info.Length = parseMp4Duration(atom.data)
+		case "trak":
+			traks = append(traks, atom.data)
+			handler, codec, width, height := parseMp4Track(atom.data)
+
+			if handler == "soun" && info.AudioCodec == "" {
+				info.AudioCodec = codec
+			}
+
+			if handler == "vide" && info.Video == nil {
+				info.Video = &mp4VideoTrack{Width: width, Height: height, Codec: codec}
+			}
+		case "udta":
+			parseMp4Tags(atom.data, info.Tags)
+
+			if chpl := findMp4Atom(atom.data, "chpl"); chpl != nil {
+				info.Chapters = parseMp4Chpl(chpl)
+			}
+		}
+	}
+
+	if len(info.Chapters) == 0 {
+		info.Chapters = readMp4ChapterTrack(r, traks)
+	}
+
+	info.Chapters = completeChapterEnds(info.Chapters, info.Length)
+
+	return
+}
+
+// Content of the atom at the path under data, nil when there is none
+func findMp4Atom(data []byte, path ...string) []byte {
+	for _, kind := range path {
+		atoms, err := parseMp4Atoms(data)
+		if err != nil {
+			return nil
+		}
+
+		data = nil
+
+		for _, atom := range atoms {
+			if atom.kind == kind {
+				data = atom.data
+				break
+			}
+		}
+
+		if data == nil {
+			return nil
+		}
+	}
+
+	return data
+}
+
+// Duration in seconds from a mvhd or mdhd atom
+func parseMp4Duration(data []byte) float64 {
+	if len(data) < 1 {
+		return 0
+	}
+
+	var timescale uint32
+	var duration uint64
+
+	if data[0] == 1 {
+		if len(data) < 32 {
+			return 0
+		}
+
+		timescale = binary.BigEndian.Uint32(data[20:24])
+		duration = binary.BigEndian.Uint64(data[24:32])
+	} else {
+		if len(data) < 20 {
+			return 0
+		}
+
+		timescale = binary.BigEndian.Uint32(data[12:16])
+		duration = uint64(binary.BigEndian.Uint32(data[16:20]))
+	}
+
+	if timescale == 0 {
+		return 0
+	}
+
+	return float64(duration) / float64(timescale)
+}
+
+// Returns the handler of the track, ie soun or vide, the fourcc of its first sample description and its dimensions
+func parseMp4Track(data []byte) (handler string, codec string, width int, height int) {
+	atoms, err := parseMp4Atoms(data)
+	if err != nil {
+		return
+	}
+
+	for _, atom := range atoms {
+		switch atom.kind {
+		case "tkhd":
+			// presentation size, 16.16 fixed point numbers at the end of the atom
+			if len(atom.data) >= 8 {
+				size := atom.data[len(atom.data)-8:]
+				width = int(binary.BigEndian.Uint32(size[:4]) >> 16)
+				height = int(binary.BigEndian.Uint32(size[4:]) >> 16)
+			}
+		case "hdlr":
+			if len(atom.data) >= 12 {
+				handler = string(atom.data[8:12])
+			}
+		case "stsd":
+			// version, flags and entry count precede the sample entries
+			if len(atom.data) >= 16 {
+				codec = string(atom.data[12:16])
+			}
+		default:
+			if mp4ContainerAtoms[atom.kind] {
+				childHandler, childCodec, childWidth, childHeight := parseMp4Track(atom.data)
+
+				if childHandler != "" {
+					handler = childHandler
+				}
+
+				if childCodec != "" {
+					codec = childCodec
+				}
+
+				if width == 0 && height == 0 {
+					width, height = childWidth, childHeight
+				}
+			}
+		}
+	}
+
+	return
+}
+
+func parseMp4Tags(udta []byte, tags map[string][]byte) {
+	atoms, err := parseMp4Atoms(udta)
+	if err != nil {
+		return
+	}
+
+	for _, atom := range atoms {
+		if atom.kind != "meta" {
+			continue
+		}
+
+		children := atom.data
+		// meta is a full atom in iso files but not in quicktime ones, which start directly with a child atom
+		if len(children) >= 8 && string(children[4:8]) != "hdlr" {
+			children = children[4:]
+		}
+
+		metaAtoms, err := parseMp4Atoms(children)
+		if err != nil {
+			continue
+		}
+
+		for _, metaAtom := range metaAtoms {
+			if metaAtom.kind != "ilst" {
+				continue
+			}
+
+			items, err := parseMp4Atoms(metaAtom.data)
+			if err != nil {
+				continue
+			}
+
+			for _, item := range items {
+				// freeform tags are all ---- atoms, they are keyed by their name instead, ie ----:SERIES
+				if item.kind == "----" {
+					if name, value, ok := parseMp4FreeformTag(item.data); ok {
+						tags["----:"+strings.ToUpper(name)] = value
+					}
+
+					continue
+				}
+
+				if value, ok := parseMp4TagValue(item.data); ok {
+					tags[item.kind] = value
+				}
+			}
+		}
+	}
+}
+
+// Value of the data atom of an ilst item, after its type and locale
+func parseMp4TagValue(item []byte) ([]byte, bool) {
+	atoms, err := parseMp4Atoms(item)
+	if err != nil {
+		return nil, false
+	}
+
+	for _, atom := range atoms {
+		if atom.kind == "data" && len(atom.data) >= 8 {
+			return atom.data[8:], true
+		}
+	}
+
+	return nil, false
+}
+
+// Name and value of a freeform tag, its mean atom is ignored
+func parseMp4FreeformTag(item []byte) (string, []byte, bool) {
+	name := findMp4Atom(item, "name")
+	if len(name) < 4 {
+		return "", nil, false
+	}
+
+	value, ok := parseMp4TagValue(item)
+
+	return string(name[4:]), value, ok
+}
+
+// Nero chapters, a start time and a length prefixed title per chapter
+func parseMp4Chpl(data []byte) []types.Chapter {
+	if len(data) < 5 {
+		return nil
+	}
+
+	offset := 4
+	// version 1 has 4 more bytes before the count
+	if data[0] == 1 {
+		offset += 4
+	}
+
+	if offset >= len(data) {
+		return nil
+	}
+
+	count := int(data[offset])
+	offset++
+
+	chapters := make([]types.Chapter, 0, count)
+
+	for n := 0; n < count && offset+9 <= len(data); n++ {
+		start := binary.BigEndian.Uint64(data[offset : offset+8])
+		titleLength := int(data[offset+8])
+		offset += 9
+
+		if offset+titleLength > len(data) {
+			break
+		}
+
+		chapters = append(chapters, types.Chapter{
+			Title: string(data[offset : offset+titleLength]),
+			Start: float64(start) / mp4ChplTimescale,
+		})
+
+		offset += titleLength
+	}
+
+	return chapters
+}
+
+// Track id from a tkhd atom, after the creation and modification times which are 64 bit in version 1
+func parseMp4TrackId(tkhd []byte) uint32 {
+	offset := 12
+	if len(tkhd) > 0 && tkhd[0] == 1 {
+		offset = 20
+	}
+
+	if len(tkhd) < offset+4 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint32(tkhd[offset : offset+4])
+}
+
+// Reads the chapters from the text track referenced by a tref.chap atom of another track
+func readMp4ChapterTrack(r io.ReadSeeker, traks [][]byte) []types.Chapter {
+	chapterIds := make(map[uint32]bool)
+
+	for _, trak := range traks {
+		chap := findMp4Atom(trak, "tref", "chap")
+
+		for i := 0; i+4 <= len(chap); i += 4 {
+			chapterIds[binary.BigEndian.Uint32(chap[i:i+4])] = true
+		}
+	}
+
+	if len(chapterIds) == 0 {
+		return nil
+	}
+
+	for _, trak := range traks {
+		if !chapterIds[parseMp4TrackId(findMp4Atom(trak, "tkhd"))] {
+			continue
+		}
+
+		chapters, err := readMp4TextSamples(r, trak)
+		if err == nil && len(chapters) > 0 {
+			return chapters
+		}
+	}
+
+	return nil
+}
+
+/*
+** Each sample of a text track is a title, its time comes from the sample durations of stts. The position of a sample
+** in the file is the offset of its chunk from stco/co64 plus the size of the samples before it in that chunk.
+ */
+func readMp4TextSamples(r io.ReadSeeker, trak []byte) ([]types.Chapter, error) {
+	timescale := parseMp4Timescale(findMp4Atom(trak, "mdia", "mdhd"))
+	stbl := findMp4Atom(trak, "mdia", "minf", "stbl")
+
+	if timescale == 0 || stbl == nil {
+		return nil, errors.New("chapter track has no timescale or sample table")
+	}
+
+	durations := parseMp4SampleDurations(findMp4Atom(stbl, "stts"))
+	sizes := parseMp4SampleSizes(findMp4Atom(stbl, "stsz"))
+	offsets := parseMp4SampleOffsets(stbl, sizes)
+
+	chapters := make([]types.Chapter, 0, len(offsets))
+	var time uint64
+
+	for i, offset := range offsets {
+		if i >= len(durations) {
+			break
+		}
+
+		title, err := readMp4TextSample(r, offset, sizes[i])
+		if err != nil {
+			return nil, err
+		}
+
+		chapters = append(chapters, types.Chapter{
+			Title: title,
+			Start: float64(time) / float64(timescale),
+			End:   float64(time+uint64(durations[i])) / float64(timescale),
+		})
+
+		time += uint64(durations[i])
+	}
+
+	return chapters, nil
+}
+
+func parseMp4Timescale(mdhd []byte) uint32 {
+	if len(mdhd) > 0 && mdhd[0] == 1 {
+		if len(mdhd) < 24 {
+			return 0
+		}
+
+		return binary.BigEndian.Uint32(mdhd[20:24])
+	}
+
+	if len(mdhd) < 16 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint32(mdhd[12:16])
+}
+
+// Duration of every sample from the run length encoded stts entries
+func parseMp4SampleDurations(stts []byte) []uint32 {
+	durations := make([]uint32, 0)
+
+	if len(stts) < 8 {
+		return durations
+	}
+
+	entries := int(binary.BigEndian.Uint32(stts[4:8]))
+
+	for i := 0; i < entries && 8+i*8+8 <= len(stts); i++ {
+		entry := stts[8+i*8:]
+		count := int(binary.BigEndian.Uint32(entry[:4]))
+		delta := binary.BigEndian.Uint32(entry[4:8])
+
+		for n := 0; n < count && len(durations) < mp4MaxChapters; n++ {
+			durations = append(durations, delta)
+		}
+	}
+
+	return durations
+}
+
+// Size of every sample, stsz either has a size shared by all samples or a table
+func parseMp4SampleSizes(stsz []byte) []uint32 {
+	sizes := make([]uint32, 0)
+
+	if len(stsz) < 12 {
+		return sizes
+	}
+
+	size := binary.BigEndian.Uint32(stsz[4:8])
+	count := int(binary.BigEndian.Uint32(stsz[8:12]))
+
+	for i := 0; i < count && i < mp4MaxChapters; i++ {
+		if size != 0 {
+			sizes = append(sizes, size)
+			continue
+		}
+
+		if 12+i*4+4 > len(stsz) {
+			break
+		}
+
+		sizes = append(sizes, binary.BigEndian.Uint32(stsz[12+i*4:]))
+	}
+
+	return sizes
+}
+
+func parseMp4SampleOffsets(stbl []byte, sizes []uint32) []int64 {
+	chunkOffsets := make([]int64, 0)
+
+	if stco := findMp4Atom(stbl, "stco"); len(stco) >= 8 {
+		count := int(binary.BigEndian.Uint32(stco[4:8]))
+		for i := 0; i < count && 8+i*4+4 <= len(stco); i++ {
+			chunkOffsets = append(chunkOffsets, int64(binary.BigEndian.Uint32(stco[8+i*4:])))
+		}
+	} else if co64 := findMp4Atom(stbl, "co64"); len(co64) >= 8 {
+		count := int(binary.BigEndian.Uint32(co64[4:8]))
+		for i := 0; i < count && 8+i*8+8 <= len(co64); i++ {
+			chunkOffsets = append(chunkOffsets, int64(binary.BigEndian.Uint64(co64[8+i*8:])))
+		}
+	}
+
+	// stsc entries give the amount of samples per chunk from their first chunk until the next entry
+	type chunkRun struct {
+		firstChunk      int
+		samplesPerChunk int
+	}
+
+	runs := make([]chunkRun, 0)
+
+	if stsc := findMp4Atom(stbl, "stsc"); len(stsc) >= 8 {
+		count := int(binary.BigEndian.Uint32(stsc[4:8]))
+		for i := 0; i < count && 8+i*12+12 <= len(stsc); i++ {
+			entry := stsc[8+i*12:]
+			runs = append(runs, chunkRun{
+				firstChunk:      int(binary.BigEndian.Uint32(entry[:4])),
+				samplesPerChunk: int(binary.BigEndian.Uint32(entry[4:8])),
+			})
+		}
+	}
+
+	offsets := make([]int64, 0, len(sizes))
+	run := 0
+
+	for chunk, chunkOffset := range chunkOffsets {
+		// chunks are numbered from 1
+		for run+1 < len(runs) && runs[run+1].firstChunk <= chunk+1 {
+			run++
+		}
+
+		samplesPerChunk := 1
+		if len(runs) > 0 {
+			samplesPerChunk = runs[run].samplesPerChunk
+		}
+
+		offset := chunkOffset
+
+		for n := 0; n < samplesPerChunk && len(offsets) < len(sizes); n++ {
+			offsets = append(offsets, offset)
+			offset += int64(sizes[len(offsets)-1])
+		}
+	}
+
+	return offsets
+}
+
+// A text sample is a 16 bit length followed by UTF-8 or UTF-16 text with a byte order mark
+func readMp4TextSample(r io.ReadSeeker, offset int64, size uint32) (string, error) {
+	if size < 2 || size > mp4MaxChapterSample {
+		return "", nil
+	}
+
+	_, err := r.Seek(offset, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	sample := make([]byte, size)
+
+	_, err = io.ReadFull(r, sample)
+	if err != nil {
+		return "", err
+	}
+
+	length := int(binary.BigEndian.Uint16(sample[:2]))
+	if 2+length > len(sample) {
+		length = len(sample) - 2
+	}
+
+	text := sample[2 : 2+length]
+
+	if len(text) >= 2 && text[0] == 0xfe && text[1] == 0xff {
+		units := make([]uint16, (len(text)-2)/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(text[2+i*2:])
+		}
+
+		return string(utf16.Decode(units)), nil
+	}
+
+	return string(text), nil
+}
+
+func (i mp4Info) text(kind string) string {
+	return string(i.Tags[kind])
+}
+
+// Index and total of trkn and disk, stored as 16 bit numbers after 2 reserved bytes
+func (i mp4Info) position(kind string) (int, int) {
+	value := i.Tags[kind]
+	if len(value) < 6 {
+		return 0, 0
+	}
+
+	return int(binary.BigEndian.Uint16(value[2:4])), int(binary.BigEndian.Uint16(value[4:6]))
+}
+
+func (i mp4Info) year() int {
+	date := i.text("\xa9day")
+	if len(date) > 4 {
+		date = date[:4]
+	}
+
+	year, _ := strconv.Atoi(date)
+
+	return year
+}
+
+func (i mp4Info) cover() []byte {
+	return i.Tags["covr"]
+}
+
+// Audiobook tools write the series in freeform tags, iTunes in the movement tags
+func (i mp4Info) series() string {
+	if series := i.text("----:SERIES"); series != "" {
+		return series
+	}
+
+	return i.text("\xa9mvn")
+}
+
+func (i mp4Info) volume() float64 {
+	if part := i.text("----:SERIES-PART"); part != "" {
+		return parseVolume(part)
+	}
+
+	if movement := i.Tags["\xa9mvi"]; len(movement) >= 2 {
+		return float64(binary.BigEndian.Uint16(movement[len(movement)-2:]))
+	}
+
+	return 0
+}
@@ -0,0 +1,299 @@
+package media
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	oggCapturePattern = "OggS"
+	oggPageHeaderSize = 27
+	// largest possible page, header with 255 segments of 255 bytes
+	oggMaxPageSize = oggPageHeaderSize + 255 + 255*255
+	// header packets carry the art, anything larger than this is not a valid header
+	oggMaxHeaderPacketSize = 32 << 20
+
+	oggCodecVorbis = "vorbis"
+	oggCodecOpus   = "opus"
+
+	// opus granule positions are always counted at 48kHz whatever the input rate was
+	opusGranuleRate = 48000
+)
+
+type oggPage struct {
+	granule  int64
+	serial   uint32
+	segments []byte
+	data     []byte
+}
+
+func readOggPage(r io.Reader) (*oggPage, error) {
+	header := make([]byte, oggPageHeaderSize)
+
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(header[:4]) != oggCapturePattern {
+		return nil, errors.New("invalid ogg page")
+	}
+
+	page := &oggPage{
+		granule:  int64(binary.LittleEndian.Uint64(header[6:14])),
+		serial:   binary.LittleEndian.Uint32(header[14:18]),
+		segments: make([]byte, header[26]),
+	}
+
+	_, err = io.ReadFull(r, page.segments)
+	if err != nil {
+		return nil, err
+	}
+
+	size := 0
+	for _, segment := range page.segments {
+		size += int(segment)
+	}
+
+	page.data = make([]byte, size)
+
+	_, err = io.ReadFull(r, page.data)
+	if err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// Reads the first packets of the first logical stream, header packets can span several pages
+func readOggHeaderPackets(r io.Reader, count int) ([][]byte, uint32, error) {
+	packets := make([][]byte, 0, count)
+	var current []byte
+	var serial uint32
+	first := true
+
+	for len(packets) < count {
+		page, err := readOggPage(r)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// pages of other streams, ie a video stream, are interleaved with the audio
+		if first {
+			serial = page.serial
+			first = false
+		} else if page.serial != serial {
+			continue
+		}
+
+		offset := 0
+		for _, segment := range page.segments {
+			current = append(current, page.data[offset:offset+int(segment)]...)
+			offset += int(segment)
+
+			if len(current) > oggMaxHeaderPacketSize {
+				return nil, 0, errors.New("ogg header packet is too large")
+			}
+
+			// a segment shorter than 255 bytes ends the packet
+			if segment < 255 {
+				packets = append(packets, current)
+				current = nil
+
+				if len(packets) == count {
+					break
+				}
+			}
+		}
+	}
+
+	return packets, serial, nil
+}
+
+// Granule position of the last page of the stream, it is the amount of samples in the stream
+func readOggLastGranule(r io.ReadSeeker, serial uint32) (int64, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	start := size - oggMaxPageSize
+	if start < 0 {
+		start = 0
+	}
+
+	_, err = r.Seek(start, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	tail, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	// search backwards for the last page of the stream with a granule position
+	for i := bytes.LastIndex(tail, []byte(oggCapturePattern)); i >= 0; i = bytes.LastIndex(tail[:i], []byte(oggCapturePattern)) {
+		if len(tail)-i < oggPageHeaderSize {
+			continue
+		}
+
+		header := tail[i : i+oggPageHeaderSize]
+		granule := int64(binary.LittleEndian.Uint64(header[6:14]))
+
+		// -1 marks pages where no packet ends
+		if binary.LittleEndian.Uint32(header[14:18]) == serial && granule != -1 {
+			return granule, nil
+		}
+	}
+
+	return 0, errors.New("no ogg page with a granule position found at the end of the stream")
+}
+
+type oggStreamInfo struct {
+	Codec      string
+	SampleRate int
+	Channels   int
+	// samples to discard at the start of an opus stream
+	PreSkip  int
+	Comments *vorbisComments
+	serial   uint32
+}
+
+// Reads the identification and comment headers of the first stream
+func readOggStreamInfo(r io.Reader) (info oggStreamInfo, err error) {
+	packets, serial, err := readOggHeaderPackets(r, 2)
+	if err != nil {
+		return
+	}
+
+	info.serial = serial
+	identification, comment := packets[0], packets[1]
+
+	switch {
+	case bytes.HasPrefix(identification, []byte("\x01vorbis")) && len(identification) >= 16:
+		info.Codec = oggCodecVorbis
+		info.Channels = int(identification[11])
+		info.SampleRate = int(binary.LittleEndian.Uint32(identification[12:16]))
+
+		if !bytes.HasPrefix(comment, []byte("\x03vorbis")) {
+			err = errors.New("missing vorbis comment header")
+			return
+		}
+
+		comment = comment[len("\x03vorbis"):]
+	case bytes.HasPrefix(identification, []byte("OpusHead")) && len(identification) >= 16:
+		info.Codec = oggCodecOpus
+		info.Channels = int(identification[9])
+		info.PreSkip = int(binary.LittleEndian.Uint16(identification[10:12]))
+		info.SampleRate = int(binary.LittleEndian.Uint32(identification[12:16]))
+
+		if !bytes.HasPrefix(comment, []byte("OpusTags")) {
+			err = errors.New("missing opus tags header")
+			return
+		}
+
+		comment = comment[len("OpusTags"):]
+	default:
+		err = errors.New("ogg stream is neither vorbis nor opus")
+		return
+	}
+
+	info.Comments, err = parseVorbisComments(comment)
+
+	return
+}
+
+// Duration of the stream in seconds from the granule position of its last page
+func (i oggStreamInfo) length(lastGranule int64) float64 {
+	if i.Codec == oggCodecOpus {
+		samples := lastGranule - int64(i.PreSkip)
+		if samples < 0 {
+			return 0
+		}
+
+		return float64(samples) / opusGranuleRate
+	}
+
+	if i.SampleRate == 0 {
+		return 0
+	}
+
+	return float64(lastGranule) / float64(i.SampleRate)
+}
+
+// First value of the comment with this key, keys are case insensitive
+func (c *vorbisComments) get(keys ...string) string {
+	for _, key := range keys {
+		for _, comment := range c.comments {
+			name, value, ok := strings.Cut(comment, "=")
+			if ok && strings.EqualFold(name, key) {
+				return value
+			}
+		}
+	}
+
+	return ""
+}
+
+// Reads a "3" or "3/12" style position, the total comes from totalKeys when the value has none
+func (c *vorbisComments) position(key string, totalKeys ...string) (int, int) {
+	index, total, _ := strings.Cut(c.get(key), "/")
+
+	if total == "" {
+		total = c.get(totalKeys...)
+	}
+
+	indexValue, _ := strconv.Atoi(strings.TrimSpace(index))
+	totalValue, _ := strconv.Atoi(strings.TrimSpace(total))
+
+	return indexValue, totalValue
+}
+
+func (c *vorbisComments) year() int {
+	date := c.get("DATE", "YEAR")
+	if len(date) > 4 {
+		date = date[:4]
+	}
+
+	year, _ := strconv.Atoi(date)
+
+	return year
+}
+
+// Art stored as base64 encoded flac picture blocks, the front cover is preferred
+func (c *vorbisComments) picture() []byte {
+	var fallback []byte
+
+	for _, comment := range c.comments {
+		name, value, ok := strings.Cut(comment, "=")
+		if !ok || !strings.EqualFold(name, "METADATA_BLOCK_PICTURE") {
+			continue
+		}
+
+		block, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+
+		pictureType, data, err := parseFlacPicture(block)
+		if err != nil || len(data) == 0 {
+			continue
+		}
+
+		if pictureType == id3FrontCover {
+			return data
+		}
+
+		if fallback == nil {
+			fallback = data
+		}
+	}
+
+	return fallback
+}
@@ -0,0 +1,378 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/egfanboy/mediapire-common/exceptions"
+	"github.com/egfanboy/mediapire-media-host/internal/utils"
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
+)
+
+var (
+	// {field}, numbers can be padded to a number of digits with {field:0N}
+	organiseTemplateField = regexp.MustCompile(`\{([a-z]+)(?::0(\d+))?\}`)
+	// characters that cannot be part of a file name on at least one platform
+	unsafePathCharacters = regexp.MustCompile(`[<>:"/\\|?*\x00-\x1f]`)
+)
+
+// Text fields of the template, missing values fall back to a placeholder so the item can still be organised
+var organiseTextFields = map[string]func(item types.MediaItem, info trackInfo) string{
+	"albumartist": func(item types.MediaItem, info trackInfo) string {
+		return firstNonEmpty(info.AlbumArtist, info.Artist, "Unknown Artist")
+	},
+	"artist": func(item types.MediaItem, info trackInfo) string { return firstNonEmpty(info.Artist, "Unknown Artist") },
+	"album":  func(item types.MediaItem, info trackInfo) string { return firstNonEmpty(info.Album, "Unknown Album") },
+	"title":  func(item types.MediaItem, info trackInfo) string { return firstNonEmpty(info.Title, item.Name) },
+	"genre":  func(item types.MediaItem, info trackInfo) string { return firstNonEmpty(info.Genre, "Unknown Genre") },
+	"name":   func(item types.MediaItem, info trackInfo) string { return item.Name },
+	"ext":    func(item types.MediaItem, info trackInfo) string { return item.Extension },
+}
+
+// Number fields of the template, items without the value cannot be organised, tracks without a disc are on the first one
+var organiseNumberFields = map[string]func(info trackInfo) int{
+	"year": func(info trackInfo) int { return info.Year },
+	"disc": func(info trackInfo) int {
+		if info.DiscIndex <= 0 {
+			return 1
+		}
+
+		return info.DiscIndex
+	},
+	"track": func(info trackInfo) int { return info.TrackIndex },
+}
+
+// only one organise run moves files at a time
+var organiseMu sync.Mutex
+
+// Failed step of a move, reason is returned to clients while the error can contain paths of the host and is only logged
+type organiseError struct {
+	reason string
+	err    error
+}
+
+func (e *organiseError) Error() string {
+	return fmt.Sprintf("%s: %v", e.reason, e.err)
+}
+
+func (e *organiseError) Unwrap() error {
+	return e.err
+}
+
+// Message safe to report for a failed move
+func getOrganiseErrorReason(err error) string {
+	var organiseErr *organiseError
+	if errors.As(err, &organiseErr) {
+		return organiseErr.reason
+	}
+
+	return "could not move file"
+}
+
+// Item and the path the template gives it
+type organiseStep struct {
+	item   types.MediaItem
+	root   string
+	target string
+	// files that follow the item, see findItemSidecars
+	sidecars []string
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if strings.TrimSpace(value) != "" {
+			return strings.TrimSpace(value)
+		}
+	}
+
+	return ""
+}
+
+func validateOrganiseTemplate(template string) error {
+	if strings.TrimSpace(template) == "" {
+		return &exceptions.ApiException{StatusCode: http.StatusBadRequest, Err: errors.New("template cannot be empty")}
+	}
+
+	if strings.HasPrefix(template, "/") || filepath.IsAbs(template) {
+		return &exceptions.ApiException{StatusCode: http.StatusBadRequest, Err: errors.New("template must be relative to the directory of the items")}
+	}
+
+	for _, match := range organiseTemplateField.FindAllStringSubmatch(template, -1) {
+		_, isText := organiseTextFields[match[1]]
+		_, isNumber := organiseNumberFields[match[1]]
+
+		if !isText && !isNumber {
+			return &exceptions.ApiException{StatusCode: http.StatusBadRequest, Err: fmt.Errorf("unsupported template field %q", match[1])}
+		}
+	}
+
+	// the extension is how files are recognised as media
+	if !strings.HasSuffix(template, ".{ext}") {
+		return &exceptions.ApiException{StatusCode: http.StatusBadRequest, Err: errors.New("template must end with .{ext}")}
+	}
+
+	for _, segment := range strings.Split(template, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return &exceptions.ApiException{StatusCode: http.StatusBadRequest, Err: fmt.Errorf("template cannot contain empty, . or .. folders")}
+		}
+	}
+
+	return nil
+}
+
+/*
+** Path of the item relative to its directory, ie {albumartist}/{album}/{track:02} {title}.{ext}. Values are made safe
+** to use in a file name so only the separators of the template create folders.
+ */
+func renderOrganiseTemplate(template string, item types.MediaItem) (string, error) {
+	info, _ := getTrackInfo(item)
+
+	var missing error
+
+	rendered := organiseTemplateField.ReplaceAllStringFunc(template, func(match string) string {
+		parts := organiseTemplateField.FindStringSubmatch(match)
+
+		if getText, ok := organiseTextFields[parts[1]]; ok {
+			return unsafePathCharacters.ReplaceAllString(getText(item, info), "_")
+		}
+
+		value := organiseNumberFields[parts[1]](info)
+		if value <= 0 && missing == nil {
+			missing = fmt.Errorf("item has no %s", parts[1])
+		}
+
+		width, _ := strconv.Atoi(parts[2])
+
+		return fmt.Sprintf("%0*d", width, value)
+	})
+
+	if missing != nil {
+		return "", missing
+	}
+
+	segments := strings.Split(rendered, "/")
+	for i, segment := range segments {
+		// trailing dots and spaces are dropped by some platforms
+		segment = strings.TrimRight(strings.TrimSpace(segment), ". ")
+		if segment == "" {
+			segment = "_"
+		}
+
+		segments[i] = segment
+	}
+
+	return filepath.Join(segments...), nil
+}
+
+func isSameFile(a string, b string) bool {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(infoA, infoB)
+}
+
+/*
+** Plans where the template puts each item. Items whose path cannot be rendered, items going to the same path
+** and items whose path is taken by another file are conflicts and are left where they are. The same goes for the
+** paths of their sidecars and for sidecars that belong to more than one item, ie Song.lrc of Song.mp3 and Song.flac.
+ */
+func planOrganise(items []types.MediaItem, template string, directories []string) ([]organiseStep, types.OrganisePlan) {
+	plan := types.OrganisePlan{Moves: make([]types.OrganiseMove, 0), Conflicts: make([]types.OrganiseConflict, 0)}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Path < items[j].Path
+	})
+
+	candidates := make([]organiseStep, 0)
+	// case insensitive target -> number of items and sidecars going there, some file systems ignore case
+	targets := make(map[string]int)
+	// sidecar -> number of items it belongs to, items that are not moved count too since they would lose it
+	sidecarOwners := make(map[string]int)
+
+	for _, item := range items {
+		root, from, ok := findRootDirectory(directories, item.Path)
+		if !ok {
+			continue
+		}
+
+		sidecars := findItemSidecars(item)
+		for _, sidecar := range sidecars {
+			sidecarOwners[sidecar]++
+		}
+
+		relTarget, err := renderOrganiseTemplate(template, item)
+		if err != nil {
+			plan.Conflicts = append(plan.Conflicts, types.OrganiseConflict{MediaId: item.Id, From: filepath.ToSlash(from), Reason: err.Error()})
+			continue
+		}
+
+		target := filepath.Join(root, relTarget)
+		if target == item.Path {
+			plan.Unchanged++
+			continue
+		}
+
+		step := organiseStep{item: item, root: root, target: target, sidecars: sidecars}
+
+		targets[strings.ToLower(target)]++
+		for _, sidecar := range sidecars {
+			targets[strings.ToLower(getMovedSidecarPath(sidecar, item, target))]++
+		}
+
+		candidates = append(candidates, step)
+	}
+
+	steps := make([]organiseStep, 0, len(candidates))
+
+	for _, candidate := range candidates {
+		from, _ := filepath.Rel(candidate.root, candidate.item.Path)
+		to, _ := filepath.Rel(candidate.root, candidate.target)
+
+		if reason := getOrganiseConflictReason(candidate, targets, sidecarOwners); reason != "" {
+			plan.Conflicts = append(plan.Conflicts, types.OrganiseConflict{
+				MediaId: candidate.item.Id,
+				From:    filepath.ToSlash(from),
+				To:      filepath.ToSlash(to),
+				Reason:  reason,
+			})
+
+			continue
+		}
+
+		plan.Moves = append(plan.Moves, types.OrganiseMove{MediaId: candidate.item.Id, From: filepath.ToSlash(from), To: filepath.ToSlash(to)})
+		steps = append(steps, candidate)
+	}
+
+	return steps, plan
+}
+
+// Why the step cannot be done, empty when none of its paths are taken or wanted by anything else
+func getOrganiseConflictReason(step organiseStep, targets map[string]int, sidecarOwners map[string]int) string {
+	if targets[strings.ToLower(step.target)] > 1 {
+		return "other items would have the same path"
+	}
+
+	if fileExists(step.target) && !isSameFile(step.target, step.item.Path) {
+		return "another file already has this path"
+	}
+
+	for _, sidecar := range step.sidecars {
+		if sidecarOwners[sidecar] > 1 {
+			return "its lyrics or subtitles belong to other items too"
+		}
+
+		sidecarTarget := getMovedSidecarPath(sidecar, step.item, step.target)
+
+		if targets[strings.ToLower(sidecarTarget)] > 1 {
+			return "its lyrics or subtitles would have the same path as other files"
+		}
+
+		if fileExists(sidecarTarget) && !isSameFile(sidecarTarget, sidecar) {
+			return "another file already has the path of its lyrics or subtitles"
+		}
+	}
+
+	return ""
+}
+
+// Files named after the item that belong to it, ie its lyrics and subtitles, they follow it when it is moved
+func findItemSidecars(item types.MediaItem) []string {
+	sidecars := make([]string, 0)
+
+	if lyricsPath := getLyricsSidecarPath(item.Path); fileExists(lyricsPath) {
+		sidecars = append(sidecars, lyricsPath)
+	}
+
+	if !videoExtensions[item.Extension] {
+		return sidecars
+	}
+
+	subtitles, err := findSubtitleSidecars(item)
+	if err != nil {
+		return sidecars
+	}
+
+	for _, subtitle := range subtitles {
+		subtitlePath := filepath.Join(item.ParentDir, subtitle.FileName)
+		if !utils.Contains(sidecars, subtitlePath) {
+			sidecars = append(sidecars, subtitlePath)
+		}
+	}
+
+	return sidecars
+}
+
+// Path of a sidecar once its item is at target, the part after the name of the item is kept
+func getMovedSidecarPath(sidecar string, item types.MediaItem, target string) string {
+	oldBase := strings.TrimSuffix(filepath.Base(item.Path), filepath.Ext(item.Path))
+	newBase := strings.TrimSuffix(filepath.Base(target), filepath.Ext(target))
+
+	return filepath.Join(filepath.Dir(target), newBase+strings.TrimPrefix(filepath.Base(sidecar), oldBase))
+}
+
+/*
+** Renames the file without replacing anything at dst, fs.ErrExist is returned when dst is taken. dst is created
+** exclusively first so a file that appears after planning is kept, the rename then only replaces that empty file.
+** The file is copied then removed when the target is on another file system.
+ */
+func moveFile(src string, dst string) error {
+	// the same file with another case on a file system that ignores case
+	if isSameFile(src, dst) {
+		return os.Rename(src, dst)
+	}
+
+	reserved, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+
+	reserved.Close()
+
+	err = os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, syscall.EXDEV) {
+		err = copyFile(src, dst)
+	}
+
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	return os.Remove(src)
+}
+
+// Removes the directory and its parents up to root as long as they are empty
+func removeEmptyDirectories(dir string, root string) {
+	for dir != root && isPathWithin(dir, root) {
+		entries, err := os.ReadDir(dir)
+		if err != nil || len(entries) > 0 {
+			return
+		}
+
+		if os.Remove(dir) != nil {
+			return
+		}
+
+		dir = filepath.Dir(dir)
+	}
+}
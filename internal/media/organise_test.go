@@ -0,0 +1,301 @@
+package media
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
+)
+
+const testOrganiseTemplate = "{albumartist}/{album}/{track:02} {title}.{ext}"
+
+func writeOrganiseTestItem(t *testing.T, dir string, fileName string, metadata Mp3Metadata) types.MediaItem {
+	t.Helper()
+
+	path := filepath.Join(dir, fileName)
+
+	err := os.WriteFile(path, fakeAudio, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ext := filepath.Ext(fileName)
+
+	return types.MediaItem{
+		Id:        fileName,
+		Name:      strings.TrimSuffix(fileName, ext),
+		Extension: strings.TrimPrefix(ext, "."),
+		Path:      path,
+		ParentDir: dir,
+		Metadata:  metadata,
+	}
+}
+
+func getOrganiseConflicts(plan types.OrganisePlan) map[string]string {
+	conflicts := make(map[string]string)
+	for _, conflict := range plan.Conflicts {
+		conflicts[conflict.MediaId] = conflict.Reason
+	}
+
+	return conflicts
+}
+
+func TestValidateOrganiseTemplate(t *testing.T) {
+	tests := map[string]bool{
+		testOrganiseTemplate:        true,
+		"{artist} - {title}.{ext}":  true,
+		"{disc:02}/{name}.{ext}":    true,
+		"":                          false,
+		"  ":                        false,
+		"/music/{title}.{ext}":      false,
+		"{unknown}/{title}.{ext}":   false,
+		"{artist}/{title}.mp3":      false,
+		"{artist}//{title}.{ext}":   false,
+		"{artist}/../{title}.{ext}": false,
+		"./{artist}/{title}.{ext}":  false,
+		"{artist}/./{title}.{ext}":  false,
+	}
+
+	for template, valid := range tests {
+		err := validateOrganiseTemplate(template)
+		if valid != (err == nil) {
+			t.Errorf("template %q: expected valid to be %v, got %v", template, valid, err)
+		}
+	}
+}
+
+func TestRenderOrganiseTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		metadata Mp3Metadata
+		want     string
+		wantErr  bool
+	}{
+		{name: "padding", template: testOrganiseTemplate, metadata: Mp3Metadata{Artist: "Band", Album: "Album", Title: "Song", TrackIndex: 3}, want: "Band/Album/03 Song.mp3"},
+		{name: "wider than padding", template: "{track:02}.{ext}", metadata: Mp3Metadata{TrackIndex: 123}, want: "123.mp3"},
+		{name: "missing values", template: testOrganiseTemplate, metadata: Mp3Metadata{TrackIndex: 1}, want: "Unknown Artist/Unknown Album/01 Name.mp3"},
+		{name: "disc defaults to the first", template: "{disc}-{track}.{ext}", metadata: Mp3Metadata{TrackIndex: 2}, want: "1-2.mp3"},
+		{name: "missing track", template: testOrganiseTemplate, metadata: Mp3Metadata{Title: "Song"}, wantErr: true},
+		{name: "missing year", template: "{year}/{title}.{ext}", metadata: Mp3Metadata{Title: "Song"}, wantErr: true},
+		{name: "unsafe characters", template: "{artist}/{title}.{ext}", metadata: Mp3Metadata{Artist: "AC/DC", Title: `What? "Yes": <No>`}, want: "AC_DC/What_ _Yes__ _No_.mp3"},
+		{name: "dot folders", template: "{artist}/{album}/{title}.{ext}", metadata: Mp3Metadata{Artist: "..", Album: "Album. ", Title: "Song"}, want: "_/Album/Song.mp3"},
+	}
+
+	for _, test := range tests {
+		item := types.MediaItem{Name: "Name", Extension: "mp3", Metadata: test.metadata}
+
+		got, err := renderOrganiseTemplate(test.template, item)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", test.name, got)
+			}
+
+			continue
+		}
+
+		if err != nil || got != filepath.FromSlash(test.want) {
+			t.Errorf("%s: expected %q, got %q (%v)", test.name, test.want, got, err)
+		}
+	}
+}
+
+func TestPlanOrganiseConflicts(t *testing.T) {
+	dir := t.TempDir()
+
+	items := []types.MediaItem{
+		writeOrganiseTestItem(t, dir, "moved.mp3", Mp3Metadata{Artist: "Band", Album: "Album", Title: "Moved", TrackIndex: 1}),
+		writeOrganiseTestItem(t, dir, "untagged.mp3", Mp3Metadata{Title: "Untagged"}),
+		// only the case of the artist differs
+		writeOrganiseTestItem(t, dir, "upper.mp3", Mp3Metadata{Artist: "Band", Album: "Album", Title: "Same", TrackIndex: 2}),
+		writeOrganiseTestItem(t, dir, "lower.mp3", Mp3Metadata{Artist: "band", Album: "album", Title: "same", TrackIndex: 2}),
+		writeOrganiseTestItem(t, dir, "taken.mp3", Mp3Metadata{Artist: "Band", Album: "Album", Title: "Taken", TrackIndex: 3}),
+		// share Shared.lrc
+		writeOrganiseTestItem(t, dir, "Shared.mp3", Mp3Metadata{Artist: "Band", Album: "Album", Title: "Shared", TrackIndex: 4}),
+		writeOrganiseTestItem(t, dir, "Shared.flac", Mp3Metadata{Artist: "Band", Album: "Other", Title: "Shared", TrackIndex: 4}),
+		// the target of its lyrics is taken
+		writeOrganiseTestItem(t, dir, "lyrics.mp3", Mp3Metadata{Artist: "Band", Album: "Album", Title: "Lyrics", TrackIndex: 5}),
+	}
+
+	for _, name := range []string{"Shared.lrc", "lyrics.lrc", "Band/Album/03 Taken.mp3", "Band/Album/05 Lyrics.lrc"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+
+		err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err == nil {
+			err = os.WriteFile(path, []byte("other"), 0644)
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	steps, plan := planOrganise(items, testOrganiseTemplate, []string{dir})
+
+	if len(steps) != 1 || steps[0].item.Id != "moved.mp3" || steps[0].target != filepath.Join(dir, "Band", "Album", "01 Moved.mp3") {
+		t.Fatalf("only moved.mp3 should be moved, got %+v", plan.Moves)
+	}
+
+	want := map[string]string{
+		"untagged.mp3": "item has no track",
+		"upper.mp3":    "other items would have the same path",
+		"lower.mp3":    "other items would have the same path",
+		"taken.mp3":    "another file already has this path",
+		"Shared.mp3":   "its lyrics or subtitles belong to other items too",
+		"Shared.flac":  "its lyrics or subtitles belong to other items too",
+		"lyrics.mp3":   "another file already has the path of its lyrics or subtitles",
+	}
+
+	conflicts := getOrganiseConflicts(plan)
+	if len(conflicts) != len(want) {
+		t.Fatalf("expected %d conflicts, got %v", len(want), conflicts)
+	}
+
+	for id, reason := range want {
+		if conflicts[id] != reason {
+			t.Errorf("%s: expected conflict %q, got %q", id, reason, conflicts[id])
+		}
+	}
+}
+
+func TestPlanOrganiseSidecarTargetConflicts(t *testing.T) {
+	dir := t.TempDir()
+
+	items := []types.MediaItem{
+		writeOrganiseTestItem(t, dir, "a.mp3", Mp3Metadata{Artist: "Band", Album: "Album", Title: "Song", TrackIndex: 1}),
+		writeOrganiseTestItem(t, dir, "b.flac", Mp3Metadata{Artist: "Band", Album: "Album", Title: "Song", TrackIndex: 1}),
+	}
+
+	for _, name := range []string{"a.lrc", "b.lrc"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("lyrics"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the items go to different files but their lyrics would both be 01 Song.lrc
+	steps, plan := planOrganise(items, testOrganiseTemplate, []string{dir})
+
+	if len(steps) != 0 || len(plan.Conflicts) != 2 {
+		t.Fatalf("expected both items to conflict, got %+v", plan)
+	}
+
+	for id, reason := range getOrganiseConflicts(plan) {
+		if reason != "its lyrics or subtitles would have the same path as other files" {
+			t.Errorf("%s: got conflict %q", id, reason)
+		}
+	}
+}
+
+func TestMoveFileKeepsExistingFile(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src.mp3"), filepath.Join(dir, "dst.mp3")
+
+	for path, content := range map[string]string{src: "src", dst: "dst"} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := moveFile(src, dst)
+	if !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("expected the target to be reported as taken, got %v", err)
+	}
+
+	if string(readTestFile(t, src)) != "src" || string(readTestFile(t, dst)) != "dst" {
+		t.Fatal("neither file should change")
+	}
+
+	moved := filepath.Join(dir, "Folder", "moved.mp3")
+	if err := os.MkdirAll(filepath.Dir(moved), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := moveFile(src, moved); err != nil {
+		t.Fatal(err)
+	}
+
+	if fileExists(src) || string(readTestFile(t, moved)) != "src" {
+		t.Fatal("file should be at its new path only")
+	}
+}
+
+func TestMoveItemKeepsId(t *testing.T) {
+	// the index is not loaded from the base path of the app
+	indexOnce.Do(func() {
+		index = &mediaIndex{
+			entries:       make(map[string]mediaIndexEntry),
+			byInode:       make(map[uint64]string),
+			byFingerprint: make(map[string]string),
+		}
+	})
+
+	dir := t.TempDir()
+	item := writeOrganiseTestItem(t, dir, "song.mp3", Mp3Metadata{Artist: "Band", Album: "Album", Title: "Song", TrackIndex: 1})
+
+	lyrics := filepath.Join(dir, "song.lrc")
+	if err := os.WriteFile(lyrics, []byte("lyrics"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(item.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getMediaIndex().Add(item, info)
+
+	steps, _ := planOrganise([]types.MediaItem{item}, testOrganiseTemplate, []string{dir})
+	if len(steps) != 1 {
+		t.Fatalf("expected one move, got %d", len(steps))
+	}
+
+	moved, err := (&mediaService{}).moveItem(steps[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(dir, "Band", "Album", "01 Song.mp3")
+
+	if moved.Id != item.Id || moved.Path != target || moved.Name != "01 Song" {
+		t.Fatalf("got item %+v", moved)
+	}
+
+	if fileExists(item.Path) || fileExists(lyrics) || !fileExists(getLyricsSidecarPath(target)) {
+		t.Fatal("the file and its lyrics should have moved")
+	}
+
+	if entry, ok := getMediaIndex().Entry(target); !ok || entry.Id != item.Id {
+		t.Fatalf("indexed entry should keep the id, got %+v", entry)
+	}
+
+	if cached, ok := mediaLookup.GetKey(item.Id); !ok || cached.Path != target {
+		t.Fatalf("lookup should have the new path, got %+v", cached)
+	}
+}
+
+func TestOrganiseErrorReasonHidesPaths(t *testing.T) {
+	dir := t.TempDir()
+
+	err := moveFile(filepath.Join(dir, "missing.mp3"), filepath.Join(dir, "Artist", "missing.mp3"))
+	if err == nil {
+		t.Fatal("moving a missing file should fail")
+	}
+
+	wrapped := &organiseError{reason: "could not move file", err: err}
+
+	if reason := getOrganiseErrorReason(wrapped); reason != "could not move file" {
+		t.Fatalf("got reason %q", reason)
+	}
+
+	if !strings.Contains(wrapped.Error(), dir) {
+		t.Fatal("the logged error should keep the paths")
+	}
+
+	if reason := getOrganiseErrorReason(err); strings.Contains(reason, dir) {
+		t.Fatalf("unexpected errors should not be reported as is, got %q", reason)
+	}
+}
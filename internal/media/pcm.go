@@ -0,0 +1,232 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/dhowden/tag"
+)
+
+const (
+	pcmChunkHeaderSize = 8
+	// tag chunks are read in memory, anything larger is skipped
+	pcmMaxTagChunkSize = 32 << 20
+
+	pcmFormatWav  = "wav"
+	pcmFormatAiff = "aiff"
+)
+
+// Tags of the RIFF LIST/INFO chunk
+var riffInfoFields = map[string]string{
+	"INAM": "title",
+	"IART": "artist",
+	"IPRD": "album",
+	"IGNR": "genre",
+	"ICRD": "date",
+	"ITRK": "track",
+	"IPRT": "track",
+}
+
+// Text chunks of AIFF files
+var aiffTextFields = map[string]string{
+	"NAME": "title",
+	"AUTH": "artist",
+}
+
+type pcmInfo struct {
+	// wav or aiff
+	Format     string
+	SampleRate int
+	BitDepth   int
+	Channels   int
+	Length     float64
+	// tags from LIST/INFO or AIFF text chunks
+	Text map[string]string
+	// tags from an embedded id3 chunk, nil when there is none
+	Id3 tag.Metadata
+}
+
+/*
+** Reads the chunks of a RIFF WAVE or an IFF AIFF/AIFC file. RIFF sizes are little endian and IFF sizes big
+** endian, both pad chunks to an even size. The audio data is skipped, only its size is needed for the duration.
+ */
+func readPcmInfo(r io.ReadSeeker) (info pcmInfo, err error) {
+	header := make([]byte, 12)
+
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return
+	}
+
+	var order binary.ByteOrder
+
+	switch {
+	case string(header[:4]) == "RIFF" && string(header[8:12]) == "WAVE":
+		order = binary.LittleEndian
+		info.Format = pcmFormatWav
+	case string(header[:4]) == "FORM" && (string(header[8:12]) == "AIFF" || string(header[8:12]) == "AIFC"):
+		order = binary.BigEndian
+		info.Format = pcmFormatAiff
+	default:
+		err = errors.New("file is neither a RIFF WAVE nor an AIFF file")
+		return
+	}
+
+	info.Text = make(map[string]string)
+
+	var byteRate int
+	var dataSize int64
+	var sampleFrames uint32
+	chunkHeader := make([]byte, pcmChunkHeaderSize)
+
+	for {
+		_, err = io.ReadFull(r, chunkHeader)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				err = nil
+				break
+			}
+
+			return
+		}
+
+		id := string(chunkHeader[:4])
+		size := int64(order.Uint32(chunkHeader[4:8]))
+		padded := size + size%2
+
+		switch {
+		case id == "fmt " || id == "COMM" || id == "LIST" || strings.EqualFold(id, "id3 ") || aiffTextFields[id] != "":
+			if size > pcmMaxTagChunkSize {
+				_, err = r.Seek(padded, io.SeekCurrent)
+				if err != nil {
+					return
+				}
+
+				continue
+			}
+
+			chunk := make([]byte, size)
+
+			_, err = io.ReadFull(r, chunk)
+			if err != nil {
+				return
+			}
+
+			_, err = r.Seek(padded-size, io.SeekCurrent)
+			if err != nil {
+				return
+			}
+
+			switch {
+			case id == "fmt " && len(chunk) >= 16:
+				info.Channels = int(order.Uint16(chunk[2:4]))
+				info.SampleRate = int(order.Uint32(chunk[4:8]))
+				byteRate = int(order.Uint32(chunk[8:12]))
+				info.BitDepth = int(order.Uint16(chunk[14:16]))
+			case id == "COMM" && len(chunk) >= 18:
+				info.Channels = int(order.Uint16(chunk[0:2]))
+				sampleFrames = order.Uint32(chunk[2:6])
+				info.BitDepth = int(order.Uint16(chunk[6:8]))
+				info.SampleRate = int(decodeExtendedFloat(chunk[8:18]))
+			case id == "LIST" && len(chunk) >= 4 && string(chunk[:4]) == "INFO":
+				parseRiffInfo(chunk[4:], info.Text)
+			case strings.EqualFold(id, "id3 "):
+				// tags are optional, a broken id3 chunk should not fail the whole file
+				if m, err := tag.ReadID3v2Tags(bytes.NewReader(chunk)); err == nil {
+					info.Id3 = m
+				}
+			case aiffTextFields[id] != "":
+				info.Text[aiffTextFields[id]] = strings.TrimRight(string(chunk), "\x00 ")
+			}
+		default:
+			if id == "data" || id == "SSND" {
+				dataSize = size
+			}
+
+			_, err = r.Seek(padded, io.SeekCurrent)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	if info.Format == pcmFormatAiff {
+		if info.SampleRate > 0 {
+			info.Length = float64(sampleFrames) / float64(info.SampleRate)
+		}
+
+		return
+	}
+
+	if byteRate > 0 {
+		info.Length = float64(dataSize) / float64(byteRate)
+	}
+
+	return
+}
+
+func parseRiffInfo(data []byte, text map[string]string) {
+	for len(data) >= pcmChunkHeaderSize {
+		id := string(data[:4])
+		size := int(binary.LittleEndian.Uint32(data[4:8]))
+		data = data[pcmChunkHeaderSize:]
+
+		if size > len(data) {
+			return
+		}
+
+		if field, ok := riffInfoFields[id]; ok {
+			if _, set := text[field]; !set {
+				text[field] = strings.TrimRight(string(data[:size]), "\x00 ")
+			}
+		}
+
+		if size%2 == 1 && size < len(data) {
+			size++
+		}
+
+		data = data[size:]
+	}
+}
+
+// Sample rate of AIFF files is an 80 bit IEEE 754 extended precision number
+func decodeExtendedFloat(b []byte) float64 {
+	exponent := int(binary.BigEndian.Uint16(b[0:2]) & 0x7fff)
+	mantissa := binary.BigEndian.Uint64(b[2:10])
+
+	if exponent == 0 && mantissa == 0 {
+		return 0
+	}
+
+	value := float64(mantissa) * math.Pow(2, float64(exponent-16383-63))
+	if b[0]&0x80 != 0 {
+		value = -value
+	}
+
+	return value
+}
+
+func (i pcmInfo) track() (int, int) {
+	index, total, _ := strings.Cut(i.Text["track"], "/")
+
+	indexValue, _ := strconv.Atoi(strings.TrimSpace(index))
+	totalValue, _ := strconv.Atoi(strings.TrimSpace(total))
+
+	return indexValue, totalValue
+}
+
+func (i pcmInfo) year() int {
+	date := i.Text["date"]
+	if len(date) > 4 {
+		date = date[:4]
+	}
+
+	year, _ := strconv.Atoi(date)
+
+	return year
+}
@@ -0,0 +1,343 @@
+package media
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
+)
+
+type searchField uint8
+
+const (
+	searchFieldName searchField = 1 << iota
+	searchFieldArtist
+	searchFieldAlbum
+	searchFieldGenre
+)
+
+// How much a match in each field contributes to the score of an item
+var searchFieldWeights = map[searchField]float64{
+	searchFieldName:   3,
+	searchFieldArtist: 2,
+	searchFieldAlbum:  2,
+	searchFieldGenre:  1,
+}
+
+// Prefixes that restrict a search term to a field, ie artist:blue
+var searchFieldPrefixes = map[string]searchField{
+	"title":  searchFieldName,
+	"artist": searchFieldArtist,
+	"album":  searchFieldAlbum,
+	"genre":  searchFieldGenre,
+}
+
+const (
+	allSearchFields = searchFieldName | searchFieldArtist | searchFieldAlbum | searchFieldGenre
+	// a term matching a whole token is worth more than one only matching the start of it
+	exactMatchBoost = 2
+)
+
+type searchTerm struct {
+	value  string
+	fields searchField
+}
+
+type searchResult struct {
+	item  types.MediaItem
+	score float64
+}
+
+// In-memory inverted index from folded tokens to the items containing them
+type searchIndex struct {
+	mu sync.Mutex
+	// token -> item id -> fields containing the token
+	postings map[string]map[string]searchField
+	// item id -> tokens of the item, used to remove an item from postings
+	itemTokens map[string][]string
+	items      map[string]types.MediaItem
+	// sorted tokens for prefix lookups, rebuilt lazily after changes
+	terms      []string
+	termsDirty bool
+}
+
+var mediaSearchIndex = &searchIndex{
+	postings:   make(map[string]map[string]searchField),
+	itemTokens: make(map[string][]string),
+	items:      make(map[string]types.MediaItem),
+}
+
+// Adds or replaces an item in the index
+func (i *searchIndex) Add(item types.MediaItem) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.remove(item.Id)
+
+	fieldValues := map[searchField]string{searchFieldName: item.Name}
+
+	if info, ok := getTrackInfo(item); ok {
+		fieldValues[searchFieldArtist] = info.Artist + " " + info.AlbumArtist
+		fieldValues[searchFieldAlbum] = info.Album
+		fieldValues[searchFieldGenre] = info.Genre
+
+		if info.Title != "" {
+			fieldValues[searchFieldName] = info.Title
+		}
+	}
+
+	itemFields := make(map[string]searchField)
+
+	for field, value := range fieldValues {
+		for _, token := range tokenize(value) {
+			itemFields[token] |= field
+		}
+	}
+
+	tokens := make([]string, 0, len(itemFields))
+
+	for token, fields := range itemFields {
+		postings, ok := i.postings[token]
+		if !ok {
+			postings = make(map[string]searchField)
+			i.postings[token] = postings
+			i.termsDirty = true
+		}
+
+		postings[item.Id] = fields
+		tokens = append(tokens, token)
+	}
+
+	i.itemTokens[item.Id] = tokens
+	i.items[item.Id] = item
+}
+
+func (i *searchIndex) Remove(id string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.remove(id)
+}
+
+func (i *searchIndex) remove(id string) {
+	for _, token := range i.itemTokens[id] {
+		postings := i.postings[token]
+		delete(postings, id)
+
+		if len(postings) == 0 {
+			delete(i.postings, token)
+			i.termsDirty = true
+		}
+	}
+
+	delete(i.itemTokens, id)
+	delete(i.items, id)
+}
+
+// Returns the tokens starting with prefix
+func (i *searchIndex) tokensWithPrefix(prefix string) []string {
+	if i.termsDirty {
+		i.terms = make([]string, 0, len(i.postings))
+		for token := range i.postings {
+			i.terms = append(i.terms, token)
+		}
+
+		sort.Strings(i.terms)
+		i.termsDirty = false
+	}
+
+	start := sort.SearchStrings(i.terms, prefix)
+
+	end := start
+	for end < len(i.terms) && strings.HasPrefix(i.terms[end], prefix) {
+		end++
+	}
+
+	return i.terms[start:end]
+}
+
+// Returns the items matching every term of the query ordered by relevance
+func (i *searchIndex) Search(query string) []searchResult {
+	terms := parseSearchQuery(query)
+	if len(terms) == 0 {
+		return []searchResult{}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var scores map[string]float64
+
+	for _, term := range terms {
+		termScores := make(map[string]float64)
+
+		for _, token := range i.tokensWithPrefix(term.value) {
+			boost := 1.0
+			if token == term.value {
+				boost = exactMatchBoost
+			}
+
+			for id, fields := range i.postings[token] {
+				matchedFields := fields & term.fields
+				if matchedFields == 0 {
+					continue
+				}
+
+				for field, weight := range searchFieldWeights {
+					if matchedFields&field != 0 {
+						termScores[id] += weight * boost
+					}
+				}
+			}
+		}
+
+		// every term must match, keep only items matched by the previous terms
+		if scores == nil {
+			scores = termScores
+		} else {
+			for id, score := range scores {
+				if termScore, ok := termScores[id]; ok {
+					scores[id] = score + termScore
+				} else {
+					delete(scores, id)
+				}
+			}
+		}
+
+		if len(scores) == 0 {
+			break
+		}
+	}
+
+	results := make([]searchResult, 0, len(scores))
+	for id, score := range scores {
+		results = append(results, searchResult{item: i.items[id], score: score})
+	}
+
+	sort.Slice(results, func(a, b int) bool {
+		if results[a].score != results[b].score {
+			return results[a].score > results[b].score
+		}
+
+		return strings.ToLower(results[a].item.Name) < strings.ToLower(results[b].item.Name)
+	})
+
+	return results
+}
+
+/*
+** Splits a query into terms. A term can be restricted to a field with a prefix (artist:blue)
+** and values with spaces can be quoted (album:"kind of blue"), in which case every word of
+** the value becomes a term for that field.
+ */
+func parseSearchQuery(query string) []searchTerm {
+	terms := make([]searchTerm, 0)
+
+	for _, part := range splitSearchQuery(query) {
+		fields := allSearchFields
+
+		if name, value, ok := strings.Cut(part, ":"); ok {
+			if field, known := searchFieldPrefixes[strings.ToLower(name)]; known {
+				fields = field
+				part = value
+			}
+		}
+
+		for _, token := range tokenize(part) {
+			terms = append(terms, searchTerm{value: token, fields: fields})
+		}
+	}
+
+	return terms
+}
+
+// Splits on spaces that are not within double quotes
+func splitSearchQuery(query string) []string {
+	parts := make([]string, 0)
+	current := strings.Builder{}
+	quoted := false
+
+	for _, r := range query {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case unicode.IsSpace(r) && !quoted:
+			if current.Len() > 0 {
+				parts = append(parts, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+
+	if current.Len() > 0 {
+		parts = append(parts, current.String())
+	}
+
+	return parts
+}
+
+// Lower cases, removes diacritics and splits a value into words
+func tokenize(value string) []string {
+	return strings.FieldsFunc(foldText(value), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func foldText(value string) string {
+	folded := strings.Builder{}
+	folded.Grow(len(value))
+
+	for _, r := range strings.ToLower(value) {
+		if replacement, ok := diacriticFolds[r]; ok {
+			folded.WriteString(replacement)
+		} else if !unicode.Is(unicode.Mn, r) {
+			// drop combining marks of decomposed characters
+			folded.WriteRune(r)
+		}
+	}
+
+	return folded.String()
+}
+
+// Lower case latin characters with diacritics and their plain equivalent
+var diacriticFolds = buildDiacriticFolds(map[string]string{
+	"a":  "àáâãäåāăą",
+	"ae": "æ",
+	"c":  "çćĉċč",
+	"d":  "ďđð",
+	"e":  "èéêëēĕėęě",
+	"g":  "ĝğġģ",
+	"h":  "ĥħ",
+	"i":  "ìíîïĩīĭįı",
+	"j":  "ĵ",
+	"k":  "ķ",
+	"l":  "ĺļľŀł",
+	"n":  "ñńņňŉ",
+	"o":  "òóôõöøōŏő",
+	"oe": "œ",
+	"r":  "ŕŗř",
+	"s":  "śŝşš",
+	"ss": "ß",
+	"t":  "ţťŧ",
+	"th": "þ",
+	"u":  "ùúûüũūŭůűų",
+	"w":  "ŵ",
+	"y":  "ýÿŷ",
+	"z":  "źżž",
+})
+
+func buildDiacriticFolds(folds map[string]string) map[rune]string {
+	result := make(map[rune]string)
+
+	for replacement, runes := range folds {
+		for _, r := range runes {
+			result[r] = replacement
+		}
+	}
+
+	return result
+}
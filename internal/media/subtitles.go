@@ -0,0 +1,236 @@
+package media
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	SubtitleFormatSrt = "srt"
+	SubtitleFormatVtt = "vtt"
+
+	// language of sidecars named after the video without a language suffix, ie movie.srt
+	subtitleLanguageUndefined = "und"
+)
+
+// Subtitle formats that can sit next to a video
+var subtitleFormats = map[string]bool{
+	"srt": true,
+	"vtt": true,
+	"ass": true,
+	"ssa": true,
+}
+
+// Language of a sidecar, ISO 639-1 or 639-2 code optionally followed by a region, ie en, fre or pt-BR
+var subtitleLanguagePattern = regexp.MustCompile(`^[a-zA-Z]{2,3}([-_][a-zA-Z0-9]{2,4})?$`)
+
+// Flags that can follow the language of a sidecar, hearing impaired subtitles are listed like full ones
+var subtitleFlags = map[string]bool{
+	"forced": true,
+	"sdh":    true,
+	"cc":     true,
+}
+
+// Media types that get their subtitle sidecars listed in their metadata
+var videoExtensions = map[string]bool{
+	"mp4":  true,
+	"m4v":  true,
+	"mkv":  true,
+	"webm": true,
+}
+
+type SubtitleMetadata struct {
+	Language string `json:"language"`
+	Format   string `json:"format"`
+	// only meant to be shown when the audio is in another language, ie signs or foreign dialog
+	Forced   bool   `json:"forced"`
+	FileName string `json:"fileName"`
+}
+
+// Metadata of media types that can have subtitle sidecars
+type subtitledMetadata interface {
+	subtitles() []SubtitleMetadata
+	withSubtitles(subtitles []SubtitleMetadata) interface{}
+}
+
+func (m Mp4Metadata) subtitles() []SubtitleMetadata {
+	return m.Subtitles
+}
+
+func (m Mp4Metadata) withSubtitles(subtitles []SubtitleMetadata) interface{} {
+	m.Subtitles = subtitles
+	return m
+}
+
+func (m MatroskaMetadata) subtitles() []SubtitleMetadata {
+	return m.Subtitles
+}
+
+func (m MatroskaMetadata) withSubtitles(subtitles []SubtitleMetadata) interface{} {
+	m.Subtitles = subtitles
+	return m
+}
+
+/*
+** Reads the language and flags between the name of the video and the extension of a sidecar, ie en.forced.
+** Anything else is part of the name of another file, ie movie.directors cut.en.srt is not a sidecar of movie.mkv.
+ */
+func parseSubtitleSuffix(suffix string, subtitle *SubtitleMetadata) bool {
+	if suffix == "" {
+		return true
+	}
+
+	parts := strings.Split(strings.ToLower(suffix), ".")
+
+	if !subtitleFlags[parts[0]] {
+		if !subtitleLanguagePattern.MatchString(parts[0]) {
+			return false
+		}
+
+		subtitle.Language = parts[0]
+		parts = parts[1:]
+	}
+
+	for _, flag := range parts {
+		if !subtitleFlags[flag] {
+			return false
+		}
+
+		if flag == "forced" {
+			subtitle.Forced = true
+		}
+	}
+
+	return true
+}
+
+/*
+** Lists the subtitle files named after the video, optionally followed by a language and flags,
+** ie movie.srt, movie.en.srt or movie.en.forced.srt for movie.mkv. Files named after another video
+** of the folder whose name starts like this one, ie movie.fr.srt next to movie.fr.mkv, belong to that video.
+ */
+func findSubtitleSidecars(item types.MediaItem) ([]SubtitleMetadata, error) {
+	entries, err := os.ReadDir(item.ParentDir)
+	if err != nil {
+		return nil, err
+	}
+
+	baseName := strings.TrimSuffix(filepath.Base(item.Path), filepath.Ext(item.Path))
+	subtitles := make([]SubtitleMetadata, 0)
+
+	// other videos whose name starts with the name of this one
+	otherVideos := make([]string, 0)
+
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+		otherBase := strings.TrimSuffix(name, filepath.Ext(name))
+
+		if !entry.IsDir() && videoExtensions[ext] && otherBase != baseName && strings.HasPrefix(otherBase, baseName+".") {
+			otherVideos = append(otherVideos, otherBase)
+		}
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		name := entry.Name()
+		ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+
+		if !subtitleFormats[ext] || !strings.HasPrefix(name, baseName+".") {
+			continue
+		}
+
+		ownedByOther := false
+		for _, otherBase := range otherVideos {
+			if strings.HasPrefix(name, otherBase+".") {
+				ownedByOther = true
+				break
+			}
+		}
+
+		if ownedByOther {
+			continue
+		}
+
+		subtitle := SubtitleMetadata{Language: subtitleLanguageUndefined, Format: ext, FileName: name}
+
+		suffix := strings.TrimPrefix(strings.TrimSuffix(strings.TrimPrefix(name, baseName), filepath.Ext(name)), ".")
+		if !parseSubtitleSuffix(suffix, &subtitle) {
+			continue
+		}
+
+		subtitles = append(subtitles, subtitle)
+	}
+
+	return subtitles, nil
+}
+
+// Lists the subtitle sidecars of video items in their metadata, other items are returned as is
+func withSidecarSubtitles(item types.MediaItem) types.MediaItem {
+	metadata, ok := item.Metadata.(subtitledMetadata)
+	if !ok || !videoExtensions[item.Extension] {
+		return item
+	}
+
+	subtitles, err := findSubtitleSidecars(item)
+	if err != nil {
+		log.Err(err).Msgf("failed to look for subtitles of %s", filepath.Base(item.Path))
+		return item
+	}
+
+	item.Metadata = metadata.withSubtitles(subtitles)
+
+	return item
+}
+
+// Picks the subtitles of the language, full subtitles are preferred over forced ones
+func findSubtitle(subtitles []SubtitleMetadata, language string) (SubtitleMetadata, bool) {
+	var forced *SubtitleMetadata
+
+	for i, subtitle := range subtitles {
+		if !strings.EqualFold(subtitle.Language, language) {
+			continue
+		}
+
+		if !subtitle.Forced {
+			return subtitle, true
+		}
+
+		if forced == nil {
+			forced = &subtitles[i]
+		}
+	}
+
+	if forced != nil {
+		return *forced, true
+	}
+
+	return SubtitleMetadata{}, false
+}
+
+// Converts SubRip subtitles to WebVTT, the cues are the same apart from the decimal separator of their timings
+func srtToVtt(srt []byte) []byte {
+	srt = bytes.TrimPrefix(srt, []byte("\xef\xbb\xbf"))
+	srt = bytes.ReplaceAll(srt, []byte("\r\n"), []byte("\n"))
+
+	lines := bytes.Split(srt, []byte("\n"))
+
+	for i, line := range lines {
+		if bytes.Contains(line, []byte("-->")) {
+			lines[i] = bytes.ReplaceAll(line, []byte(","), []byte("."))
+		}
+	}
+
+	vtt := []byte("WEBVTT\n\n")
+
+	return append(vtt, bytes.Join(lines, []byte("\n"))...)
+}
@@ -0,0 +1,94 @@
+package media
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
+)
+
+func TestParseSubtitleSuffix(t *testing.T) {
+	cases := map[string]struct {
+		ok       bool
+		language string
+		forced   bool
+	}{
+		"":                 {ok: true, language: subtitleLanguageUndefined},
+		"en":               {ok: true, language: "en"},
+		"FRE":              {ok: true, language: "fre"},
+		"pt-BR":            {ok: true, language: "pt-br"},
+		"en.forced":        {ok: true, language: "en", forced: true},
+		"en.sdh":           {ok: true, language: "en"},
+		"forced":           {ok: true, language: subtitleLanguageUndefined, forced: true},
+		"Directors Cut.en": {},
+		"en.commentary":    {},
+		"directors":        {},
+	}
+
+	for suffix, c := range cases {
+		subtitle := SubtitleMetadata{Language: subtitleLanguageUndefined}
+
+		ok := parseSubtitleSuffix(suffix, &subtitle)
+		if ok != c.ok {
+			t.Errorf("%q: expected ok to be %t", suffix, c.ok)
+			continue
+		}
+
+		if ok && (subtitle.Language != c.language || subtitle.Forced != c.forced) {
+			t.Errorf("%q: got language %q and forced %t", suffix, subtitle.Language, subtitle.Forced)
+		}
+	}
+}
+
+func TestFindSubtitleSidecars(t *testing.T) {
+	dir := t.TempDir()
+
+	files := []string{
+		"Alien.mkv",
+		"Alien.srt",
+		"Alien.en.srt",
+		"Alien.pt-BR.vtt",
+		"Alien.fre.forced.srt",
+		"Alien.Directors Cut.en.srt",
+		"Alien.en.commentary.srt",
+		"Alien.fr.mkv",
+		"Alien.fr.srt",
+		"Aliens.en.srt",
+		"Alien.nfo",
+	}
+
+	for _, name := range files {
+		err := os.WriteFile(filepath.Join(dir, name), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	item := types.MediaItem{Path: filepath.Join(dir, "Alien.mkv"), ParentDir: dir, Extension: "mkv"}
+
+	subtitles, err := findSubtitleSidecars(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, 0, len(subtitles))
+	for _, subtitle := range subtitles {
+		names = append(names, subtitle.FileName)
+	}
+
+	sort.Strings(names)
+
+	expected := []string{"Alien.en.srt", "Alien.fre.forced.srt", "Alien.pt-BR.vtt", "Alien.srt"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+
+	// the french cut owns its own subtitles
+	subtitles, err = findSubtitleSidecars(types.MediaItem{Path: filepath.Join(dir, "Alien.fr.mkv"), ParentDir: dir, Extension: "mkv"})
+	if err != nil || len(subtitles) != 1 || subtitles[0].FileName != "Alien.fr.srt" {
+		t.Fatalf("unexpected subtitles of the other video %+v: %v", subtitles, err)
+	}
+}
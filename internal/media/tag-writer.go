@@ -0,0 +1,118 @@
+package media
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/egfanboy/mediapire-common/exceptions"
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
+)
+
+const (
+	// padding left after the tags when they outgrow their space so the next edits do not move the audio
+	tagPadding = 4096
+)
+
+// Encodes the patched tags of the file of the item, they replace the first audioOffset bytes of the file
+type tagWriter func(item types.MediaItem, patch types.MediaMetadataPatch) (tags []byte, audioOffset int64, err error)
+
+var tagWriters = map[string]tagWriter{
+	"mp3":  writeId3v2Tags,
+	"flac": writeFlacTags,
+}
+
+func getTagWriter(ext string) (tagWriter, error) {
+	writer, ok := tagWriters[ext]
+	if !ok {
+		return nil, &exceptions.ApiException{
+			StatusCode: http.StatusBadRequest,
+			Err:        fmt.Errorf("writing tags is not supported for media of type %s", ext),
+		}
+	}
+
+	return writer, nil
+}
+
+// Track index and count once the patch is applied, ok is false when the patch does not change them
+func patchedTrack(patch types.MediaMetadataPatch, current trackInfo) (index int, of int, ok bool) {
+	if patch.TrackIndex == nil && patch.TrackOf == nil {
+		return 0, 0, false
+	}
+
+	index, of = current.TrackIndex, current.TrackOf
+
+	if patch.TrackIndex != nil {
+		index = *patch.TrackIndex
+	}
+
+	if patch.TrackOf != nil {
+		of = *patch.TrackOf
+	}
+
+	return index, of, true
+}
+
+/*
+** Replaces the first audioOffset bytes of the file with the tags. The file is written next to the original and
+** replaces it like new content does, the previous content is kept as its backup so the change can be rolled back.
+ */
+func replaceTags(item types.MediaItem, tags []byte, audioOffset int64) error {
+	info, err := os.Stat(item.Path)
+	if err != nil {
+		return err
+	}
+
+	updatePath := getUpdatePath(item.Path)
+
+	err = writeWithTags(updatePath, item.Path, tags, audioOffset, info.Mode().Perm())
+	if err != nil {
+		os.Remove(updatePath)
+		return err
+	}
+
+	return commitFileUpdate(item, updatePath)
+}
+
+// Writes the tags followed by the audio of src, starting at audioOffset, to dst
+func writeWithTags(dst string, src string, tags []byte, audioOffset int64, perm os.FileMode) error {
+	original, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer original.Close()
+
+	rewritten, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	err = copyWithTags(rewritten, original, tags, audioOffset)
+	if err != nil {
+		rewritten.Close()
+		return err
+	}
+
+	return rewritten.Close()
+}
+
+func copyWithTags(dst *os.File, src *os.File, tags []byte, audioOffset int64) error {
+	_, err := dst.Write(tags)
+	if err != nil {
+		return err
+	}
+
+	_, err = src.Seek(audioOffset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		return err
+	}
+
+	return dst.Sync()
+}
@@ -0,0 +1,116 @@
+package media
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dhowden/tag"
+	"github.com/egfanboy/mediapire-media-host/pkg/types"
+)
+
+// Bytes standing in for the audio of a file, the writers never look at them
+var fakeAudio = bytes.Repeat([]byte{0xde, 0xad, 0xbe, 0xef}, 1024)
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+/*
+** Runs the writer on the file and writes the result next to it like a patch does, returns the new content and
+** whether the tags kept the size of the previous ones.
+ */
+func applyTagWriter(t *testing.T, writer tagWriter, item types.MediaItem, patch types.MediaMetadataPatch) ([]byte, bool) {
+	t.Helper()
+
+	tags, audioOffset, err := writer(item, patch)
+	if err != nil {
+		t.Fatalf("writing tags: %v", err)
+	}
+
+	updatePath := getUpdatePath(item.Path)
+
+	err = writeWithTags(updatePath, item.Path, tags, audioOffset, 0644)
+	if err != nil {
+		t.Fatalf("rewriting file: %v", err)
+	}
+
+	content, err := os.ReadFile(updatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return content, int64(len(tags)) == audioOffset
+}
+
+func writeTestFile(t *testing.T, name string, content []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+
+	err := os.WriteFile(path, content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func readTestTags(t *testing.T, content []byte) tag.Metadata {
+	t.Helper()
+
+	m, err := tag.ReadFrom(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("reading tags back: %v", err)
+	}
+
+	return m
+}
+
+func assertAudioKept(t *testing.T, content []byte) {
+	t.Helper()
+
+	if !bytes.HasSuffix(content, fakeAudio) {
+		t.Fatal("audio was not kept after the tags")
+	}
+}
+
+func TestWriteWithTagsReplacesHead(t *testing.T) {
+	path := writeTestFile(t, "file", append([]byte("old-tags"), fakeAudio...))
+	dst := filepath.Join(filepath.Dir(path), "rewritten")
+
+	err := writeWithTags(dst, path, []byte("new, longer tags"), int64(len("old-tags")), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(content, append([]byte("new, longer tags"), fakeAudio...)) {
+		t.Fatal("rewritten file does not have the new tags followed by the audio")
+	}
+
+	original, _ := os.ReadFile(path)
+	if !bytes.HasPrefix(original, []byte("old-tags")) {
+		t.Fatal("original file was modified")
+	}
+}
+
+func readTestFile(t *testing.T, path string) []byte {
+	t.Helper()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return content
+}
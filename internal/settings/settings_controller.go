@@ -43,5 +43,5 @@ func initController() settingsController {
 }
 
 func init() {
-	app.GetApp().ControllerRegistry.Register(initController())
+	app.RegisterController(initController())
 }
@@ -1,54 +1,52 @@
 package transfers
 
 import (
-	"errors"
 	"net/http"
 
-	"github.com/egfanboy/mediapire-media-host/internal/app"
-
-	"github.com/egfanboy/mediapire-common/router"
+	"github.com/egfanboy/mediapire-media-host/internal/utils"
+	"github.com/gorilla/mux"
 )
 
-const basePath = "/transfers"
+const (
+	// not built by the v1 route builder so it needs the full api path
+	pathDownload = "/api/v1/transfers/{transferId}/download"
+)
 
 type transfersController struct {
-	builders []func() router.RouteBuilder
-	service  transfersApi
+	service transfersApi
 }
 
-func (c transfersController) GetApis() (routes []router.RouteBuilder) {
-	for _, b := range c.builders {
-
-		routes = append(routes, b())
+// Serves the archive from disk in chunks instead of loading it in memory
+func (c transfersController) Download(w http.ResponseWriter, request *http.Request) {
+	if request.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
 	}
 
-	return
-}
+	transferId := mux.Vars(request)["transferId"]
 
-func (c transfersController) HandleRegister() router.RouteBuilder {
-	return router.NewV1RouteBuilder().
-		SetMethod(http.MethodOptions, http.MethodGet).
-		SetPath(basePath + "/{transferId}/download").
-		SetDataType(router.DataTypeFile).
-		SetReturnCode(http.StatusOK).
-		SetHandler(func(request *http.Request, p router.RouteParams) (interface{}, error) {
-			transferId, ok := p.Params["transferId"]
-			if !ok {
-				return nil, errors.New("transferId not found in API path")
-			}
-
-			return c.service.Download(request.Context(), transferId)
-		})
-}
+	file, err := c.service.Download(request.Context(), transferId)
+	if err != nil {
+		utils.WriteHttpError(w, err)
+		return
+	}
 
-func initController() transfersController {
-	c := transfersController{service: newTransfersService()}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		utils.WriteHttpError(w, err)
+		return
+	}
 
-	c.builders = append(c.builders, c.HandleRegister)
+	w.Header().Set("Content-Type", "application/zip")
 
-	return c
+	http.ServeContent(w, request, transferId+".zip", info.ModTime(), file)
 }
 
-func init() {
-	app.GetApp().ControllerRegistry.Register(initController())
+// Registers the routes that cannot be expressed through a route builder
+func BuildRawRoutes(r *mux.Router) {
+	c := transfersController{service: newTransfersService()}
+
+	r.HandleFunc(pathDownload, c.Download).Methods(http.MethodOptions, http.MethodGet, http.MethodHead)
 }
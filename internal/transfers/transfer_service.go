@@ -2,28 +2,37 @@ package transfers
 
 import (
 	"context"
+	"errors"
+	"net/http"
 	"os"
 	"path"
 
+	"github.com/egfanboy/mediapire-common/exceptions"
 	"github.com/egfanboy/mediapire-media-host/internal/app"
 	"github.com/rs/zerolog/log"
 )
 
 type transfersApi interface {
-	Download(ctx context.Context, transferId string) ([]byte, error)
+	Download(ctx context.Context, transferId string) (*os.File, error)
 }
 
 type transfersService struct {
 }
 
-func (s *transfersService) Download(ctx context.Context, transferId string) ([]byte, error) {
-	fileContent, err := os.ReadFile(path.Join(app.GetApp().DownloadPath, transferId+".zip"))
+// Opens the archive of a transfer, the caller is responsible for closing it
+func (s *transfersService) Download(ctx context.Context, transferId string) (*os.File, error) {
+	file, err := os.Open(path.Join(app.GetApp().DownloadPath, transferId+".zip"))
 	if err != nil {
 		log.Err(err).Msgf("Failed to open item for transfer with id %s", transferId)
+
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, &exceptions.ApiException{Err: err, StatusCode: http.StatusNotFound}
+		}
+
 		return nil, err
 	}
 
-	return fileContent, nil
+	return file, nil
 }
 
 func newTransfersService() transfersApi {
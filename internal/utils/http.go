@@ -0,0 +1,20 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/egfanboy/mediapire-common/exceptions"
+)
+
+// Writes an error to a response, using the status code of the error when it is an api exception
+func WriteHttpError(w http.ResponseWriter, err error) {
+	statusCode := http.StatusInternalServerError
+
+	var apiErr *exceptions.ApiException
+	if errors.As(err, &apiErr) {
+		statusCode = apiErr.StatusCode
+	}
+
+	http.Error(w, err.Error(), statusCode)
+}
@@ -1,11 +1,14 @@
 package api
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/egfanboy/mediapire-media-host/pkg/types"
@@ -15,16 +18,37 @@ const (
 	baseMediaPath     = "/api/v1/media"
 	baseTransfersPath = "/api/v1/transfers"
 	baseSettingsPath  = "/api/v1/settings"
+	baseArtistsPath   = "/api/v1/artists"
+	baseAlbumsPath    = "/api/v1/albums"
+	baseGenresPath    = "/api/v1/genres"
+	baseFoldersPath   = "/api/v1/folders"
+	baseOrganisePath  = "/api/v1/organise"
 )
 
 type MediaHostApi interface {
-	GetMedia(ctx context.Context, mediaTypes *[]string) ([]types.MediaItem, *http.Response, error)
+	GetMedia(ctx context.Context, options *GetMediaOptions) (types.MediaPage, *http.Response, error)
+	SearchMedia(ctx context.Context, search string, options *GetMediaOptions) (types.MediaPage, *http.Response, error)
+	GetArtists(ctx context.Context, options *PageOptions) (types.ArtistPage, *http.Response, error)
+	GetAlbums(ctx context.Context, options *PageOptions) (types.AlbumPage, *http.Response, error)
+	GetGenres(ctx context.Context, options *PageOptions) (types.GenrePage, *http.Response, error)
+	GetAlbumTracks(ctx context.Context, albumId string, options *PageOptions) (types.MediaPage, *http.Response, error)
+	GetFolders(ctx context.Context) ([]types.Folder, *http.Response, error)
+	GetFolder(ctx context.Context, folderId string) (types.Folder, *http.Response, error)
+	DownloadFolder(ctx context.Context, folderId string) ([]byte, *http.Response, error)
+	PreviewOrganise(ctx context.Context, request types.OrganiseRequest) (types.OrganisePlan, *http.Response, error)
+	OrganiseMedia(ctx context.Context, request types.OrganiseRequest) (types.OrganisePlan, *http.Response, error)
 	StreamMedia(ctx context.Context, mediaId string) ([]byte, *http.Response, error)
+	StreamMediaRange(ctx context.Context, mediaId string, start int64, end *int64) ([]byte, *http.Response, error)
 	DownloadTransfer(ctx context.Context, transferId string) ([]byte, *http.Response, error)
 	GetSettings(ctx context.Context) (types.MediaHostSettings, *http.Response, error)
 	GetMediaArt(ctx context.Context, mediaId string) ([]byte, *http.Response, error)
+	GetMediaSubtitles(ctx context.Context, mediaId string, language string, format string) ([]byte, *http.Response, error)
+	GetMediaChapters(ctx context.Context, mediaId string) ([]types.Chapter, *http.Response, error)
+	GetMediaLyrics(ctx context.Context, mediaId string) (types.Lyrics, *http.Response, error)
+	SaveMediaLyrics(ctx context.Context, mediaId string, lyrics types.Lyrics) (types.Lyrics, *http.Response, error)
 	GetMediaById(ctx context.Context, mediaId string) (types.MediaItem, *http.Response, error)
 	GetMediaByIdWithContent(ctx context.Context, mediaId string) (types.MediaItemWithContent, *http.Response, error)
+	PatchMediaMetadata(ctx context.Context, mediaId string, patch types.MediaMetadataPatch) (types.MediaItem, *http.Response, error)
 }
 
 func buildUriFromHost(h types.Host, apiUri string) string {
@@ -35,11 +59,362 @@ type mediaHostClient struct {
 	host types.Host
 }
 
-func (c *mediaHostClient) GetMedia(ctx context.Context, mediaTypes *[]string) (result []types.MediaItem, r *http.Response, err error) {
+// Options to list media, the zero value returns all media
+type GetMediaOptions struct {
+	MediaTypes []string
+	// one of name, artist, album, added or length
+	Sort string
+	// asc or desc
+	Order string
+	// metadata field (artist, albumArtist, album, genre, title, year) to the exact value to match
+	Filters map[string]string
+	// when set only a page of media is returned, use the NextCursor of the page to get the next one
+	Limit  int
+	Offset int
+	Cursor string
+}
+
+func (o *GetMediaOptions) isPaginated() bool {
+	return o != nil && (o.Limit > 0 || o.Cursor != "")
+}
+
+func (o *GetMediaOptions) encode() string {
+	if o == nil {
+		return ""
+	}
+
+	params := url.Values{}
+
+	if len(o.MediaTypes) > 0 {
+		params.Set("mediaType", strings.Join(o.MediaTypes, ","))
+	}
+
+	if o.Sort != "" {
+		params.Set("sort", o.Sort)
+	}
+
+	if o.Order != "" {
+		params.Set("order", o.Order)
+	}
+
+	for field, value := range o.Filters {
+		params.Set(field, value)
+	}
+
+	if o.Limit > 0 {
+		params.Set("limit", strconv.Itoa(o.Limit))
+	}
+
+	if o.Offset > 0 {
+		params.Set("offset", strconv.Itoa(o.Offset))
+	}
+
+	if o.Cursor != "" {
+		params.Set("cursor", o.Cursor)
+	}
+
+	return params.Encode()
+}
+
+// Options to page through artists, albums, genres and album tracks, the zero value returns everything
+type PageOptions struct {
+	Limit  int
+	Offset int
+	Cursor string
+}
+
+func (o *PageOptions) encode() string {
+	if o == nil {
+		return ""
+	}
+
+	params := url.Values{}
+
+	if o.Limit > 0 {
+		params.Set("limit", strconv.Itoa(o.Limit))
+	}
+
+	if o.Offset > 0 {
+		params.Set("offset", strconv.Itoa(o.Offset))
+	}
+
+	if o.Cursor != "" {
+		params.Set("cursor", o.Cursor)
+	}
+
+	return params.Encode()
+}
+
+func (c *mediaHostClient) GetMedia(ctx context.Context, options *GetMediaOptions) (result types.MediaPage, r *http.Response, err error) {
 	apiUrl := baseMediaPath
 
-	if mediaTypes != nil && len(*mediaTypes) > 0 {
-		apiUrl = apiUrl + fmt.Sprintf("?mediaType=%s", strings.Join(*mediaTypes, ","))
+	if query := options.encode(); query != "" {
+		apiUrl = apiUrl + "?" + query
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, buildUriFromHost(c.host, apiUrl), nil)
+	if err != nil {
+		return
+	}
+
+	r, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		return
+	}
+
+	if options.isPaginated() {
+		err = json.Unmarshal(body, &result)
+
+		return
+	}
+
+	// host returns a plain list when not paginating
+	err = json.Unmarshal(body, &result.Items)
+	result.Total = len(result.Items)
+
+	return
+}
+
+func (c *mediaHostClient) GetArtists(ctx context.Context, options *PageOptions) (result types.ArtistPage, r *http.Response, err error) {
+	apiUrl := baseArtistsPath
+
+	if query := options.encode(); query != "" {
+		apiUrl = apiUrl + "?" + query
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, buildUriFromHost(c.host, apiUrl), nil)
+	if err != nil {
+		return
+	}
+
+	r, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+
+	defer r.Body.Close()
+
+	if r.StatusCode >= 300 {
+		err = fmt.Errorf("request failed with status %d", r.StatusCode)
+		return
+	}
+
+	err = json.NewDecoder(r.Body).Decode(&result)
+
+	return
+}
+
+func (c *mediaHostClient) GetAlbums(ctx context.Context, options *PageOptions) (result types.AlbumPage, r *http.Response, err error) {
+	apiUrl := baseAlbumsPath
+
+	if query := options.encode(); query != "" {
+		apiUrl = apiUrl + "?" + query
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, buildUriFromHost(c.host, apiUrl), nil)
+	if err != nil {
+		return
+	}
+
+	r, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+
+	defer r.Body.Close()
+
+	if r.StatusCode >= 300 {
+		err = fmt.Errorf("request failed with status %d", r.StatusCode)
+		return
+	}
+
+	err = json.NewDecoder(r.Body).Decode(&result)
+
+	return
+}
+
+func (c *mediaHostClient) GetGenres(ctx context.Context, options *PageOptions) (result types.GenrePage, r *http.Response, err error) {
+	apiUrl := baseGenresPath
+
+	if query := options.encode(); query != "" {
+		apiUrl = apiUrl + "?" + query
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, buildUriFromHost(c.host, apiUrl), nil)
+	if err != nil {
+		return
+	}
+
+	r, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+
+	defer r.Body.Close()
+
+	if r.StatusCode >= 300 {
+		err = fmt.Errorf("request failed with status %d", r.StatusCode)
+		return
+	}
+
+	err = json.NewDecoder(r.Body).Decode(&result)
+
+	return
+}
+
+// Tracks of the album ordered by disc then track
+func (c *mediaHostClient) GetAlbumTracks(ctx context.Context, albumId string, options *PageOptions) (result types.MediaPage, r *http.Response, err error) {
+	apiUrl := fmt.Sprintf("%s/%s/tracks", baseAlbumsPath, albumId)
+
+	if query := options.encode(); query != "" {
+		apiUrl = apiUrl + "?" + query
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, buildUriFromHost(c.host, apiUrl), nil)
+	if err != nil {
+		return
+	}
+
+	r, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+
+	defer r.Body.Close()
+
+	if r.StatusCode >= 300 {
+		err = fmt.Errorf("request failed with status %d", r.StatusCode)
+		return
+	}
+
+	err = json.NewDecoder(r.Body).Decode(&result)
+
+	return
+}
+
+// Tree of each directory of the host with the folders and media in it
+func (c *mediaHostClient) GetFolders(ctx context.Context) (result []types.Folder, r *http.Response, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, buildUriFromHost(c.host, baseFoldersPath), nil)
+	if err != nil {
+		return
+	}
+
+	r, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+
+	defer r.Body.Close()
+
+	if r.StatusCode >= 300 {
+		err = fmt.Errorf("request failed with status %d", r.StatusCode)
+		return
+	}
+
+	err = json.NewDecoder(r.Body).Decode(&result)
+
+	return
+}
+
+func (c *mediaHostClient) GetFolder(ctx context.Context, folderId string) (result types.Folder, r *http.Response, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, buildUriFromHost(c.host, fmt.Sprintf("%s/%s", baseFoldersPath, folderId)), nil)
+	if err != nil {
+		return
+	}
+
+	r, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+
+	defer r.Body.Close()
+
+	if r.StatusCode >= 300 {
+		err = fmt.Errorf("request failed with status %d", r.StatusCode)
+		return
+	}
+
+	err = json.NewDecoder(r.Body).Decode(&result)
+
+	return
+}
+
+// Zip archive of the media under the folder, keeping the structure of its subfolders
+func (c *mediaHostClient) DownloadFolder(ctx context.Context, folderId string) ([]byte, *http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, buildUriFromHost(c.host, fmt.Sprintf("%s/%s/download", baseFoldersPath, folderId)), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, r, err
+	}
+
+	if r.StatusCode >= 300 {
+		return nil, r, fmt.Errorf("request failed with status %d", r.StatusCode)
+	}
+
+	b, err := io.ReadAll(r.Body)
+
+	defer r.Body.Close()
+
+	return b, r, err
+}
+
+// Lists where the template would move the media of the host without moving anything
+func (c *mediaHostClient) PreviewOrganise(ctx context.Context, request types.OrganiseRequest) (types.OrganisePlan, *http.Response, error) {
+	return c.organise(ctx, baseOrganisePath+"/preview", request)
+}
+
+// Moves the media of the host to the path the template gives them, the media keep their id
+func (c *mediaHostClient) OrganiseMedia(ctx context.Context, request types.OrganiseRequest) (types.OrganisePlan, *http.Response, error) {
+	return c.organise(ctx, baseOrganisePath, request)
+}
+
+func (c *mediaHostClient) organise(ctx context.Context, apiUrl string, request types.OrganiseRequest) (result types.OrganisePlan, r *http.Response, err error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, buildUriFromHost(c.host, apiUrl), bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	r, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+
+	defer r.Body.Close()
+
+	if r.StatusCode >= 300 {
+		err = fmt.Errorf("request failed with status %d", r.StatusCode)
+		return
+	}
+
+	err = json.NewDecoder(r.Body).Decode(&result)
+
+	return
+}
+
+// Searches the metadata of the media on the host, search supports field prefixes such as artist:, album: and genre:
+func (c *mediaHostClient) SearchMedia(ctx context.Context, search string, options *GetMediaOptions) (result types.MediaPage, r *http.Response, err error) {
+	apiUrl := fmt.Sprintf("%s/search?q=%s", baseMediaPath, url.QueryEscape(search))
+
+	// sorting is decided by relevance
+	if query := options.encode(); query != "" {
+		apiUrl = apiUrl + "&" + query
 	}
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, buildUriFromHost(c.host, apiUrl), nil)
@@ -58,6 +433,11 @@ func (c *mediaHostClient) GetMedia(ctx context.Context, mediaTypes *[]string) (r
 		return
 	}
 
+	if r.StatusCode >= 300 {
+		err = fmt.Errorf("request failed with status %d", r.StatusCode)
+		return
+	}
+
 	err = json.Unmarshal(body, &result)
 
 	return
@@ -81,6 +461,38 @@ func (c *mediaHostClient) StreamMedia(ctx context.Context, mediaId string) (b []
 	return
 }
 
+// Requests the bytes from start to end (inclusive) of a media item, if end is nil the rest of the item is returned
+func (c *mediaHostClient) StreamMediaRange(ctx context.Context, mediaId string, start int64, end *int64) (b []byte, r *http.Response, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, buildUriFromHost(c.host, fmt.Sprintf("%s/stream?id=%s", baseMediaPath, mediaId)), nil)
+	if err != nil {
+		return
+	}
+
+	byteRange := fmt.Sprintf("bytes=%d-", start)
+	if end != nil {
+		byteRange = fmt.Sprintf("%s%d", byteRange, *end)
+	}
+
+	req.Header.Set("Range", byteRange)
+
+	r, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+
+	defer r.Body.Close()
+
+	// host will answer with the full content if it does not honour the range, treat it as a failure
+	if r.StatusCode != http.StatusPartialContent {
+		err = fmt.Errorf("request failed with status %d", r.StatusCode)
+		return
+	}
+
+	b, err = io.ReadAll(r.Body)
+
+	return
+}
+
 func (c *mediaHostClient) DownloadTransfer(ctx context.Context, transferId string) ([]byte, *http.Response, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, buildUriFromHost(c.host, fmt.Sprintf("%s/%s/download", baseTransfersPath, transferId)), nil)
 	if err != nil {
@@ -147,6 +559,110 @@ func (c *mediaHostClient) GetMediaArt(ctx context.Context, mediaId string) ([]by
 	return b, r, err
 }
 
+// Format is optional, vtt converts srt subtitles to WebVTT
+func (c *mediaHostClient) GetMediaSubtitles(ctx context.Context, mediaId string, language string, format string) ([]byte, *http.Response, error) {
+	apiUrl := fmt.Sprintf("%s/%s/subtitles/%s", baseMediaPath, mediaId, url.PathEscape(language))
+	if format != "" {
+		apiUrl = fmt.Sprintf("%s?format=%s", apiUrl, url.QueryEscape(format))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, buildUriFromHost(c.host, apiUrl), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, r, err
+	}
+
+	defer r.Body.Close()
+
+	if r.StatusCode >= 300 {
+		return nil, r, fmt.Errorf("request failed with status %d", r.StatusCode)
+	}
+
+	b, err := io.ReadAll(r.Body)
+
+	return b, r, err
+}
+
+func (c *mediaHostClient) GetMediaChapters(ctx context.Context, mediaId string) (result []types.Chapter, r *http.Response, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, buildUriFromHost(c.host, fmt.Sprintf("%s/%s/chapters", baseMediaPath, mediaId)), nil)
+	if err != nil {
+		return
+	}
+
+	r, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+
+	defer r.Body.Close()
+
+	if r.StatusCode >= 300 {
+		err = fmt.Errorf("request failed with status %d", r.StatusCode)
+		return
+	}
+
+	err = json.NewDecoder(r.Body).Decode(&result)
+
+	return
+}
+
+func (c *mediaHostClient) GetMediaLyrics(ctx context.Context, mediaId string) (result types.Lyrics, r *http.Response, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, buildUriFromHost(c.host, fmt.Sprintf("%s/%s/lyrics", baseMediaPath, mediaId)), nil)
+	if err != nil {
+		return
+	}
+
+	r, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+
+	defer r.Body.Close()
+
+	if r.StatusCode >= 300 {
+		err = fmt.Errorf("request failed with status %d", r.StatusCode)
+		return
+	}
+
+	err = json.NewDecoder(r.Body).Decode(&result)
+
+	return
+}
+
+func (c *mediaHostClient) SaveMediaLyrics(ctx context.Context, mediaId string, lyrics types.Lyrics) (result types.Lyrics, r *http.Response, err error) {
+	body, err := json.Marshal(lyrics)
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, buildUriFromHost(c.host, fmt.Sprintf("%s/%s/lyrics", baseMediaPath, mediaId)), bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	r, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+
+	defer r.Body.Close()
+
+	if r.StatusCode >= 300 {
+		err = fmt.Errorf("request failed with status %d", r.StatusCode)
+		return
+	}
+
+	err = json.NewDecoder(r.Body).Decode(&result)
+
+	return
+}
+
 func (c *mediaHostClient) GetMediaById(ctx context.Context, mediaId string) (result types.MediaItem, r *http.Response, err error) {
 	data, r, err := c.getMediaById(ctx, mediaId, false)
 	if err != nil {
@@ -191,6 +707,37 @@ func (c *mediaHostClient) getMediaById(ctx context.Context, mediaId string, retu
 	return
 
 }
+
+func (c *mediaHostClient) PatchMediaMetadata(ctx context.Context, mediaId string, patch types.MediaMetadataPatch) (result types.MediaItem, r *http.Response, err error) {
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, buildUriFromHost(c.host, fmt.Sprintf("%s/%s/metadata", baseMediaPath, mediaId)), bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	r, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+
+	defer r.Body.Close()
+
+	if r.StatusCode >= 300 {
+		err = fmt.Errorf("request failed with status %d", r.StatusCode)
+		return
+	}
+
+	err = json.NewDecoder(r.Body).Decode(&result)
+
+	return
+}
+
 func NewClient(h types.Host) MediaHostApi {
 	return &mediaHostClient{host: h}
 }
@@ -16,3 +16,135 @@ type MediaItemWithContent struct {
 }
 
 type DownloadRequest []string
+
+// A page of media items, NextCursor is empty on the last page
+type MediaPage struct {
+	Items      []MediaItem `json:"items"`
+	Total      int         `json:"total"`
+	Offset     int         `json:"offset"`
+	Limit      int         `json:"limit"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+}
+
+// Changes to the tags of a media item, nil fields are left untouched and empty values remove the tag
+type MediaMetadataPatch struct {
+	Title      *string `json:"title,omitempty"`
+	Artist     *string `json:"artist,omitempty"`
+	Album      *string `json:"album,omitempty"`
+	Genre      *string `json:"genre,omitempty"`
+	TrackIndex *int    `json:"trackIndex,omitempty"`
+	TrackOf    *int    `json:"trackOf,omitempty"`
+	// Image to embed as the front cover
+	Art []byte `json:"art,omitempty"`
+}
+
+type LyricsLine struct {
+	// milliseconds from the start of the track, always 0 for lyrics that are not synced
+	Time int64  `json:"time"`
+	Text string `json:"text"`
+}
+
+type Lyrics struct {
+	Synced   bool         `json:"synced"`
+	Language string       `json:"language,omitempty"`
+	Lines    []LyricsLine `json:"lines"`
+}
+
+type Chapter struct {
+	Title string `json:"title"`
+	// seconds from the start of the item
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+// Artists are the album artists of the items, or their artist when they have none
+type Artist struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	AlbumCount int    `json:"albumCount"`
+	TrackCount int    `json:"trackCount"`
+	// total length of the tracks in seconds
+	Length float64 `json:"length"`
+	// id of the media item whose art represents the artist, empty when none of its items can have art
+	ArtId string `json:"artId,omitempty"`
+}
+
+type Album struct {
+	Id         string  `json:"id"`
+	Title      string  `json:"title"`
+	Artist     string  `json:"artist"`
+	Year       int     `json:"year,omitempty"`
+	TrackCount int     `json:"trackCount"`
+	Length     float64 `json:"length"`
+	ArtId      string  `json:"artId,omitempty"`
+}
+
+type Genre struct {
+	Id         string  `json:"id"`
+	Name       string  `json:"name"`
+	TrackCount int     `json:"trackCount"`
+	Length     float64 `json:"length"`
+	ArtId      string  `json:"artId,omitempty"`
+}
+
+type ArtistPage struct {
+	Items      []Artist `json:"items"`
+	Total      int      `json:"total"`
+	Offset     int      `json:"offset"`
+	Limit      int      `json:"limit"`
+	NextCursor string   `json:"nextCursor,omitempty"`
+}
+
+type AlbumPage struct {
+	Items      []Album `json:"items"`
+	Total      int     `json:"total"`
+	Offset     int     `json:"offset"`
+	Limit      int     `json:"limit"`
+	NextCursor string  `json:"nextCursor,omitempty"`
+}
+
+type GenrePage struct {
+	Items      []Genre `json:"items"`
+	Total      int     `json:"total"`
+	Offset     int     `json:"offset"`
+	Limit      int     `json:"limit"`
+	NextCursor string  `json:"nextCursor,omitempty"`
+}
+
+// Folder within one of the directories of the host, paths are relative to that directory
+type Folder struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	// empty for the directory itself
+	Path    string      `json:"path"`
+	Folders []Folder    `json:"folders"`
+	Media   []MediaItem `json:"media"`
+}
+
+// Options of an organise run, the template of the host and all of its media are used when they are omitted
+type OrganiseRequest struct {
+	Template string   `json:"template,omitempty"`
+	MediaIds []string `json:"mediaIds,omitempty"`
+}
+
+// Paths are relative to the directory of the host the item is in
+type OrganiseMove struct {
+	MediaId string `json:"mediaId"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+}
+
+// Item that cannot be moved, To is empty when the template could not be applied to it
+type OrganiseConflict struct {
+	MediaId string `json:"mediaId"`
+	From    string `json:"from"`
+	To      string `json:"to,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+type OrganisePlan struct {
+	Moves     []OrganiseMove     `json:"moves"`
+	Conflicts []OrganiseConflict `json:"conflicts"`
+	// items already named after the template
+	Unchanged int `json:"unchanged"`
+}
@@ -0,0 +1,33 @@
+package types
+
+const (
+	// Routing key to patch the tags of media items, hosts answer with a media updated message for the changeset
+	TopicPatchMediaMetadata = "media.metadata.patch"
+	// Routing key of the message sent when items of a host were renamed or moved, their ids do not change
+	TopicMediaMoved = "media.moved"
+)
+
+type MediaMetadataPatchItem struct {
+	MediaId string             `json:"mediaId"`
+	Patch   MediaMetadataPatch `json:"patch"`
+}
+
+type PatchMediaMetadataMessage struct {
+	ChangesetId string `json:"changesetId"`
+	// Node id to the items to patch on that node
+	Items map[string][]MediaMetadataPatchItem `json:"items"`
+}
+
+type MovedMediaItem struct {
+	MediaId string `json:"mediaId"`
+	Name    string `json:"name"`
+	// ids of the folders the item is in now and was in before, see the folders api
+	FolderId         string `json:"folderId"`
+	PreviousName     string `json:"previousName"`
+	PreviousFolderId string `json:"previousFolderId"`
+}
+
+type MediaMovedMessage struct {
+	NodeId string           `json:"nodeId"`
+	Items  []MovedMediaItem `json:"items"`
+}